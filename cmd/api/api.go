@@ -13,12 +13,14 @@ import (
 	"goEcommerce/internal/driver"
 	"goEcommerce/internal/encryption"
 	"goEcommerce/internal/models"
-	"goEcommerce/internal/urlsigner"
+	"goEcommerce/internal/storage"
+	"goEcommerce/internal/throttle"
 	"goEcommerce/internal/validator"
 	"golang.org/x/crypto/bcrypt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -34,8 +36,16 @@ type config struct {
 		dsn string
 	}
 	stripe struct {
-		secret string
-		key    string
+		secret        string
+		key           string
+		webhookSecret string
+	}
+	gateway string
+	limiter string
+	storage struct {
+		name string
+		dir  string
+		url  string
 	}
 	smtp struct {
 		host     string
@@ -43,8 +53,9 @@ type config struct {
 		username string
 		password string
 	}
-	secretkey string
-	frontend  string
+	encryptionkeys string
+	indexkey       string
+	frontend       string
 }
 
 type application struct {
@@ -53,6 +64,12 @@ type application struct {
 	errorLog *log.Logger
 	version  string
 	DB       models.DBModel
+	Gateway  cards.PaymentGateway
+	Storage  storage.Storage
+	Keyring  *encryption.Keyring
+
+	AccountLimiter throttle.Limiter
+	IPLimiter      throttle.Limiter
 }
 
 func (app *application) serve() error {
@@ -80,17 +97,58 @@ func main() {
 	flag.StringVar(&cfg.smtp.username, "smtpuser", "406ff5e32131ed", "smtp user")
 	flag.StringVar(&cfg.smtp.password, "smtppass", "3ba16b17d0d4f1", "smtp password")
 	flag.IntVar(&cfg.smtp.port, "smtpport", 587, "smtp port")
-	flag.StringVar(&cfg.secretkey, "secret", "qdYaJw3sIhTVH5opBEr0PNoIXLWr5QqC", "secret key")
+	flag.StringVar(&cfg.encryptionkeys, "encryptionkeys", "dev:cWRZYUp3M3NJaFRWSDVvcEJFcjBQTm9JWExXcjVRcUM=", "Encryption keys as id:base64key, comma separated; the first encrypts new data")
+	flag.StringVar(&cfg.indexkey, "indexkey", "d2lkZ2V0cy1kZXYtYmxpbmQtaW5kZXgta2V5LTAwMDE=", "Base64 key for the blind indexes of encrypted emails; never rotated")
 	flag.StringVar(&cfg.frontend, "frontend", "http://localhost:4000", "url to front end")
+	flag.StringVar(&cfg.gateway, "gateway", "stripe", "Payment gateway {stripe|fake}")
+	flag.StringVar(&cfg.limiter, "limiter", "memory", "Login attempt limiter {memory}")
+	flag.StringVar(&cfg.storage.name, "storage", "local", "File storage for uploads {local}")
+	flag.StringVar(&cfg.storage.dir, "storagedir", "./static", "Directory for local file storage")
+	flag.StringVar(&cfg.storage.url, "storageurl", "/static", "Base url uploads are served from")
 
 	flag.Parse()
 
 	cfg.stripe.key = os.Getenv("STRIPE_KEY")
 	cfg.stripe.secret = os.Getenv("STRIPE_SECRET")
+	cfg.stripe.webhookSecret = os.Getenv("STRIPE_WEBHOOK_SECRET")
 
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 
+	if cfg.stripe.webhookSecret == "" {
+		errorLog.Println("STRIPE_WEBHOOK_SECRET is not set; stripe webhooks will be refused")
+	}
+
+	gateway, err := cards.NewGateway(cfg.gateway, cfg.stripe.secret, cfg.stripe.key)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	store, err := storage.New(cfg.storage.name, cfg.storage.dir, cfg.storage.url)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	keyring, err := encryption.New(cfg.encryptionkeys)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	indexKey, err := encryption.ParseIndexKey(cfg.indexkey)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	accountLimiter, err := throttle.New(cfg.limiter, accountLoginPolicy)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	ipLimiter, err := throttle.New(cfg.limiter, ipLoginPolicy)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
 	conn, err := driver.OpenDB(cfg.db.dsn)
 	if err != nil {
 		errorLog.Fatal(err)
@@ -107,73 +165,73 @@ func main() {
 		infoLog:  infoLog,
 		errorLog: errorLog,
 		version:  version,
-		DB:       models.DBModel{DB: conn},
+		DB:       models.DBModel{DB: conn, Keyring: keyring, IndexKey: indexKey},
+		Gateway:  gateway,
+		Storage:  store,
+		Keyring:  keyring,
+
+		AccountLimiter: accountLimiter,
+		IPLimiter:      ipLimiter,
 	}
 
+	go app.remindEndingTrials(time.Hour)
+
 	err = app.serve()
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-// GetPaymentIntent gets a payment intent, and returns json (or error json)
-func (app *application) GetPaymentIntent(w http.ResponseWriter, r *http.Request) {
-	var payload stripePayload
+// VirtualTerminalPaymentIntent returns a payment intent for an amount typed in by an admin user
+func (app *application) VirtualTerminalPaymentIntent(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Amount int `json:"amount"`
+	}
 
-	err := json.NewDecoder(r.Body).Decode(&payload)
+	err := app.readJSON(w, r, &payload)
 	if err != nil {
-		app.errorLog.Println(err)
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
 		return
 	}
 
-	amount, err := strconv.Atoi(payload.Amount)
+	if payload.Amount <= 0 {
+		app.writePaymentIntentError(w, "Amount must be greater than zero")
+		return
+	}
+
+	pi, msg, err := app.Gateway.CreatePaymentIntent("usd", payload.Amount, map[string]string{"source": "virtual-terminal"})
 	if err != nil {
 		app.errorLog.Println(err)
+		app.writePaymentIntentError(w, msg)
 		return
 	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: payload.Currency,
+	err = app.writeJSON(w, http.StatusOK, pi)
+	if err != nil {
+		return
 	}
+}
 
-	okay := true
+// writePaymentIntentError writes the error json for a payment intent that could not be created
+func (app *application) writePaymentIntentError(w http.ResponseWriter, msg string) {
+	j := jsonResponse{
+		OK:      false,
+		Message: msg,
+		Content: "",
+	}
 
-	pi, msg, err := card.Charge(payload.Currency, amount)
+	out, err := json.MarshalIndent(j, "", "   ")
 	if err != nil {
-		okay = false
+		app.errorLog.Println(err)
 	}
 
-	if okay {
-		out, err := json.MarshalIndent(pi, "", "   ")
-		if err != nil {
-			app.errorLog.Println(err)
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		_, err = w.Write(out)
-		if err != nil {
-			return
-		}
-	} else {
-		j := jsonResponse{
-			OK:      false,
-			Message: msg,
-			Content: "",
-		}
-
-		out, err := json.MarshalIndent(j, "", "   ")
-		if err != nil {
-			app.errorLog.Println(err)
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		_, err = w.Write(out)
-		if err != nil {
-			return
-		}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(out)
+	if err != nil {
+		return
 	}
 }
 
@@ -203,18 +261,39 @@ func (app *application) GetWidgetByID(w http.ResponseWriter, r *http.Request) {
 
 // Invoice describes the JSON payload sent to the microservice
 type Invoice struct {
+	ID        int           `json:"id"`
+	WidgetID  int           `json:"widget_id"`
+	Amount    int           `json:"amount"`
+	Product   string        `json:"product"`
+	Quantity  int           `json:"quantity"`
+	FirstName string        `json:"first_name"`
+	LastName  string        `json:"last_name"`
+	Email     string        `json:"email"`
+	CreatedAt time.Time     `json:"created_at"`
+	Items     []InvoiceItem `json:"items"`
+}
+
+// InvoiceItem is one line of an invoice
+type InvoiceItem struct {
+	Product   string `json:"product"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice int    `json:"unit_price"`
+	Amount    int    `json:"amount"`
+}
+
+// CreditNote describes the JSON payload sent to the microservice for a refund
+type CreditNote struct {
 	ID        int       `json:"id"`
-	WidgetID  int       `json:"widget_id"`
+	OrderID   int       `json:"order_id"`
 	Amount    int       `json:"amount"`
-	Product   string    `json:"product"`
-	Quantity  int       `json:"quantity"`
+	Reason    string    `json:"reason"`
 	FirstName string    `json:"first_name"`
 	LastName  string    `json:"last_name"`
 	Email     string    `json:"email"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
-// CreateCustomerAndSubscribeToPlan is the handler for subscribing to the bronze plan
+// CreateCustomerAndSubscribeToPlan is the handler for subscribing to a plan
 func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter, r *http.Request) {
 	var data stripePayload
 	err := json.NewDecoder(r.Body).Decode(&data)
@@ -232,91 +311,136 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 		return
 	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: data.Currency,
+	// the plan and its price come from the widget, not from the browser
+	productID, _ := strconv.Atoi(data.ProductID)
+	widget, err := app.DB.GetWidget(productID)
+	if err != nil || !widget.IsRecurring || widget.IsArchived {
+		app.errorLog.Println(err)
+		v.AddError("product_id", "is not a subscription plan")
+		app.failedValidation(w, r, v.Errors)
+		return
 	}
 
 	okay := true
 	var subscription *stripe.Subscription
 	txnMsg := "Transaction successful"
 
-	stripeCustomer, msg, err := card.CreateCustomer(data.PaymentMethod, data.Email)
-	if err != nil {
-		app.errorLog.Println(err)
+	// only plans with a trial which does not need one may be subscribed to without a card
+	offer := cards.PlanOffer{
+		TrialDays:   widget.TrialDays,
+		WithoutCard: data.PaymentMethod == "",
+	}
+	if widget.HasIntro() {
+		offer.Coupon = widget.IntroCouponID
+	}
+	if offer.WithoutCard && (widget.TrialDays == 0 || !widget.TrialWithoutCard) {
 		okay = false
-		txnMsg = msg
+		txnMsg = "A card is required for this plan"
 	}
 
+	var stripeCustomer *stripe.Customer
 	if okay {
-		subscription, err = card.SubscribeToPlan(stripeCustomer, data.Plan, data.Email, data.LastFour, "")
+		var msg string
+		stripeCustomer, msg, err = app.Gateway.CreateCustomer(data.PaymentMethod, data.Email)
 		if err != nil {
 			app.errorLog.Println(err)
 			okay = false
-			txnMsg = "Error subscribing customer"
+			txnMsg = msg
 		}
 	}
 
 	if okay {
-		productID, _ := strconv.Atoi(data.ProductID)
-		customerID, err := app.SaveCustomer(data.FirstName, data.LastName, data.Email)
+		subscription, err = app.Gateway.SubscribeToPlan(stripeCustomer, widget.PlanID, offer, data.Email, data.LastFour, "")
 		if err != nil {
 			app.errorLog.Println(err)
-			return
+			okay = false
+			txnMsg = "Error subscribing customer"
 		}
+	}
 
-		// create a new txn
-		amount, _ := strconv.Atoi(data.Amount)
+	if okay {
+		customer := models.Customer{
+			FirstName: data.FirstName,
+			LastName:  data.LastName,
+			Email:     data.Email,
+		}
+
+		// create a new txn, for what the first cycle charged. The order is for the plan's full price
+		amount := widget.Price
 		txn := models.Transaction{
-			Amount:              amount,
+			Amount:              widget.FirstCharge(),
 			Currency:            "usd",
 			LastFour:            data.LastFour,
 			ExpiryMonth:         data.ExpiryMonth,
 			ExpiryYear:          data.ExpiryYear,
-			TransactionStatusID: 2,
+			TransactionStatusID: models.TransactionStatusCleared,
 			PaymentIntent:       subscription.ID,
 			PaymentMethod:       data.PaymentMethod,
+			PeriodStart:         unixTime(subscription.CurrentPeriodStart),
+			PeriodEnd:           unixTime(subscription.CurrentPeriodEnd),
 		}
-
-		txnID, err := app.SaveTransaction(txn)
-		if err != nil {
-			app.errorLog.Println(err)
-			return
+		if subscription.LatestInvoice != nil {
+			txn.InvoiceID = subscription.LatestInvoice.ID
 		}
 
 		// create order
 		order := models.Order{
-			WidgetID:      productID,
-			TransactionID: txnID,
-			CustomerID:    customerID,
-			StatusID:      1,
-			Quantity:      1,
-			Amount:        amount,
-			CreatedAt:     time.Now(),
-			UpdatedAt:     time.Now(),
+			WidgetID:  productID,
+			StatusID:  models.OrderStatusPaid,
+			Quantity:  1,
+			Amount:    amount,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+			Items: []models.OrderItem{
+				{
+					WidgetID:  productID,
+					Quantity:  1,
+					UnitPrice: amount,
+					Amount:    amount,
+				},
+			},
 		}
 
-		orderID, err := app.SaveOrder(order)
+		orderID, err := app.DB.CreateSubscriptionTx(customer, txn, order, localSubscription(subscription))
 		if err != nil {
 			app.errorLog.Println(err)
-			return
+			okay = false
+			if app.compensateFailedSubscription(subscription, txn, data.Email, err) {
+				txnMsg = "Error saving subscription; your payment has been refunded"
+			} else {
+				txnMsg = "Error saving subscription; your payment is being reviewed and we will contact you by email"
+			}
 		}
 
-		inv := Invoice{
-			ID:        orderID,
-			Amount:    2000,
-			Product:   "Bronze Plan monthly subscription",
-			Quantity:  order.Quantity,
-			FirstName: data.FirstName,
-			LastName:  data.LastName,
-			Email:     data.Email,
-			CreatedAt: time.Now(),
-		}
+		if okay {
+			product := fmt.Sprintf("%s %s subscription", widget.Name, widget.BillingFrequency())
+			if widget.TrialDays > 0 {
+				product = fmt.Sprintf("%s, %d day free trial", product, widget.TrialDays)
+			}
 
-		err = app.callInvoiceMicro(inv)
-		if err != nil {
-			app.errorLog.Println(err)
+			inv := Invoice{
+				ID:        orderID,
+				Amount:    txn.Amount,
+				Product:   product,
+				Quantity:  order.Quantity,
+				FirstName: data.FirstName,
+				LastName:  data.LastName,
+				Email:     data.Email,
+				CreatedAt: time.Now(),
+				Items: []InvoiceItem{
+					{
+						Product:   product,
+						Quantity:  order.Quantity,
+						UnitPrice: txn.Amount,
+						Amount:    txn.Amount,
+					},
+				},
+			}
+
+			err = app.callInvoiceMicro(inv)
+			if err != nil {
+				app.errorLog.Println(err)
+			}
 		}
 	}
 
@@ -337,8 +461,17 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 
 // callInvoiceMicro calls the invoicing microservice
 func (app *application) callInvoiceMicro(inv Invoice) error {
-	url := "http://localhost:5000/invoice/create-and-send"
-	out, err := json.MarshalIndent(inv, "", "\t")
+	return app.postToInvoiceMicro("http://localhost:5000/invoice/create-and-send", inv)
+}
+
+// callCreditNoteMicro asks the invoicing microservice to send a credit note for a refund
+func (app *application) callCreditNoteMicro(note CreditNote) error {
+	return app.postToInvoiceMicro("http://localhost:5000/credit-note/create-and-send", note)
+}
+
+// postToInvoiceMicro posts payload to the invoicing microservice as json
+func (app *application) postToInvoiceMicro(url string, payload interface{}) error {
+	out, err := json.MarshalIndent(payload, "", "\t")
 	if err != nil {
 		return err
 	}
@@ -364,33 +497,53 @@ func (app *application) callInvoiceMicro(inv Invoice) error {
 	return nil
 }
 
-// SaveCustomer saves a customer and returns id
-func (app *application) SaveCustomer(firstName, lastName, email string) (int, error) {
-	customer := models.Customer{
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
+// compensateFailedSubscription is called when a customer was subscribed and charged, but the order
+// could not be saved. It cancels the subscription and refunds what was paid on the first invoice,
+// and if that fails, flags the payment for manual review. It returns true if the customer has been
+// refunded (or was never charged)
+func (app *application) compensateFailedSubscription(subscription *stripe.Subscription, txn models.Transaction, email string, orderErr error) bool {
+	amount := txn.Amount
+	if subscription.LatestInvoice != nil {
+		amount = int(subscription.LatestInvoice.AmountPaid)
 	}
 
-	id, err := app.DB.InsertCustomer(customer)
+	err := app.Gateway.CancelSubscriptionNow(subscription.ID)
 	if err != nil {
-		return 0, err
+		app.errorLog.Println(err)
 	}
-	return id, nil
-}
 
-// SaveTransaction saves a txn and returns id
-func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
-	id, err := app.DB.InsertTransaction(txn)
+	if err == nil && subscription.LatestInvoice != nil {
+		if amount == 0 {
+			app.infoLog.Printf("cancelled unpaid subscription %s because the order could not be saved\n", subscription.ID)
+			return true
+		}
+
+		if subscription.LatestInvoice.PaymentIntent != nil {
+			_, err = app.Gateway.Refund(subscription.LatestInvoice.PaymentIntent.ID, amount)
+			if err == nil {
+				app.infoLog.Printf("cancelled and refunded subscription %s because the order could not be saved\n", subscription.ID)
+				return true
+			}
+			app.errorLog.Println(err)
+		}
+	}
+
+	err = app.DB.InsertPaymentReview(models.PaymentReview{
+		PaymentIntent: subscription.ID,
+		Amount:        amount,
+		Currency:      txn.Currency,
+		Email:         email,
+		Reason:        orderErr.Error(),
+	})
 	if err != nil {
-		return 0, err
+		app.errorLog.Printf("subscription %s needs manual review and could not be flagged: %s\n", subscription.ID, err)
 	}
-	return id, nil
+	return false
 }
 
-// SaveOrder saves a order and returns id
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id, err := app.DB.InsertOrder(order)
+// SaveTransaction saves a txn and returns id
+func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
+	id, err := app.DB.InsertTransaction(txn)
 	if err != nil {
 		return 0, err
 	}
@@ -402,6 +555,8 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 	var userInput struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Name     string `json:"name"`
+		twoFactorPayload
 	}
 
 	err := app.readJSON(w, r, &userInput)
@@ -413,9 +568,19 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// slow down guessing; the wait grows with each failure, for the account and the address
+	if wait := app.loginWait(r, userInput.Email); wait > 0 {
+		err := app.tooManyLoginAttempts(w, wait)
+		if err != nil {
+			return
+		}
+		return
+	}
+
 	// get the user from the database by email; send error if invalid email
 	user, err := app.DB.GetUserByEmail(userInput.Email)
 	if err != nil {
+		app.loginFailed(r, userInput.Email, nil)
 		err := app.invalidCredentials(w)
 		if err != nil {
 			return
@@ -434,6 +599,7 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 	}
 
 	if !validPassword {
+		app.loginFailed(r, userInput.Email, &user)
 		err := app.invalidCredentials(w)
 		if err != nil {
 			return
@@ -441,6 +607,32 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// with two factor on, the password alone is not enough; the client asks for a code and retries
+	if user.TwoFactorEnabled {
+		if userInput.Code == "" && userInput.RecoveryCode == "" {
+			err := app.twoFactorCodeRequired(w)
+			if err != nil {
+				return
+			}
+			return
+		}
+
+		ok, err := app.verifyTwoFactor(user.ID, userInput.Code, userInput.RecoveryCode)
+		if err != nil || !ok {
+			app.loginFailed(r, userInput.Email, &user)
+			err := app.invalidCredentials(w)
+			if err != nil {
+				return
+			}
+			return
+		}
+	}
+
+	err = app.AccountLimiter.Reset(r.Context(), accountKey(userInput.Email))
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
 	// generate the token
 	token, err := models.GenerateToken(user.ID, time.Hour*24, models.ScopeAuthentication)
 	if err != nil {
@@ -450,6 +642,12 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 		}
 		return
 	}
+	token.Device = truncate(r.UserAgent(), 255)
+	token.IPAddress = clientIP(r)
+	token.Name = truncate(strings.TrimSpace(userInput.Name), 255)
+	if token.Name == "" {
+		token.Name = deviceName(r.UserAgent())
+	}
 
 	// save to database
 	err = app.DB.InsertToken(token, user)
@@ -503,19 +701,17 @@ func (app *application) CheckAuthentication(w http.ResponseWriter, r *http.Reque
 
 // VirtualTerminalPaymentSucceeded displays a page with receipt information
 func (app *application) authenticateToken(r *http.Request) (*models.User, error) {
-	authorizationHeader := r.Header.Get("Authorization")
-	if authorizationHeader == "" {
-		return nil, errors.New("no authorization header received")
-	}
-
-	headerParts := strings.Split(authorizationHeader, " ")
-	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-		return nil, errors.New("no authorization header received")
+	token, err := bearerToken(r)
+	if err != nil {
+		return nil, err
 	}
 
-	token := headerParts[1]
-	if len(token) != 26 {
-		return nil, errors.New("authentication token wrong size")
+	if models.IsAPIKey(token) {
+		user, err := app.DB.GetUserForAPIKey(token)
+		if err != nil {
+			return nil, errors.New("no matching api key found")
+		}
+		return user, nil
 	}
 
 	// get the user from the tokens table
@@ -551,12 +747,7 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 		return
 	}
 
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key:    app.config.stripe.key,
-	}
-
-	pi, err := card.RetrievePaymentIntent(txnData.PaymentIntent)
+	pi, err := app.Gateway.RetrievePaymentIntent(txnData.PaymentIntent)
 	if err != nil {
 		err := app.badRequest(w, r, err)
 		if err != nil {
@@ -565,7 +756,19 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 		return
 	}
 
-	pm, err := card.GetPaymentMethod(txnData.PaymentMethod)
+	if pi.Status != stripe.PaymentIntentStatusSucceeded || pi.LatestCharge == nil {
+		err := app.badRequest(w, r, errors.New("payment has not succeeded"))
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	// record what was actually charged, not what the browser says
+	txnData.PaymentAmount = int(pi.Amount)
+	txnData.PaymentCurrency = string(pi.Currency)
+
+	pm, err := app.Gateway.GetPaymentMethod(txnData.PaymentMethod)
 	if err != nil {
 		err := app.badRequest(w, r, err)
 		if err != nil {
@@ -587,10 +790,10 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 		PaymentIntent:       txnData.PaymentIntent,
 		PaymentMethod:       txnData.PaymentMethod,
 		BankReturnCode:      pi.LatestCharge.ID,
-		TransactionStatusID: 2,
+		TransactionStatusID: models.TransactionStatusCleared,
 	}
 
-	_, err = app.SaveTransaction(txn)
+	txnID, err := app.SaveTransaction(txn)
 	if err != nil {
 		err := app.badRequest(w, r, err)
 		if err != nil {
@@ -599,6 +802,9 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 		return
 	}
 
+	txn.ID = txnID
+	app.audit(r, models.AuditTerminalCharge, "transaction", strconv.Itoa(txnID), nil, txn)
+
 	err = app.writeJSON(w, http.StatusOK, txn)
 	if err != nil {
 		return
@@ -621,7 +827,7 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 	}
 
 	// verify that email exists
-	_, err = app.DB.GetUserByEmail(payload.Email)
+	user, err := app.DB.GetUserByEmail(payload.Email)
 	if err != nil {
 		var resp struct {
 			Error   bool   `json:"error"`
@@ -636,19 +842,21 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	link := fmt.Sprintf("%s/reset-password?email=%s", app.config.frontend, payload.Email)
-
-	sign := urlsigner.Signer{
-		Secret: []byte(app.config.secretkey),
+	// the link carries a single use token; asking again replaces any earlier link
+	token, err := app.DB.CreateActionToken(user.ID, models.PurposePasswordReset, models.PasswordResetTTL)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
 	}
 
-	signedLink := sign.GenerateTokenFromString(link)
-
 	var data struct {
 		Link string
 	}
 
-	data.Link = signedLink
+	data.Link = fmt.Sprintf("%s/reset-password?token=%s", app.config.frontend, url.QueryEscape(token))
 
 	// send mail
 	err = app.SendMail("info@south.com", payload.Email, "Password Reset Request", "password-reset", data)
@@ -674,10 +882,10 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 	}
 }
 
-// ResetPassword resets a user's password in the database
+// ResetPassword resets a user's password in the database, using up the token from their reset link
 func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
-		Email    string `json:"email"`
+		Token    string `json:"token"`
 		Password string `json:"password"`
 	}
 
@@ -690,22 +898,8 @@ func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	encryptor := encryption.Encryption{
-		Key: []byte(app.config.secretkey),
-	}
-
-	realEmail, err := encryptor.Decrypt(payload.Email)
-	if err != nil {
-		err := app.badRequest(w, r, err)
-		if err != nil {
-			return
-		}
-		return
-	}
-
-	user, err := app.DB.GetUserByEmail(realEmail)
-	if err != nil {
-		err := app.badRequest(w, r, err)
+	if payload.Password == "" {
+		err := app.badRequest(w, r, errors.New("password must not be blank"))
 		if err != nil {
 			return
 		}
@@ -721,7 +915,10 @@ func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.DB.UpdatePasswordForUser(user, string(newHash))
+	err = app.DB.ResetPasswordWithToken(payload.Token, string(newHash))
+	if errors.Is(err, models.ErrInvalidToken) {
+		err = errors.New("this reset link is invalid, has expired or has already been used")
+	}
 	if err != nil {
 		err := app.badRequest(w, r, err)
 		if err != nil {
@@ -805,7 +1002,16 @@ func (app *application) AllSubscriptions(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	allSales, lastPage, totalRecords, err := app.DB.GetAllSubscriptionsPaginated(payload.PageSize, payload.CurrentPage)
+	v := validator.New()
+	v.Check(payload.PageSize > 0 && payload.PageSize <= 100, "page_size", "must be between 1 and 100")
+	v.Check(payload.CurrentPage > 0, "page", "must be at least 1")
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	subscriptions, lastPage, totalRecords, err := app.DB.GetAllSubscriptionsPaginated(payload.PageSize, payload.CurrentPage)
 	if err != nil {
 		err := app.badRequest(w, r, err)
 		if err != nil {
@@ -815,18 +1021,18 @@ func (app *application) AllSubscriptions(w http.ResponseWriter, r *http.Request)
 	}
 
 	var resp struct {
-		CurrentPage  int             `json:"current_page"`
-		PageSize     int             `json:"page_size"`
-		LastPage     int             `json:"last_page"`
-		TotalRecords int             `json:"total_records"`
-		Orders       []*models.Order `json:"orders"`
+		CurrentPage   int                    `json:"current_page"`
+		PageSize      int                    `json:"page_size"`
+		LastPage      int                    `json:"last_page"`
+		TotalRecords  int                    `json:"total_records"`
+		Subscriptions []*models.Subscription `json:"subscriptions"`
 	}
 
 	resp.CurrentPage = payload.CurrentPage
 	resp.PageSize = payload.PageSize
 	resp.LastPage = lastPage
 	resp.TotalRecords = totalRecords
-	resp.Orders = allSales
+	resp.Subscriptions = subscriptions
 
 	err = app.writeJSON(w, http.StatusOK, resp)
 	if err != nil {
@@ -854,13 +1060,13 @@ func (app *application) GetSale(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// RefundCharge accepts a json payload and tries to refund a charge
+// RefundCharge refunds all or part of the charge for an order. An order can be refunded in several
+// parts, up to the amount that was captured, and the customer is sent a credit note for each refund
 func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 	var chargeToRefund struct {
-		ID            int    `json:"id"`
-		PaymentIntent string `json:"pi"`
-		Amount        int    `json:"amount"`
-		Currency      string `json:"currency"`
+		ID     int    `json:"id"`
+		Amount int    `json:"amount"`
+		Reason string `json:"reason"`
 	}
 
 	err := app.readJSON(w, r, &chargeToRefund)
@@ -872,14 +1078,47 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// validate
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: chargeToRefund.Currency,
+	chargeToRefund.Reason = strings.TrimSpace(chargeToRefund.Reason)
+
+	before, err := app.DB.GetOrderByID(chargeToRefund.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = errors.New("no such order")
+	}
+	var refunds []*models.Refund
+	if err == nil {
+		refunds, err = app.DB.GetRefundsForOrder(chargeToRefund.ID)
+	}
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	refunded := models.TotalRefunded(refunds)
+	refundable := models.RefundableAmount(before.Transaction.Amount, refunded)
+
+	v := validator.New()
+	v.Check(chargeToRefund.Amount > 0, "amount", "must be greater than zero")
+	v.Check(chargeToRefund.Amount <= refundable, "amount", fmt.Sprintf("must be no more than the %d left to refund", refundable))
+	v.Check(len(chargeToRefund.Reason) <= 255, "reason", "must be no more than 255 characters")
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	statusID, _ := models.RefundStatuses(before.Transaction.Amount, refunded+chargeToRefund.Amount)
+	if !models.CanChangeOrderStatus(before.Widget.IsRecurring, before.StatusID, statusID) {
+		err := app.badRequest(w, r, fmt.Errorf("a %s order cannot be refunded", strings.ToLower(before.StatusName)))
+		if err != nil {
+			return
+		}
+		return
 	}
 
-	err = card.Refund(chargeToRefund.PaymentIntent, chargeToRefund.Amount)
+	stripeRefundID, err := app.Gateway.Refund(before.Transaction.PaymentIntent, chargeToRefund.Amount)
 	if err != nil {
 		err := app.badRequest(w, r, err)
 		if err != nil {
@@ -888,9 +1127,18 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// update status in db
-	err = app.DB.UpdateOrderStatus(chargeToRefund.ID, 2)
+	refund := models.Refund{
+		OrderID:        chargeToRefund.ID,
+		Amount:         chargeToRefund.Amount,
+		Reason:         chargeToRefund.Reason,
+		StripeRefundID: stripeRefundID,
+		UserID:         app.currentUser(r).ID,
+	}
+
+	// record the refund in db
+	refund.ID, statusID, err = app.DB.RecordRefund(refund)
 	if err != nil {
+		app.errorLog.Printf("refund %s of order %d: %s\n", stripeRefundID, chargeToRefund.ID, err)
 		err := app.badRequest(w, r, errors.New("the charge was refunded, but the database could not be updated"))
 		if err != nil {
 			return
@@ -898,12 +1146,44 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if statusID == models.OrderStatusRefunded {
+		err = app.DB.RestockOrder(chargeToRefund.ID)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+
+	after := struct {
+		models.Order
+		Refund models.Refund `json:"refund"`
+	}{Order: before, Refund: refund}
+	after.StatusID = statusID
+	after.StatusName = models.OrderStatusName(statusID)
+	app.audit(r, models.AuditOrderRefund, "order", strconv.Itoa(chargeToRefund.ID), before, after)
+
+	err = app.callCreditNoteMicro(CreditNote{
+		ID:        refund.ID,
+		OrderID:   before.ID,
+		Amount:    refund.Amount,
+		Reason:    refund.Reason,
+		FirstName: before.Customer.FirstName,
+		LastName:  before.Customer.LastName,
+		Email:     before.Customer.Email,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
 	var resp struct {
 		Error   bool   `json:"error"`
 		Message string `json:"message"`
 	}
 	resp.Error = false
 	resp.Message = "Charge Refunded"
+	if statusID == models.OrderStatusPartiallyRefunded {
+		resp.Message = "Charge Partially Refunded"
+	}
 
 	err = app.writeJSON(w, http.StatusOK, resp)
 	if err != nil {
@@ -911,12 +1191,12 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// CancelSubscription is the handler to cancel a subscription
+// CancelSubscription is the handler to cancel a subscription. The subscription runs to the end of
+// its billing period, and can be reactivated until then. Only the order id is read from the request;
+// the subscription cancelled is the one saved with the order
 func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Request) {
 	var subToCancel struct {
-		ID            int    `json:"id"`
-		PaymentIntent string `json:"pi"`
-		Currency      string `json:"currency"`
+		ID int `json:"id"`
 	}
 
 	err := app.readJSON(w, r, &subToCancel)
@@ -928,13 +1208,13 @@ func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: subToCancel.Currency,
+	before, err := app.DB.GetOrderByID(subToCancel.ID)
+	if err == nil && !models.CanChangeOrderStatus(before.Widget.IsRecurring, before.StatusID, models.OrderStatusCancelling) {
+		err = fmt.Errorf("a %s subscription cannot be cancelled", strings.ToLower(before.StatusName))
+	}
+	if err == nil {
+		err = app.Gateway.CancelSubscriptions(before.Transaction.PaymentIntent)
 	}
-
-	err = card.CancelSubscriptions(subToCancel.PaymentIntent)
 	if err != nil {
 		err := app.badRequest(w, r, err)
 		if err != nil {
@@ -943,8 +1223,9 @@ func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// update status in db
-	err = app.DB.UpdateOrderStatus(subToCancel.ID, 3)
+	// update status in db. A subscription set to cancel keeps its status, trialing or active, until
+	// the end of its billing period
+	err = app.DB.UpdateSubscriptionStatus(subToCancel.ID, models.OrderStatusCancelling, app.currentUser(r).ID, "", true)
 	if err != nil {
 		err := app.badRequest(w, r, errors.New("the subscription was cancelled, but the database could not be updated"))
 		if err != nil {
@@ -953,12 +1234,17 @@ func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	after := before
+	after.StatusID = models.OrderStatusCancelling
+	after.StatusName = models.OrderStatusName(after.StatusID)
+	app.audit(r, models.AuditSubscriptionCancel, "order", strconv.Itoa(subToCancel.ID), before, after)
+
 	var resp struct {
 		Error   bool   `json:"error"`
 		Message string `json:"message"`
 	}
 	resp.Error = false
-	resp.Message = "Subscription Cancelled"
+	resp.Message = "Subscription will cancel at the end of its billing period"
 
 	err = app.writeJSON(w, http.StatusOK, resp)
 	if err != nil {
@@ -1018,6 +1304,36 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	user.ID = userID
+
+	if !user.Role.Valid() {
+		err := app.badRequest(w, r, errors.New("invalid role"))
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	var before *models.User
+	if userID > 0 {
+		existing, err := app.DB.GetOneUser(userID)
+		// nobody can change their own role, so the owner editing users can never lock themselves out
+		if err == nil && userID == app.currentUser(r).ID && existing.Role != user.Role {
+			err = errors.New("you cannot change your own role")
+		}
+		if err != nil {
+			err := app.badRequest(w, r, err)
+			if err != nil {
+				return
+			}
+			return
+		}
+		before = &existing
+	}
+
+	// the password is never logged, only that it was changed
+	after := user
+	after.Password = ""
 
 	if userID > 0 {
 		err = app.DB.EditUser(user)
@@ -1028,6 +1344,8 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
+		app.audit(r, models.AuditUserUpdate, "user", id, before, after)
+
 		if user.Password != "" {
 			newHash, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
 			if err != nil {
@@ -1045,6 +1363,7 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 				}
 				return
 			}
+			app.audit(r, models.AuditUserPassword, "user", id, nil, nil)
 		}
 	} else {
 		newHash, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
@@ -1055,7 +1374,7 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
-		err = app.DB.AddUser(user, string(newHash))
+		userID, err = app.DB.AddUser(user, string(newHash))
 		if err != nil {
 			err := app.badRequest(w, r, err)
 			if err != nil {
@@ -1063,6 +1382,8 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
+		after.ID = userID
+		app.audit(r, models.AuditUserCreate, "user", strconv.Itoa(userID), nil, after)
 	}
 
 	var resp struct {
@@ -1082,7 +1403,18 @@ func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	userID, _ := strconv.Atoi(id)
 
-	err := app.DB.DeleteUser(userID)
+	if userID == app.currentUser(r).ID {
+		err := app.badRequest(w, r, errors.New("you cannot delete yourself"))
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	before, err := app.DB.GetOneUser(userID)
+	if err == nil {
+		err = app.DB.DeleteUser(userID)
+	}
 	if err != nil {
 		err := app.badRequest(w, r, err)
 		if err != nil {
@@ -1091,6 +1423,8 @@ func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	app.audit(r, models.AuditUserDelete, "user", id, before, nil)
+
 	var resp struct {
 		Error   bool   `json:"error"`
 		Message string `json:"message"`
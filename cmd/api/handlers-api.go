@@ -14,6 +14,7 @@ type stripePayload struct {
 	FirstName     string `json:"first_name"`
 	LastName      string `json:"last_name"`
 }
+
 type jsonResponse struct {
 	OK      bool   `json:"ok"`
 	Message string `json:"message,omitempty"`
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"goEcommerce/internal/models"
+	"goEcommerce/internal/validator"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// AllAPIKeys returns every api key (without the keys themselves) as JSON
+func (app *application) AllAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := app.DB.GetAllAPIKeys()
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, keys)
+	if err != nil {
+		return
+	}
+}
+
+// CreateAPIKey creates an api key for the logged in user. The response is the only time the key
+// itself is ever shown
+func (app *application) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Name          string               `json:"name"`
+		Scopes        []models.APIKeyScope `json:"scopes"`
+		ExpiresInDays int                  `json:"expires_in_days"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	user := app.currentUser(r)
+	payload.Name = strings.TrimSpace(payload.Name)
+
+	v := validator.New()
+	v.Check(payload.Name != "", "name", "must not be blank")
+	v.Check(len(payload.Name) <= 255, "name", "must be no more than 255 characters")
+	v.Check(len(payload.Scopes) > 0, "scopes", "must include at least one scope")
+	v.Check(payload.ExpiresInDays >= 0, "expires_in_days", "must not be negative")
+	for _, scope := range payload.Scopes {
+		perm, ok := models.APIKeyScopes[scope]
+		v.Check(ok, "scopes", "contains an unknown scope")
+		// a key can never do more than the user creating it
+		v.Check(!ok || user.Role.Can(perm), "scopes", "contains a scope your role does not allow")
+	}
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	var expiresAt *time.Time
+	if payload.ExpiresInDays > 0 {
+		t := time.Now().AddDate(0, 0, payload.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	key, err := models.GenerateAPIKey(user.ID, payload.Name, payload.Scopes, expiresAt)
+	if err == nil {
+		err = app.DB.InsertAPIKey(key)
+	}
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	// never log the key itself
+	logged := *key
+	logged.PlainText = ""
+	app.audit(r, models.AuditAPIKeyCreate, "api_key", strconv.Itoa(key.ID), nil, logged)
+
+	var resp struct {
+		Error   bool           `json:"error"`
+		Message string         `json:"message"`
+		APIKey  *models.APIKey `json:"api_key"`
+	}
+
+	resp.Error = false
+	resp.Message = "api key created; copy it now, it will not be shown again"
+	resp.APIKey = key
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
+
+// RevokeAPIKey deletes an api key by id (from the url)
+func (app *application) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	keyID, _ := strconv.Atoi(id)
+
+	err := app.DB.DeleteAPIKey(keyID)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	app.audit(r, models.AuditAPIKeyRevoke, "api_key", id, nil, nil)
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "api key revoked"
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
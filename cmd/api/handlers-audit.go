@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"goEcommerce/internal/models"
+	"goEcommerce/internal/validator"
+	"net/http"
+	"time"
+)
+
+// audit records an admin action in the audit log. before and after are the entity before and after
+// the action, and either may be nil. The action has already happened by the time it is recorded, so
+// a failure to record it is logged rather than failing the request
+func (app *application) audit(r *http.Request, action, entity, entityID string, before, after interface{}) {
+	user := app.currentUser(r)
+
+	entry := models.AuditEntry{
+		UserID:    user.ID,
+		Action:    action,
+		Entity:    entity,
+		EntityID:  entityID,
+		IPAddress: clientIP(r),
+	}
+	if user.APIKey != nil {
+		entry.APIKeyID = user.APIKey.ID
+	}
+
+	var err error
+	entry.Before, err = auditJSON(before)
+	if err == nil {
+		entry.After, err = auditJSON(after)
+	}
+	if err == nil {
+		err = app.DB.InsertAuditEntry(entry)
+	}
+	if err != nil {
+		app.errorLog.Printf("audit %s %s %s: %s\n", action, entity, entityID, err)
+	}
+}
+
+// auditJSON marshals an entity for the audit log; nil, including a nil pointer, stays empty
+func auditJSON(v interface{}) (json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil || string(data) == "null" {
+		return nil, err
+	}
+	return data, nil
+}
+
+// auditDateFormat is the format of the date filters on the audit log
+const auditDateFormat = "2006-01-02"
+
+// AuditLog returns a page of the audit log as JSON, filtered by user, action, entity and date
+func (app *application) AuditLog(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		PageSize    int    `json:"page_size"`
+		CurrentPage int    `json:"page"`
+		UserID      int    `json:"user_id"`
+		Action      string `json:"action"`
+		Entity      string `json:"entity"`
+		EntityID    string `json:"entity_id"`
+		From        string `json:"from"`
+		To          string `json:"to"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	filter := models.AuditFilter{
+		UserID:   payload.UserID,
+		Action:   payload.Action,
+		Entity:   payload.Entity,
+		EntityID: payload.EntityID,
+	}
+
+	v := validator.New()
+	v.Check(payload.PageSize > 0 && payload.PageSize <= 100, "page_size", "must be between 1 and 100")
+	v.Check(payload.CurrentPage > 0, "page", "must be at least 1")
+	if payload.From != "" {
+		filter.From, err = time.Parse(auditDateFormat, payload.From)
+		v.Check(err == nil, "from", "must be a date")
+	}
+	if payload.To != "" {
+		filter.To, err = time.Parse(auditDateFormat, payload.To)
+		v.Check(err == nil, "to", "must be a date")
+		// the to date is inclusive, so include the whole day
+		filter.To = filter.To.AddDate(0, 0, 1)
+	}
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	entries, lastPage, totalRecords, err := app.DB.GetAuditLogPaginated(filter, payload.PageSize, payload.CurrentPage)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	var resp struct {
+		CurrentPage  int                  `json:"current_page"`
+		PageSize     int                  `json:"page_size"`
+		LastPage     int                  `json:"last_page"`
+		TotalRecords int                  `json:"total_records"`
+		Entries      []*models.AuditEntry `json:"entries"`
+	}
+
+	resp.CurrentPage = payload.CurrentPage
+	resp.PageSize = payload.PageSize
+	resp.LastPage = lastPage
+	resp.TotalRecords = totalRecords
+	resp.Entries = entries
+
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"goEcommerce/internal/models"
+	"goEcommerce/internal/throttle"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// accountLoginPolicy slows down password guessing against one account, and locks it for a while
+// after too many failures. The owner is emailed when that happens
+var accountLoginPolicy = throttle.Policy{
+	FreeAttempts: 3,
+	BaseDelay:    time.Second,
+	MaxDelay:     time.Minute,
+	LockoutAfter: 10,
+	LockoutFor:   15 * time.Minute,
+	Window:       time.Hour,
+}
+
+// ipLoginPolicy slows down one address trying many accounts. It is looser than accountLoginPolicy,
+// since several people can share an address
+var ipLoginPolicy = throttle.Policy{
+	FreeAttempts: 10,
+	BaseDelay:    time.Second,
+	MaxDelay:     time.Minute,
+	LockoutAfter: 100,
+	LockoutFor:   15 * time.Minute,
+	Window:       time.Hour,
+}
+
+// accountKey is the limiter key for login attempts against an email address
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// ipKey is the limiter key for login attempts from an address
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// loginWait returns how long the client must wait before trying to log in as email. Limiter errors
+// are logged and let the attempt through, so a broken limiter does not lock everyone out
+func (app *application) loginWait(r *http.Request, email string) time.Duration {
+	wait, err := app.AccountLimiter.Wait(r.Context(), accountKey(email))
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	ipWait, err := app.IPLimiter.Wait(r.Context(), ipKey(clientIP(r)))
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	return max(wait, ipWait)
+}
+
+// loginFailed records a failed login as email, which is counted whether or not the account exists.
+// If it locks out a real account, the owner is told by email
+func (app *application) loginFailed(r *http.Request, email string, user *models.User) {
+	_, err := app.IPLimiter.Fail(r.Context(), ipKey(clientIP(r)))
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	locked, err := app.AccountLimiter.Fail(r.Context(), accountKey(email))
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+	if !locked || user == nil {
+		return
+	}
+
+	app.infoLog.Printf("locked out user %d after too many failed logins from %s\n", user.ID, clientIP(r))
+
+	var data struct {
+		Minutes int
+		IP      string
+		Link    string
+	}
+
+	data.Minutes = int(accountLoginPolicy.LockoutFor.Minutes())
+	data.IP = clientIP(r)
+	data.Link = fmt.Sprintf("%s/forgot-password", app.config.frontend)
+
+	// sent in the background, so a lockout does not answer more slowly than any other failure
+	go func(to string) {
+		err := app.SendMail("info@south.com", to, "Your account has been locked", "account-locked", data)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}(user.Email)
+}
+
+// tooManyLoginAttempts sends a 429, telling the client how long to wait
+func (app *application) tooManyLoginAttempts(w http.ResponseWriter, wait time.Duration) error {
+	seconds := int(math.Ceil(wait.Seconds()))
+
+	var payload struct {
+		Error      bool   `json:"error"`
+		Message    string `json:"message"`
+		RetryAfter int    `json:"retry_after"`
+	}
+
+	payload.Error = true
+	payload.Message = fmt.Sprintf("too many failed login attempts; try again in %s", time.Duration(seconds)*time.Second)
+	payload.RetryAfter = seconds
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	return app.writeJSON(w, http.StatusTooManyRequests, payload)
+}
+
+// UnlockUser clears the failed logins against a user (by id, from the url), so they can log in
+// again straight away
+func (app *application) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	userID, _ := strconv.Atoi(id)
+
+	user, err := app.DB.GetOneUser(userID)
+	if err == nil {
+		err = app.AccountLimiter.Reset(r.Context(), accountKey(user.Email))
+	}
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	app.audit(r, models.AuditUserUnlock, "user", id, nil, nil)
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "user unlocked"
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"goEcommerce/internal/models"
+	"goEcommerce/internal/validator"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// fulfilmentStatuses are the statuses ChangeOrderStatus can set. Refunds and cancellations go
+// through RefundCharge and CancelSubscription, which tell the payment provider first
+var fulfilmentStatuses = []int{models.OrderStatusFulfilled, models.OrderStatusShipped, models.OrderStatusDelivered}
+
+// orderStatus is an order status and its name, as JSON. Fulfilment statuses can be set with
+// ChangeOrderStatus
+type orderStatus struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Fulfilment bool   `json:"fulfilment"`
+}
+
+// isFulfilmentStatus reports whether ChangeOrderStatus can set statusID
+func isFulfilmentStatus(statusID int) bool {
+	for _, s := range fulfilmentStatuses {
+		if s == statusID {
+			return true
+		}
+	}
+	return false
+}
+
+// SaleHistory returns the status history and refunds of an order (by id, from the url), how much is
+// left to refund, and the statuses it can move to next
+func (app *application) SaleHistory(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	orderID, _ := strconv.Atoi(id)
+
+	order, err := app.DB.GetOrderByID(orderID)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	history, err := app.DB.GetOrderStatusHistory(orderID)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	refunds, err := app.DB.GetRefundsForOrder(orderID)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	var resp struct {
+		Status       orderStatus                 `json:"status"`
+		NextStatuses []orderStatus               `json:"next_statuses"`
+		History      []*models.OrderStatusChange `json:"history"`
+		Refunds      []*models.Refund            `json:"refunds"`
+		Refunded     int                         `json:"refunded"`
+		Refundable   int                         `json:"refundable"`
+	}
+
+	resp.Status = orderStatus{ID: order.StatusID, Name: order.StatusName}
+	resp.NextStatuses = []orderStatus{}
+	for _, next := range models.NextOrderStatuses(order.Widget.IsRecurring, order.StatusID) {
+		resp.NextStatuses = append(resp.NextStatuses, orderStatus{
+			ID:         next,
+			Name:       models.OrderStatusName(next),
+			Fulfilment: isFulfilmentStatus(next),
+		})
+	}
+	resp.History = history
+	resp.Refunds = refunds
+	resp.Refunded = models.TotalRefunded(refunds)
+	resp.Refundable = models.RefundableAmount(order.Transaction.Amount, resp.Refunded)
+
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
+
+// ChangeOrderStatus moves an order for one-off widgets through fulfilment: fulfilled, shipped and
+// delivered. Subscriptions are never fulfilled
+func (app *application) ChangeOrderStatus(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ID       int    `json:"id"`
+		StatusID int    `json:"status_id"`
+		Note     string `json:"note"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	payload.Note = strings.TrimSpace(payload.Note)
+
+	v := validator.New()
+	v.Check(isFulfilmentStatus(payload.StatusID), "status_id", "must be fulfilled, shipped or delivered")
+	v.Check(len(payload.Note) <= 255, "note", "must be no more than 255 characters")
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	before, err := app.DB.GetOrderByID(payload.ID)
+	if err == nil && before.Widget.IsRecurring {
+		err = errors.New("subscriptions cannot be fulfilled, shipped or delivered")
+	}
+	if err == nil {
+		err = app.DB.UpdateOrderStatus(payload.ID, payload.StatusID, app.currentUser(r).ID, payload.Note)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		err = errors.New("no such order")
+	}
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	after := before
+	after.StatusID = payload.StatusID
+	after.StatusName = models.OrderStatusName(payload.StatusID)
+	app.audit(r, models.AuditOrderStatus, "order", strconv.Itoa(payload.ID), before, after)
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "order marked " + strings.ToLower(after.StatusName)
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"goEcommerce/internal/models"
+	"goEcommerce/internal/validator"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// subscriptionAction is a change to a subscription made with the payment provider, which moves its
+// order from one status to another. An empty status keeps the subscription's status as it is
+type subscriptionAction struct {
+	from    int
+	to      int
+	status  string
+	audit   string
+	message string
+	gateway func(subID string) error
+}
+
+// changeSubscription reads the order id of a subscription from the request, makes the change with
+// the payment provider and then updates the order, if the order is in the status action starts from
+func (app *application) changeSubscription(w http.ResponseWriter, r *http.Request, action subscriptionAction) {
+	var payload struct {
+		ID int `json:"id"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	before, err := app.DB.GetOrderByID(payload.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = errors.New("no such subscription")
+	}
+	if err == nil && before.StatusID != action.from {
+		err = fmt.Errorf("a %s subscription cannot be %s", strings.ToLower(before.StatusName), action.message)
+	}
+	if err == nil {
+		err = action.gateway(before.Transaction.PaymentIntent)
+	}
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	err = app.DB.UpdateSubscriptionStatus(payload.ID, action.to, app.currentUser(r).ID, action.status, false)
+	if err != nil {
+		err := app.badRequest(w, r, fmt.Errorf("the subscription was %s, but the database could not be updated", action.message))
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	after := before
+	after.StatusID = action.to
+	after.StatusName = models.OrderStatusName(action.to)
+	app.audit(r, action.audit, "order", strconv.Itoa(payload.ID), before, after)
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "Subscription " + action.message
+
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
+
+// ReactivateSubscription keeps a subscription which is set to cancel at the end of its billing period.
+// It stays active, or trialing, as it was
+func (app *application) ReactivateSubscription(w http.ResponseWriter, r *http.Request) {
+	app.changeSubscription(w, r, subscriptionAction{
+		from:    models.OrderStatusCancelling,
+		to:      models.OrderStatusPaid,
+		audit:   models.AuditSubscriptionReactivate,
+		message: "reactivated",
+		gateway: app.Gateway.ReactivateSubscription,
+	})
+}
+
+// PauseSubscription stops charging for a subscription until it is resumed
+func (app *application) PauseSubscription(w http.ResponseWriter, r *http.Request) {
+	app.changeSubscription(w, r, subscriptionAction{
+		from:    models.OrderStatusPaid,
+		to:      models.OrderStatusPaused,
+		status:  models.SubscriptionStatusPaused,
+		audit:   models.AuditSubscriptionPause,
+		message: "paused",
+		gateway: app.Gateway.PauseSubscription,
+	})
+}
+
+// ResumeSubscription starts charging for a paused subscription again
+func (app *application) ResumeSubscription(w http.ResponseWriter, r *http.Request) {
+	app.changeSubscription(w, r, subscriptionAction{
+		from:    models.OrderStatusPaused,
+		to:      models.OrderStatusPaid,
+		status:  models.SubscriptionStatusActive,
+		audit:   models.AuditSubscriptionResume,
+		message: "resumed",
+		gateway: app.Gateway.ResumeSubscription,
+	})
+}
+
+// planChangePayload is the json payload for previewing and making a plan change
+type planChangePayload struct {
+	ID            int   `json:"id"`
+	WidgetID      int   `json:"widget_id"`
+	ProrationDate int64 `json:"proration_date"`
+}
+
+// checkPlanChange loads the subscription and the plan it is moving to, and checks the move is allowed
+func (app *application) checkPlanChange(payload planChangePayload, v *validator.Validator) (models.Order, models.Widget, error) {
+	order, err := app.DB.GetOrderByID(payload.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return order, models.Widget{}, errors.New("no such subscription")
+	}
+	if err != nil {
+		return order, models.Widget{}, err
+	}
+
+	plan, err := app.DB.GetWidget(payload.WidgetID)
+	v.Check(err == nil && plan.IsRecurring && !plan.IsArchived && plan.PlanID != "", "widget_id", "is not a subscription plan")
+	v.Check(payload.WidgetID != order.WidgetID, "widget_id", "is the plan the subscription is already on")
+	v.Check(order.StatusID == models.OrderStatusPaid, "id", "must be an active subscription")
+
+	return order, plan, nil
+}
+
+// PreviewPlanChange returns what moving a subscription to another plan now would charge, or credit
+// if the amount is negative, for the rest of its billing period, and the proration date to send to
+// ChangeSubscriptionPlan to make the change for that amount
+func (app *application) PreviewPlanChange(w http.ResponseWriter, r *http.Request) {
+	var payload planChangePayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	v := validator.New()
+	order, plan, err := app.checkPlanChange(payload, v)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	amount, prorationDate, err := app.Gateway.PreviewPlanChange(order.Transaction.PaymentIntent, plan.PlanID)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	var resp struct {
+		Error         bool   `json:"error"`
+		Message       string `json:"message"`
+		Plan          string `json:"plan"`
+		Price         int    `json:"price"`
+		Interval      string `json:"interval"`
+		Amount        int    `json:"amount"`
+		ProrationDate int64  `json:"proration_date"`
+	}
+	resp.Error = false
+	resp.Message = "plan change previewed"
+	resp.Plan = plan.Name
+	resp.Price = plan.Price
+	resp.Interval = plan.PlanInterval
+	resp.Amount = amount
+	resp.ProrationDate = prorationDate
+
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
+
+// ChangeSubscriptionPlan moves a subscription to another plan, charging or crediting the prorated
+// difference for the rest of its billing period as of the proration date from PreviewPlanChange
+func (app *application) ChangeSubscriptionPlan(w http.ResponseWriter, r *http.Request) {
+	var payload planChangePayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	v := validator.New()
+	v.Check(payload.ProrationDate > 0, "proration_date", "must come from a preview of the change")
+	before, plan, err := app.checkPlanChange(payload, v)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	prorated, err := app.Gateway.ChangePlan(before.Transaction.PaymentIntent, plan.PlanID, payload.ProrationDate)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	err = app.DB.ChangeSubscriptionPlan(payload.ID, plan.ID, plan.Price, prorated, app.currentUser(r).ID)
+	if err != nil {
+		app.errorLog.Printf("plan change of order %d to widget %d: %s\n", payload.ID, plan.ID, err)
+		err := app.badRequest(w, r, errors.New("the plan was changed, but the database could not be updated"))
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	after := before
+	after.WidgetID = plan.ID
+	after.Widget = plan
+	after.Amount = plan.Price
+	app.audit(r, models.AuditSubscriptionChangePlan, "order", strconv.Itoa(payload.ID), before, after)
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "Subscription moved to " + plan.Name
+
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
+
+// SubscriptionPlans returns a subscription (by order id, from the url) with its plan history and the
+// transactions for its billing cycles, and the plans it can be moved to
+func (app *application) SubscriptionPlans(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	orderID, _ := strconv.Atoi(id)
+
+	history, err := app.DB.GetSubscriptionPlanHistory(orderID)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	// subscriptions whose order predates the local records have none, and show only their plans
+	subscription, err := app.DB.GetSubscriptionByOrderID(orderID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	renewals, err := app.DB.GetSubscriptionTransactions(orderID)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	widgets, err := app.DB.GetAllWidgets(false)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	var resp struct {
+		Subscription models.Subscription   `json:"subscription"`
+		Plans        []*models.Widget      `json:"plans"`
+		History      []*models.PlanChange  `json:"history"`
+		Renewals     []*models.Transaction `json:"renewals"`
+	}
+
+	resp.Plans = []*models.Widget{}
+	for _, widget := range widgets {
+		if widget.IsRecurring && widget.PlanID != "" {
+			resp.Plans = append(resp.Plans, widget)
+		}
+	}
+	resp.History = history
+	resp.Subscription = subscription
+	resp.Renewals = renewals
+
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
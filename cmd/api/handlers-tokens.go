@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"goEcommerce/internal/models"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// bearerToken returns the token or api key from the Authorization header
+func bearerToken(r *http.Request) (string, error) {
+	authorizationHeader := r.Header.Get("Authorization")
+	if authorizationHeader == "" {
+		return "", errors.New("no authorization header received")
+	}
+
+	headerParts := strings.Split(authorizationHeader, " ")
+	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		return "", errors.New("no authorization header received")
+	}
+
+	token := headerParts[1]
+	if !models.IsAPIKey(token) && len(token) != 26 {
+		return "", errors.New("authentication token wrong size")
+	}
+
+	return token, nil
+}
+
+// deviceName makes a short, readable name for a token from the browser's user agent
+func deviceName(userAgent string) string {
+	browser := ""
+	for _, b := range []struct{ match, name string }{
+		{"Edg/", "Edge"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(userAgent, b.match) {
+			browser = b.name
+			break
+		}
+	}
+
+	system := ""
+	for _, s := range []struct{ match, name string }{
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, s.match) {
+			system = s.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	default:
+		return "Unknown device"
+	}
+}
+
+// Logout revokes the token the request was made with. The user's other tokens keep working
+func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
+	token, err := bearerToken(r)
+	if err == nil {
+		err = app.DB.DeleteToken(token)
+	}
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "logged out"
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
+
+// MyTokens lists the tokens of the logged in user, marking the one the request was made with
+func (app *application) MyTokens(w http.ResponseWriter, r *http.Request) {
+	token, _ := bearerToken(r)
+
+	tokens, err := app.DB.GetTokensForUser(app.currentUser(r).ID, token)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, tokens)
+	if err != nil {
+		return
+	}
+}
+
+// RevokeMyToken revokes one of the logged in user's tokens, by id
+func (app *application) RevokeMyToken(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	tokenID, _ := strconv.Atoi(id)
+
+	err := app.DB.DeleteTokenForUser(tokenID, app.currentUser(r).ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = errors.New("no such token")
+	}
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	app.audit(r, models.AuditTokenRevoke, "token", id, nil, nil)
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "token revoked"
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
+
+// RevokeUserTokens revokes every token of a user (by id, from the url), logging them out everywhere
+func (app *application) RevokeUserTokens(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	userID, _ := strconv.Atoi(id)
+
+	err := app.DB.DeleteTokensForUser(userID)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	app.audit(r, models.AuditUserRevokeTokens, "user", id, nil, nil)
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "all tokens revoked"
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
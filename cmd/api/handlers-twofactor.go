@@ -0,0 +1,368 @@
+package main
+
+import (
+	"errors"
+	"goEcommerce/internal/models"
+	"goEcommerce/internal/totp"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// twoFactorIssuer is the account issuer shown in authenticator apps
+const twoFactorIssuer = "Widgets"
+
+// twoFactorPayload is the code posted to confirm two factor authentication; either a code from
+// the user's authenticator app or one of their recovery codes
+type twoFactorPayload struct {
+	Code         string `json:"totp_code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// verifyTwoFactor checks a code from the user's authenticator app, or one of their recovery codes.
+// Each code only works once
+func (app *application) verifyTwoFactor(userID int, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		return app.DB.UseRecoveryCode(userID, recoveryCode)
+	}
+
+	encrypted, _, err := app.DB.GetTwoFactorSecret(userID)
+	if err != nil || encrypted == "" {
+		return false, err
+	}
+
+	secret, err := app.Keyring.Decrypt(encrypted)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return app.DB.UseTwoFactorStep(userID, step)
+}
+
+// twoFactorCodeRequired tells the client to ask for a two factor code and try again
+func (app *application) twoFactorCodeRequired(w http.ResponseWriter) error {
+	var payload struct {
+		Error             bool   `json:"error"`
+		Message           string `json:"message"`
+		TwoFactorRequired bool   `json:"two_factor_required"`
+	}
+
+	payload.Error = true
+	payload.Message = "enter the code from your authenticator app"
+	payload.TwoFactorRequired = true
+
+	return app.writeJSON(w, http.StatusUnauthorized, payload)
+}
+
+// TwoFactorStatus returns whether the logged in user has two factor authentication on, whether
+// their role requires it, and how many recovery codes they have left
+func (app *application) TwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	user := app.currentUser(r)
+
+	left, err := app.DB.CountRecoveryCodes(user.ID)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	var resp struct {
+		Error             bool   `json:"error"`
+		Message           string `json:"message"`
+		Enabled           bool   `json:"enabled"`
+		Required          bool   `json:"required"`
+		RecoveryCodesLeft int    `json:"recovery_codes_left"`
+	}
+
+	resp.Error = false
+	resp.Enabled = user.TwoFactorEnabled
+	resp.Required = user.TwoFactorRequired
+	resp.RecoveryCodesLeft = left
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
+
+// TwoFactorSetup makes a new secret for the logged in user, and returns it with the provisioning
+// uri for their authenticator app. Two factor is not on until TwoFactorEnable confirms a code
+func (app *application) TwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	user := app.currentUser(r)
+
+	if user.TwoFactorEnabled {
+		err := app.badRequest(w, r, errors.New("two factor authentication is already on"))
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	encrypted, err := app.Keyring.Encrypt(secret)
+	if err == nil {
+		err = app.DB.SetTwoFactorSecret(user.ID, encrypted)
+	}
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	app.audit(r, models.AuditTwoFactorSetup, "user", strconv.Itoa(user.ID), nil, nil)
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+		Secret  string `json:"secret"`
+		URI     string `json:"uri"`
+	}
+
+	resp.Error = false
+	resp.Secret = secret
+	resp.URI = totp.ProvisioningURI(twoFactorIssuer, user.Email, secret)
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
+
+// TwoFactorEnable turns on two factor authentication once the user confirms a code from their app,
+// and returns their recovery codes. This is the only time the recovery codes are shown
+func (app *application) TwoFactorEnable(w http.ResponseWriter, r *http.Request) {
+	user := app.currentUser(r)
+
+	var payload twoFactorPayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	encrypted, enabled, err := app.DB.GetTwoFactorSecret(user.ID)
+	if err == nil && (enabled || encrypted == "") {
+		err = errors.New("set up two factor authentication first")
+	}
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	secret, err := app.Keyring.Decrypt(encrypted)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	step, ok := totp.Validate(secret, payload.Code, time.Now())
+	if !ok {
+		err := app.badRequest(w, r, errors.New("that code is not right; check the time on your device"))
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	codes, hashes, err := models.GenerateRecoveryCodes(models.RecoveryCodeCount)
+	if err == nil {
+		err = app.DB.EnableTwoFactor(user.ID, step, hashes)
+	}
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	app.audit(r, models.AuditTwoFactorEnable, "user", strconv.Itoa(user.ID), nil, nil)
+
+	var resp struct {
+		Error         bool     `json:"error"`
+		Message       string   `json:"message"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	resp.Error = false
+	resp.Message = "two factor authentication is on"
+	resp.RecoveryCodes = codes
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
+
+// TwoFactorDisable turns off two factor authentication for the logged in user, after checking a
+// code. Users whose role requires two factor cannot turn it off
+func (app *application) TwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	user := app.currentUser(r)
+
+	var payload twoFactorPayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	if user.TwoFactorRequired {
+		err := app.badRequest(w, r, errors.New("your role requires two factor authentication"))
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	ok, err := app.verifyTwoFactor(user.ID, payload.Code, payload.RecoveryCode)
+	if err == nil && !ok {
+		err = errors.New("that code is not right")
+	}
+	if err == nil {
+		err = app.DB.ResetTwoFactor(user.ID)
+	}
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	app.audit(r, models.AuditTwoFactorDisable, "user", strconv.Itoa(user.ID), nil, nil)
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "two factor authentication is off"
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
+
+// ResetUserTwoFactor turns off two factor authentication for a user (by id, from the url) who has
+// lost their device and recovery codes, and logs them out everywhere. If their role requires two
+// factor, they must set it up again when they next log in
+func (app *application) ResetUserTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	userID, _ := strconv.Atoi(id)
+
+	err := app.DB.ResetTwoFactor(userID)
+	if err == nil {
+		err = app.DB.DeleteTokensForUser(userID)
+	}
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	app.audit(r, models.AuditUserResetTwoFactor, "user", id, nil, nil)
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "two factor authentication reset"
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
+
+// RoleSettings returns the settings for every role as JSON
+func (app *application) RoleSettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := app.DB.GetRoleSettings()
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, settings)
+	if err != nil {
+		return
+	}
+}
+
+// EditRoleSetting saves the settings for one role
+func (app *application) EditRoleSetting(w http.ResponseWriter, r *http.Request) {
+	var setting models.RoleSetting
+	var before *models.RoleSetting
+
+	err := app.readJSON(w, r, &setting)
+	if err == nil && !setting.Role.Valid() {
+		err = errors.New("invalid role")
+	}
+	if err == nil {
+		var settings []*models.RoleSetting
+		settings, err = app.DB.GetRoleSettings()
+		for _, s := range settings {
+			if s.Role == setting.Role {
+				before = s
+			}
+		}
+	}
+	if err == nil {
+		err = app.DB.UpdateRoleSetting(setting)
+	}
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	app.audit(r, models.AuditRoleSettingUpdate, "role_setting", string(setting.Role), before, setting)
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"goEcommerce/internal/models"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v75"
+	"github.com/stripe/stripe-go/v75/webhook"
+)
+
+// webhookHandler handles one type of Stripe event. Its writes go through tx, which also holds the
+// claim on the event, so they commit or roll back together
+type webhookHandler func(ctx context.Context, tx *sql.Tx, event stripe.Event) error
+
+// webhookHandlers returns the handlers for the Stripe events we act on, keyed by event type
+func (app *application) webhookHandlers() map[string]webhookHandler {
+	return map[string]webhookHandler{
+		"invoice.payment_failed":        app.handleInvoicePaymentFailed,
+		"invoice.paid":                  app.handleInvoicePaid,
+		"customer.subscription.updated": app.handleSubscriptionUpdated,
+		"customer.subscription.deleted": app.handleSubscriptionDeleted,
+		"charge.refunded":               app.handleChargeRefunded,
+		"charge.dispute.created":        app.handleDisputeCreated,
+		"payment_intent.payment_failed": app.handlePaymentIntentEnded,
+		"payment_intent.canceled":       app.handlePaymentIntentEnded,
+	}
+}
+
+// StripeWebhook receives events from Stripe, verifies their signature, stores them, and
+// dispatches them to the matching handler. Events are stored by id, so a redelivered event
+// is only acted on once
+func (app *application) StripeWebhook(w http.ResponseWriter, r *http.Request) {
+	// an empty secret would accept signatures made with an empty key, so anyone could forge events
+	if app.config.stripe.webhookSecret == "" {
+		app.errorLog.Println("webhook received but STRIPE_WEBHOOK_SECRET is not set")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	maxBytes := 65536
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxBytes)))
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	event, err := webhook.ConstructEventWithOptions(payload, r.Header.Get("Stripe-Signature"), app.config.stripe.webhookSecret,
+		webhook.ConstructEventOptions{IgnoreAPIVersionMismatch: true})
+	if err != nil {
+		app.errorLog.Println(err)
+		err := app.badRequest(w, r, errors.New("invalid signature"))
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	err = app.DB.InsertWebhookEvent(models.WebhookEvent{
+		EventID:   event.ID,
+		EventType: string(event.Type),
+		Payload:   string(payload),
+	})
+	if err != nil {
+		app.errorLog.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = app.DB.ProcessWebhookEvent(event.ID, func(ctx context.Context, tx *sql.Tx) error {
+		if handler, ok := app.webhookHandlers()[string(event.Type)]; ok {
+			return handler(ctx, tx, event)
+		}
+		return nil
+	})
+	if err != nil {
+		// a non 2xx response makes Stripe deliver the event again later
+		app.errorLog.Printf("webhook %s (%s): %s\n", event.ID, event.Type, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = "received"
+
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
+
+// handleInvoicePaymentFailed records a declined transaction for a renewal of a subscription which
+// could not be charged. The transactions for earlier cycles, which were paid, are left alone
+func (app *application) handleInvoicePaymentFailed(ctx context.Context, tx *sql.Tx, event stripe.Event) error {
+	var invoice stripe.Invoice
+	err := json.Unmarshal(event.Data.Raw, &invoice)
+	if err != nil {
+		return err
+	}
+
+	if invoice.Subscription == nil || invoice.BillingReason != stripe.InvoiceBillingReasonSubscriptionCycle {
+		return nil
+	}
+
+	txn := invoiceTransaction(&invoice, int(invoice.AmountDue), models.TransactionStatusDeclined)
+	return app.DB.RecordRenewalTx(ctx, tx, invoice.Subscription.ID, txn)
+}
+
+// invoiceTransaction returns the transaction for a renewal invoice, for amount in statusID
+func invoiceTransaction(invoice *stripe.Invoice, amount, statusID int) models.Transaction {
+	txn := models.Transaction{
+		Amount:              amount,
+		Currency:            string(invoice.Currency),
+		InvoiceID:           invoice.ID,
+		TransactionStatusID: statusID,
+	}
+	if invoice.PaymentIntent != nil {
+		txn.PaymentIntent = invoice.PaymentIntent.ID
+	}
+	if invoice.Lines != nil {
+		for _, line := range invoice.Lines.Data {
+			if line.Period != nil && line.Type == stripe.InvoiceLineItemTypeSubscription {
+				txn.PeriodStart = unixTime(line.Period.Start)
+				txn.PeriodEnd = unixTime(line.Period.End)
+				break
+			}
+		}
+	}
+	return txn
+}
+
+// unixTime returns a time from the payment provider, or nil if it is not set
+func unixTime(t int64) *time.Time {
+	if t == 0 {
+		return nil
+	}
+	at := time.Unix(t, 0)
+	return &at
+}
+
+// localSubscription returns the local record of a subscription with the payment provider. A
+// subscription whose collection is paused is active with the provider, but paused here
+func localSubscription(subscription *stripe.Subscription) models.Subscription {
+	status := string(subscription.Status)
+	if subscription.PauseCollection != nil && status == models.SubscriptionStatusActive {
+		status = models.SubscriptionStatusPaused
+	}
+
+	return models.Subscription{
+		StripeSubscriptionID: subscription.ID,
+		Status:               status,
+		CurrentPeriodStart:   unixTime(subscription.CurrentPeriodStart),
+		CurrentPeriodEnd:     unixTime(subscription.CurrentPeriodEnd),
+		CancelAtPeriodEnd:    subscription.CancelAtPeriodEnd,
+		TrialEnd:             unixTime(subscription.TrialEnd),
+	}
+}
+
+// handleInvoicePaid records the transaction for each renewal of a subscription. The invoice for the
+// first billing cycle is recorded when the customer subscribes, and plan changes by the order
+func (app *application) handleInvoicePaid(ctx context.Context, tx *sql.Tx, event stripe.Event) error {
+	var invoice stripe.Invoice
+	err := json.Unmarshal(event.Data.Raw, &invoice)
+	if err != nil {
+		return err
+	}
+
+	if invoice.Subscription == nil || invoice.BillingReason != stripe.InvoiceBillingReasonSubscriptionCycle {
+		return nil
+	}
+
+	txn := invoiceTransaction(&invoice, int(invoice.AmountPaid), models.TransactionStatusCleared)
+	return app.DB.RecordRenewalTx(ctx, tx, invoice.Subscription.ID, txn)
+}
+
+// handleSubscriptionUpdated keeps the local record of a subscription in step with the payment provider
+func (app *application) handleSubscriptionUpdated(ctx context.Context, tx *sql.Tx, event stripe.Event) error {
+	var subscription stripe.Subscription
+	err := json.Unmarshal(event.Data.Raw, &subscription)
+	if err != nil {
+		return err
+	}
+
+	return app.DB.SyncSubscriptionTx(ctx, tx, localSubscription(&subscription))
+}
+
+// handleSubscriptionDeleted marks a subscription and its order as cancelled
+func (app *application) handleSubscriptionDeleted(ctx context.Context, tx *sql.Tx, event stripe.Event) error {
+	var subscription stripe.Subscription
+	err := json.Unmarshal(event.Data.Raw, &subscription)
+	if err != nil {
+		return err
+	}
+
+	err = app.DB.SyncSubscriptionTx(ctx, tx, localSubscription(&subscription))
+	if err != nil {
+		return err
+	}
+
+	return app.DB.UpdateOrderStatusByPaymentIntentTx(ctx, tx, subscription.ID, models.OrderStatusCancelled)
+}
+
+// handleChargeRefunded records the refunds of a charge, and updates the order and transaction for a
+// charge that was refunded in full or in part. Charges are matched by payment intent, so only one-off
+// sales are updated: subscription transactions are stored under the subscription id, and a refunded
+// invoice charge only carries the invoice's payment intent, so refunds of subscription charges do not
+// match any row and are ignored. Refunds made in the admin area are recorded there too; whichever
+// comes second leaves the refund as it is
+func (app *application) handleChargeRefunded(ctx context.Context, tx *sql.Tx, event stripe.Event) error {
+	var charge stripe.Charge
+	err := json.Unmarshal(event.Data.Raw, &charge)
+	if err != nil {
+		return err
+	}
+
+	if charge.PaymentIntent == nil {
+		return nil
+	}
+
+	// newer api versions leave the refunds out of the event, and then only the statuses are updated
+	if charge.Refunds != nil {
+		for _, refund := range charge.Refunds.Data {
+			if refund.Status == stripe.RefundStatusFailed || refund.Status == stripe.RefundStatusCanceled {
+				continue
+			}
+
+			err = app.DB.RecordProviderRefundTx(ctx, tx, charge.PaymentIntent.ID, models.Refund{
+				Amount:         int(refund.Amount),
+				Reason:         string(refund.Reason),
+				StripeRefundID: refund.ID,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if !charge.Refunded {
+		err = app.DB.UpdateTransactionStatusByPaymentIntentTx(ctx, tx, charge.PaymentIntent.ID, models.TransactionStatusPartiallyRefunded)
+		if err != nil {
+			return err
+		}
+		return app.DB.UpdateOrderStatusByPaymentIntentTx(ctx, tx, charge.PaymentIntent.ID, models.OrderStatusPartiallyRefunded)
+	}
+
+	err = app.DB.UpdateTransactionStatusByPaymentIntentTx(ctx, tx, charge.PaymentIntent.ID, models.TransactionStatusRefunded)
+	if err != nil {
+		return err
+	}
+
+	err = app.DB.RestockOrdersByPaymentIntentTx(ctx, tx, charge.PaymentIntent.ID)
+	if err != nil {
+		return err
+	}
+
+	return app.DB.UpdateOrderStatusByPaymentIntentTx(ctx, tx, charge.PaymentIntent.ID, models.OrderStatusRefunded)
+}
+
+// handleDisputeCreated marks the transaction for a disputed charge
+func (app *application) handleDisputeCreated(ctx context.Context, tx *sql.Tx, event stripe.Event) error {
+	var dispute stripe.Dispute
+	err := json.Unmarshal(event.Data.Raw, &dispute)
+	if err != nil {
+		return err
+	}
+
+	if dispute.PaymentIntent == nil {
+		return nil
+	}
+
+	return app.DB.UpdateTransactionStatusByPaymentIntentTx(ctx, tx, dispute.PaymentIntent.ID, models.TransactionStatusDisputed)
+}
+
+// handlePaymentIntentEnded releases the stock reserved for a payment intent which failed or was cancelled
+func (app *application) handlePaymentIntentEnded(ctx context.Context, tx *sql.Tx, event stripe.Event) error {
+	var pi stripe.PaymentIntent
+	err := json.Unmarshal(event.Data.Raw, &pi)
+	if err != nil {
+		return err
+	}
+
+	return app.DB.ReleaseStockTx(ctx, tx, pi.ID)
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"goEcommerce/internal/images"
+	"goEcommerce/internal/models"
+	"goEcommerce/internal/validator"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// AllWidgets returns every widget, including archived ones, as JSON
+func (app *application) AllWidgets(w http.ResponseWriter, r *http.Request) {
+	widgets, err := app.DB.GetAllWidgets(true)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, widgets)
+	if err != nil {
+		return
+	}
+}
+
+// OneWidget gets one widget by id (from the url) and returns it as JSON
+func (app *application) OneWidget(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	widgetID, _ := strconv.Atoi(id)
+
+	widget, err := app.DB.GetWidget(widgetID)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, widget)
+	if err != nil {
+		return
+	}
+}
+
+// EditWidget is the handler for adding a widget (id 0) or editing an existing one. A recurring widget
+// without a plan id can have its Stripe price created for it by setting create_price, and a plan
+// whose price or interval changes gets a new Stripe price. The coupon for a plan's introductory price
+// is created whenever its introductory terms, price or interval change. The inventory level is only
+// set when a widget is added; AdjustWidgetStock changes it after that
+func (app *application) EditWidget(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	widgetID, _ := strconv.Atoi(id)
+
+	var payload struct {
+		models.Widget
+		CreatePrice bool `json:"create_price"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	widget := payload.Widget
+	widget.ID = widgetID
+	widget.Name = strings.TrimSpace(widget.Name)
+	if widget.PlanInterval == "" {
+		widget.PlanInterval = models.PlanIntervalMonth
+	}
+	if widget.Slug == "" {
+		widget.Slug = strings.ToLower(strings.Join(strings.Fields(widget.Name), "-"))
+	}
+
+	v := validator.New()
+	v.Check(len(widget.Name) > 1, "name", "must be at least 2 characters")
+	v.Check(validator.Matches(widget.Slug, validator.SlugRX), "slug", "must be lower case letters, numbers and dashes")
+	v.Check(strings.TrimSpace(widget.Description) != "", "description", "must not be blank")
+	v.Check(widget.Price > 0, "price", "must be greater than zero")
+	v.Check(widget.InventoryLevel >= 0, "inventory_level", "must not be negative")
+	v.Check(!widget.IsRecurring || widget.PlanID != "" || payload.CreatePrice, "plan_id", "is required for a subscription plan")
+	v.Check(widget.IsRecurring || !payload.CreatePrice, "create_price", "is only for subscription plans")
+	v.Check(validator.In(widget.PlanInterval, models.PlanIntervalMonth, models.PlanIntervalYear), "plan_interval",
+		"must be month or year")
+	v.Check(widget.TrialDays >= 0 && widget.TrialDays <= 730, "trial_days", "must be between 0 and 730")
+	v.Check(widget.IsRecurring || widget.TrialDays == 0, "trial_days", "is only for subscription plans")
+	v.Check(widget.TrialDays > 0 || !widget.TrialWithoutCard, "trial_without_card", "needs a free trial")
+	v.Check(widget.IntroCycles >= 0, "intro_cycles", "must not be negative")
+	v.Check(widget.IsRecurring || widget.IntroCycles == 0, "intro_cycles", "is only for subscription plans")
+	v.Check(widget.IntroCycles == 0 || (widget.IntroPrice >= 0 && widget.IntroPrice < widget.Price), "intro_price",
+		"must be less than the price")
+
+	var before *models.Widget
+	if widgetID > 0 {
+		current, err := app.DB.GetWidget(widgetID)
+		if err != nil {
+			err := app.badRequest(w, r, err)
+			if err != nil {
+				return
+			}
+			return
+		}
+		before = &current
+	}
+
+	existing, err := app.DB.GetWidgetBySlug(widget.Slug)
+	if err == nil && existing.ID != widgetID {
+		v.AddError("slug", "is already in use")
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	if before != nil {
+		widget.InventoryLevel = before.InventoryLevel
+	}
+
+	// the coupon is ours to manage, so one sent with the widget is ignored
+	widget.IntroCouponID = ""
+	if widget.IntroCycles == 0 {
+		widget.IntroPrice = 0
+	} else if before != nil && before.IntroCouponID != "" && before.Price == widget.Price &&
+		before.IntroPrice == widget.IntroPrice && before.IntroCycles == widget.IntroCycles &&
+		before.PlanInterval == widget.PlanInterval {
+		widget.IntroCouponID = before.IntroCouponID
+	} else {
+		// coupons run for a number of months, however often the plan is billed
+		widget.IntroCouponID, err = app.Gateway.CreateCoupon(widget.Price-widget.IntroPrice, "usd",
+			widget.IntroCycles*widget.IntervalMonths())
+		if err != nil {
+			err := app.badRequest(w, r, err)
+			if err != nil {
+				return
+			}
+			return
+		}
+	}
+
+	// a Stripe price cannot be changed, so a plan whose price or interval changes gets a new one,
+	// unless a new price id was given with it. Existing subscribers stay on the price they signed up for
+	repriced := before != nil && before.IsRecurring && widget.IsRecurring && widget.PlanID == before.PlanID &&
+		(before.Price != widget.Price || before.PlanInterval != widget.PlanInterval)
+	if (payload.CreatePrice && widget.PlanID == "") || repriced {
+		widget.PlanID, err = app.Gateway.CreatePrice(widget.Name, widget.Price, "usd", widget.PlanInterval)
+		if err != nil {
+			err := app.badRequest(w, r, err)
+			if err != nil {
+				return
+			}
+			return
+		}
+	}
+
+	action := models.AuditWidgetUpdate
+	if widgetID > 0 {
+		err = app.DB.UpdateWidget(widget)
+	} else {
+		action = models.AuditWidgetCreate
+		widgetID, err = app.DB.InsertWidget(widget)
+		widget.ID = widgetID
+	}
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	app.audit(r, action, "widget", strconv.Itoa(widgetID), before, widget)
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+		ID      int    `json:"id"`
+	}
+
+	resp.Error = false
+	resp.ID = widgetID
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
+
+// AdjustWidgetStock adds an adjustment, which may be negative, to a widget's inventory. Stock is
+// changed by an amount rather than set, so sales made while the page was open are not overwritten
+func (app *application) AdjustWidgetStock(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	widgetID, _ := strconv.Atoi(id)
+
+	var payload struct {
+		Adjustment int `json:"adjustment"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	v := validator.New()
+	v.Check(payload.Adjustment != 0, "adjustment", "must not be zero")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	level, err := app.DB.AdjustInventory(widgetID, payload.Adjustment)
+	if errors.Is(err, models.ErrNegativeStock) {
+		v.AddError("adjustment", err.Error())
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	app.audit(r, models.AuditWidgetStock, "widget", id,
+		map[string]int{"inventory_level": level - payload.Adjustment},
+		map[string]int{"inventory_level": level, "adjustment": payload.Adjustment})
+
+	var resp struct {
+		Error          bool   `json:"error"`
+		Message        string `json:"message"`
+		InventoryLevel int    `json:"inventory_level"`
+	}
+
+	resp.Error = false
+	resp.InventoryLevel = level
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
+
+// ArchiveWidget takes a widget off sale
+func (app *application) ArchiveWidget(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	widgetID, _ := strconv.Atoi(id)
+
+	before, err := app.DB.GetWidget(widgetID)
+	if err == nil {
+		err = app.DB.ArchiveWidget(widgetID)
+	}
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	after := before
+	after.IsArchived = true
+	app.audit(r, models.AuditWidgetArchive, "widget", id, before, after)
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
+
+// widgetImagePrefix is the storage key prefix for uploaded widget images
+const widgetImagePrefix = "uploads/widgets"
+
+// UploadWidgetImage stores an uploaded widget image (multipart field "image") and its thumbnail,
+// and returns their storage keys and urls. The keys are saved on the widget with EditWidget
+func (app *application) UploadWidgetImage(w http.ResponseWriter, r *http.Request) {
+	// allow a little over the image limit for the rest of the multipart body
+	r.Body = http.MaxBytesReader(w, r.Body, images.MaxUploadSize+1<<20)
+
+	v := validator.New()
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			v.AddError("image", images.ErrTooLarge.Error())
+		} else {
+			v.AddError("image", "must be uploaded")
+		}
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	data, err := io.ReadAll(io.LimitReader(file, images.MaxUploadSize+1))
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	img, err := images.Process(data)
+	if err != nil {
+		v.AddError("image", err.Error())
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	key := img.Key(widgetImagePrefix)
+	thumbKey := img.ThumbnailKey(widgetImagePrefix)
+
+	err = app.Storage.Put(r.Context(), key, bytes.NewReader(img.Data), img.ContentType)
+	if err == nil {
+		err = app.Storage.Put(r.Context(), thumbKey, bytes.NewReader(img.Thumbnail), img.ThumbnailType)
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		err := app.badRequest(w, r, errors.New("the image could not be stored"))
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	app.audit(r, models.AuditImageUpload, "image", key, nil, map[string]string{
+		"image":     key,
+		"thumbnail": thumbKey,
+	})
+
+	var resp struct {
+		Error        bool   `json:"error"`
+		Message      string `json:"message"`
+		Image        string `json:"image"`
+		Thumbnail    string `json:"thumbnail"`
+		ImageURL     string `json:"image_url"`
+		ThumbnailURL string `json:"thumbnail_url"`
+	}
+
+	resp.Error = false
+	resp.Image = key
+	resp.Thumbnail = thumbKey
+	resp.ImageURL = app.Storage.URL(key)
+	resp.ThumbnailURL = app.Storage.URL(thumbKey)
+	err = app.writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		return
+	}
+}
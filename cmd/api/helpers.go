@@ -5,7 +5,9 @@ import (
 	"errors"
 	"golang.org/x/crypto/bcrypt"
 	"io"
+	"net"
 	"net/http"
+	"unicode/utf8"
 )
 
 // readJSON reads json from request body into data. We only accept a single json value in the body
@@ -91,6 +93,62 @@ func (app *application) invalidCredentials(w http.ResponseWriter) error {
 	return nil
 }
 
+// clientIP returns the address the request came from. Forwarding headers are not trusted, since
+// the api is not run behind a known proxy
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// truncate shortens s to at most n bytes, without splitting a utf-8 character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// forbidden sends a 403 for authenticated users whose role does not allow the request
+func (app *application) forbidden(w http.ResponseWriter) error {
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = "you do not have permission to do that"
+
+	err := app.writeJSON(w, http.StatusForbidden, payload)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// twoFactorSetupRequired sends a 403 for users whose role requires two factor authentication but
+// who have not set it up
+func (app *application) twoFactorSetupRequired(w http.ResponseWriter) error {
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = "your role requires two factor authentication; set it up to continue"
+
+	err := app.writeJSON(w, http.StatusForbidden, payload)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 func (app *application) passwordMatches(hash, password string) (bool, error) {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	if err != nil {
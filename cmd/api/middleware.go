@@ -1,10 +1,20 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"goEcommerce/internal/models"
+	"net/http"
+)
+
+// contextKey is the type for values stored in the request context
+type contextKey string
+
+// userContextKey holds the authenticated *models.User
+const userContextKey contextKey = "user"
 
 func (app *application) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, err := app.authenticateToken(r)
+		user, err := app.authenticateToken(r)
 		if err != nil {
 			err := app.invalidCredentials(w)
 			if err != nil {
@@ -12,6 +22,54 @@ func (app *application) Auth(next http.Handler) http.Handler {
 			}
 			return
 		}
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequirePermission refuses the request unless the user authenticated by Auth has permission p
+func (app *application) RequirePermission(p models.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := app.currentUser(r)
+			if user == nil || !user.Can(p) {
+				err := app.forbidden(w)
+				if err != nil {
+					return
+				}
+				return
+			}
+			// people whose role requires two factor must set it up before doing anything else
+			if user.APIKey == nil && user.TwoFactorRequired && !user.TwoFactorEnabled {
+				err := app.twoFactorSetupRequired(w)
+				if err != nil {
+					return
+				}
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// HumanOnly refuses requests made with an api key, for routes that only make sense for people
+// logged in with a token, such as managing their own sessions or api keys
+func (app *application) HumanOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.currentUser(r)
+		if user == nil || user.APIKey != nil {
+			err := app.forbidden(w)
+			if err != nil {
+				return
+			}
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// currentUser returns the user authenticated by Auth, or nil
+func (app *application) currentUser(r *http.Request) *models.User {
+	user, _ := r.Context().Value(userContextKey).(*models.User)
+	return user
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"goEcommerce/internal/models"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -18,33 +19,78 @@ func (app *application) routes() http.Handler {
 		MaxAge:           300,
 	}))
 
-	mux.Post("/api/payment-intent", app.GetPaymentIntent)
-
 	mux.Get("/api/widget/{id}", app.GetWidgetByID)
 
 	mux.Post("/api/create-customer-and-subscribe-to-plan", app.CreateCustomerAndSubscribeToPlan)
 
 	mux.Post("/api/authenticate", app.CreateAuthToken)
 	mux.Post("/api/is-authenticated", app.CheckAuthentication)
+	mux.With(app.Auth, app.HumanOnly).Post("/api/logout", app.Logout)
 	mux.Post("/api/forgot-password", app.SendPasswordResetEmail)
 	mux.Post("/api/reset-password", app.ResetPassword)
 
+	mux.Post("/api/webhooks/stripe", app.StripeWebhook)
+
 	mux.Route("/api/admin", func(mux chi.Router) {
 		mux.Use(app.Auth)
 
-		mux.Post("/virtual-terminal-succeeded", app.VirtualTerminalPaymentSucceeded)
-		mux.Post("/all-sales", app.AllSales)
-		mux.Post("/all-subscriptions", app.AllSubscriptions)
+		mux.With(app.HumanOnly).Post("/tokens", app.MyTokens)
+		mux.With(app.HumanOnly).Post("/tokens/revoke/{id}", app.RevokeMyToken)
+
+		mux.With(app.HumanOnly).Post("/two-factor", app.TwoFactorStatus)
+		mux.With(app.HumanOnly).Post("/two-factor/setup", app.TwoFactorSetup)
+		mux.With(app.HumanOnly).Post("/two-factor/enable", app.TwoFactorEnable)
+		mux.With(app.HumanOnly).Post("/two-factor/disable", app.TwoFactorDisable)
+
+		manageKeys := app.RequirePermission(models.PermManageAPIKeys)
+		mux.With(app.HumanOnly, manageKeys).Post("/api-keys", app.AllAPIKeys)
+		mux.With(app.HumanOnly, manageKeys).Post("/api-keys/create", app.CreateAPIKey)
+		mux.With(app.HumanOnly, manageKeys).Post("/api-keys/revoke/{id}", app.RevokeAPIKey)
+
+		terminal := app.RequirePermission(models.PermVirtualTerminal)
+		mux.With(terminal).Post("/virtual-terminal-payment-intent", app.VirtualTerminalPaymentIntent)
+		mux.With(terminal).Post("/virtual-terminal-succeeded", app.VirtualTerminalPaymentSucceeded)
+
+		viewSales := app.RequirePermission(models.PermViewSales)
+		mux.With(viewSales).Post("/all-sales", app.AllSales)
+		mux.With(viewSales).Post("/all-subscriptions", app.AllSubscriptions)
+		mux.With(viewSales).Post("/get-sale/{id}", app.GetSale)
+		mux.With(viewSales).Post("/sale-history/{id}", app.SaleHistory)
+		mux.With(app.RequirePermission(models.PermFulfilOrders)).Post("/order-status", app.ChangeOrderStatus)
+
+		mux.With(app.RequirePermission(models.PermRefund)).Post("/refund", app.RefundCharge)
+		mux.With(viewSales).Post("/subscription-plans/{id}", app.SubscriptionPlans)
+		manageSubscriptions := app.RequirePermission(models.PermCancelSubscriptions)
+		mux.With(manageSubscriptions).Post("/cancel-subscription", app.CancelSubscription)
+		mux.With(manageSubscriptions).Post("/reactivate-subscription", app.ReactivateSubscription)
+		mux.With(manageSubscriptions).Post("/pause-subscription", app.PauseSubscription)
+		mux.With(manageSubscriptions).Post("/resume-subscription", app.ResumeSubscription)
+		changePlans := app.RequirePermission(models.PermChangePlans)
+		mux.With(changePlans).Post("/preview-plan-change", app.PreviewPlanChange)
+		mux.With(changePlans).Post("/change-plan", app.ChangeSubscriptionPlan)
 
-		mux.Post("/get-sale/{id}", app.GetSale)
+		viewWidgets := app.RequirePermission(models.PermViewWidgets)
+		manageWidgets := app.RequirePermission(models.PermManageWidgets)
+		mux.With(viewWidgets).Post("/widgets", app.AllWidgets)
+		mux.With(viewWidgets).Post("/widgets/{id}", app.OneWidget)
+		mux.With(manageWidgets).Post("/widgets/edit/{id}", app.EditWidget)
+		mux.With(manageWidgets).Post("/widgets/archive/{id}", app.ArchiveWidget)
+		mux.With(manageWidgets).Post("/widgets/stock/{id}", app.AdjustWidgetStock)
+		mux.With(manageWidgets).Post("/widgets/image", app.UploadWidgetImage)
 
-		mux.Post("/refund", app.RefundCharge)
-		mux.Post("/cancel-subscription", app.CancelSubscription)
+		viewUsers := app.RequirePermission(models.PermViewUsers)
+		manageUsers := app.RequirePermission(models.PermManageUsers)
+		mux.With(viewUsers).Post("/all-users", app.AllUsers)
+		mux.With(viewUsers).Post("/all-users/{id}", app.OneUser)
+		mux.With(manageUsers).Post("/all-users/edit/{id}", app.EditUser)
+		mux.With(manageUsers).Post("/all-users/delete/{id}", app.DeleteUser)
+		mux.With(manageUsers).Post("/all-users/revoke-tokens/{id}", app.RevokeUserTokens)
+		mux.With(manageUsers).Post("/all-users/reset-two-factor/{id}", app.ResetUserTwoFactor)
+		mux.With(manageUsers).Post("/all-users/unlock/{id}", app.UnlockUser)
+		mux.With(viewUsers).Post("/role-settings", app.RoleSettings)
+		mux.With(manageUsers).Post("/role-settings/edit", app.EditRoleSetting)
 
-		mux.Post("/all-users", app.AllUsers)
-		mux.Post("/all-users/{id}", app.OneUser)
-		mux.Post("/all-users/edit/{id}", app.EditUser)
-		mux.Post("/all-users/delete/{id}", app.DeleteUser)
+		mux.With(app.RequirePermission(models.PermViewAuditLog)).Post("/audit-log", app.AuditLog)
 	})
 
 	return mux
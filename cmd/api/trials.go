@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// trialReminderLead is how long before a free trial ends its customer is reminded
+const trialReminderLead = 3 * 24 * time.Hour
+
+// remindEndingTrials sends trial ending reminders every interval, for as long as the server runs
+func (app *application) remindEndingTrials(interval time.Duration) {
+	for {
+		app.sendTrialReminders()
+		time.Sleep(interval)
+	}
+}
+
+// sendTrialReminders emails the customer of every free trial ending within trialReminderLead,
+// once per trial. Each reminder is claimed before it is sent, so servers running side by side do
+// not send it twice. Customers who started the trial without a card are told to subscribe again
+// with one, since their subscription ends with the trial
+func (app *application) sendTrialReminders() {
+	subscriptions, err := app.DB.GetTrialsEndingBefore(time.Now().Add(trialReminderLead))
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	for _, s := range subscriptions {
+		claimed, err := app.DB.ClaimTrialReminder(s.ID)
+		if err != nil {
+			app.errorLog.Println(err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		var data struct {
+			FirstName string
+			Plan      string
+			TrialEnd  string
+			Price     string
+			Interval  string
+			HasCard   bool
+			Link      string
+		}
+		data.FirstName = s.Customer.FirstName
+		data.Plan = s.Widget.Name
+		data.TrialEnd = s.TrialEnd.Format("January 2, 2006")
+		data.Price = fmt.Sprintf("$%.2f", float64(s.Widget.CyclePrice(1))/100)
+		data.Interval = s.Widget.PlanInterval
+		data.HasCard = s.HasCard
+		data.Link = fmt.Sprintf("%s/plans/%s", app.config.frontend, s.Widget.Slug)
+
+		err = app.SendMail("info@south.com", s.Customer.Email, "Your free trial is ending", "trial-ending", data)
+		if err != nil {
+			app.errorLog.Printf("trial reminder for subscription %d: %s\n", s.ID, err)
+
+			err = app.DB.ReleaseTrialReminder(s.ID)
+			if err != nil {
+				app.errorLog.Println(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"github.com/phpdave11/gofpdf"
+	"github.com/phpdave11/gofpdf/contrib/gofpdi"
+	"net/http"
+	"time"
+)
+
+// CreditNote describes the json payload received for a refund
+type CreditNote struct {
+	ID        int       `json:"id"`
+	OrderID   int       `json:"order_id"`
+	Amount    int       `json:"amount"`
+	Reason    string    `json:"reason"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateAndSendCreditNote makes a credit note for a refund and emails it to the customer
+func (app *application) CreateAndSendCreditNote(w http.ResponseWriter, r *http.Request) {
+	// receive json
+	var note CreditNote
+
+	err := app.readJSON(w, r, &note)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	// generate a pdf credit note
+	err = app.createCreditNotePDF(note)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	// create mail attachment
+	attachments := []string{
+		fmt.Sprintf("./invoices/credit-%d.pdf", note.ID),
+	}
+
+	// send mail with attachment
+	err = app.SendMail("info@widgets.com", note.Email, "Your credit note", "credit-note", attachments, nil)
+	if err != nil {
+		err := app.badRequest(w, r, err)
+		if err != nil {
+			return
+		}
+		return
+	}
+
+	// send response
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = fmt.Sprintf("Credit note credit-%d.pdf created and sent to %s", note.ID, note.Email)
+
+	err = app.writeJSON(w, http.StatusCreated, resp)
+	if err != nil {
+		return
+	}
+}
+
+// createCreditNotePDF generates a PDF credit note on the invoice template
+func (app *application) createCreditNotePDF(note CreditNote) error {
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	pdf.SetMargins(10, 13, 10)
+	pdf.SetAutoPageBreak(true, 0)
+
+	importer := gofpdi.NewImporter()
+
+	t := importer.ImportPage(pdf, "./pdf-templates/invoice.pdf", 1, "/MediaBox")
+
+	pdf.AddPage()
+	importer.UseImportedTemplate(pdf, t, 0, 0, 215.9, 0)
+
+	// write info
+	pdf.SetY(50)
+	pdf.SetX(10)
+	pdf.SetFont("Times", "", 11)
+	pdf.CellFormat(97, 8, fmt.Sprintf("Attention: %s %s", note.FirstName, note.LastName), "", 0, "L", false, 0, "")
+	pdf.Ln(5)
+	pdf.CellFormat(97, 8, note.Email, "", 0, "L", false, 0, "")
+	pdf.Ln(5)
+	pdf.CellFormat(97, 8, note.CreatedAt.Format("2006-01-02"), "", 0, "L", false, 0, "")
+	pdf.Ln(5)
+	pdf.SetFont("Times", "B", 11)
+	pdf.CellFormat(97, 8, fmt.Sprintf("CREDIT NOTE %d for order %d", note.ID, note.OrderID), "", 0, "L", false, 0, "")
+	pdf.SetFont("Times", "", 11)
+
+	description := "Refund"
+	if note.Reason != "" {
+		description = fmt.Sprintf("Refund: %s", note.Reason)
+	}
+
+	pdf.SetX(58)
+	pdf.SetY(93)
+	pdf.CellFormat(155, 8, description, "", 0, "L", false, 0, "")
+	pdf.SetX(166)
+	pdf.CellFormat(20, 8, "1", "", 0, "C", false, 0, "")
+	pdf.SetX(185)
+	pdf.CellFormat(20, 8, fmt.Sprintf("-$%.2f", float32(note.Amount)/100.0), "", 0, "R", false, 0, "")
+
+	notePath := fmt.Sprintf("./invoices/credit-%d.pdf", note.ID)
+	err := pdf.OutputFileAndClose(notePath)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -10,14 +10,23 @@ import (
 
 // Order describes the json payload received by this microservice
 type Order struct {
-	ID        int       `json:"id"`
-	Quantity  int       `json:"quantity"`
-	Amount    int       `json:"amount"`
-	Product   string    `json:"product"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        int         `json:"id"`
+	Quantity  int         `json:"quantity"`
+	Amount    int         `json:"amount"`
+	Product   string      `json:"product"`
+	FirstName string      `json:"first_name"`
+	LastName  string      `json:"last_name"`
+	Email     string      `json:"email"`
+	CreatedAt time.Time   `json:"created_at"`
+	Items     []OrderItem `json:"items"`
+}
+
+// OrderItem describes one line of an order
+type OrderItem struct {
+	Product   string `json:"product"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice int    `json:"unit_price"`
+	Amount    int    `json:"amount"`
 }
 
 func (app *application) CreateAndSendInvoice(w http.ResponseWriter, r *http.Request) {
@@ -95,14 +104,34 @@ func (app *application) createInvoicePDF(order Order) error {
 	pdf.Ln(5)
 	pdf.CellFormat(97, 8, order.CreatedAt.Format("2006-01-02"), "", 0, "L", false, 0, "")
 
-	pdf.SetX(58)
-	pdf.SetY(93)
-	pdf.CellFormat(155, 8, order.Product, "", 0, "L", false, 0, "")
-	pdf.SetX(166)
-	pdf.CellFormat(20, 8, fmt.Sprintf("%d", order.Quantity), "", 0, "C", false, 0, "")
+	// older callers send a single product rather than line items
+	items := order.Items
+	if len(items) == 0 {
+		items = []OrderItem{
+			{Product: order.Product, Quantity: order.Quantity, Amount: order.Amount},
+		}
+	}
 
-	pdf.SetX(185)
-	pdf.CellFormat(20, 8, fmt.Sprintf("$%.2f", float32(order.Amount/100.0)), "", 0, "R", false, 0, "")
+	y := 93.0
+	for _, item := range items {
+		pdf.SetX(58)
+		pdf.SetY(y)
+		pdf.CellFormat(155, 8, item.Product, "", 0, "L", false, 0, "")
+		pdf.SetX(166)
+		pdf.CellFormat(20, 8, fmt.Sprintf("%d", item.Quantity), "", 0, "C", false, 0, "")
+
+		pdf.SetX(185)
+		pdf.CellFormat(20, 8, fmt.Sprintf("$%.2f", float32(item.Amount)/100.0), "", 0, "R", false, 0, "")
+		y += 8
+	}
+
+	if len(items) > 1 {
+		pdf.SetY(y)
+		pdf.SetX(166)
+		pdf.CellFormat(20, 8, "Total", "", 0, "C", false, 0, "")
+		pdf.SetX(185)
+		pdf.CellFormat(20, 8, fmt.Sprintf("$%.2f", float32(order.Amount)/100.0), "", 0, "R", false, 0, "")
+	}
 
 	invoicePath := fmt.Sprintf("./invoices/%d.pdf", order.ID)
 	err := pdf.OutputFileAndClose(invoicePath)
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"goEcommerce/internal/driver"
+	"goEcommerce/internal/encryption"
+	"goEcommerce/internal/migrations"
+	"goEcommerce/internal/models"
+	"log"
+	"os"
+	"strconv"
+)
+
+const usage = `Usage: migrate [flags] <command>
+
+Commands:
+  up          apply all pending migrations
+  down        roll back the most recent migration
+  status      list migrations and whether they have been applied
+  to <n>      migrate up or down to version n (0 rolls back everything)
+  seed        load development data, including an admin user with a known
+              password; never run this against production
+  reencrypt   move encrypted data to the active key after a key rotation,
+              and encrypt and index personal data stored before it was
+              encrypted; needs -encryptionkeys and -indexkey, and
+              -legacysecret for data encrypted before keys had ids
+
+Flags:
+`
+
+func main() {
+	var dsn, encryptionKeys, indexKey, legacySecret string
+
+	flag.StringVar(&dsn, "dsn", "username:password@tcp(localhost:3306)/widgets?parseTime=true&tls=false", "DSN")
+	flag.StringVar(&encryptionKeys, "encryptionkeys", "", "Encryption keys as id:base64key, comma separated; the first is the active key")
+	flag.StringVar(&indexKey, "indexkey", "", "Base64 key for the blind indexes of encrypted emails; never rotated")
+	flag.StringVar(&legacySecret, "legacysecret", "", "The old secret key, to re-encrypt data from before keys had ids")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
+	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+
+	conn, err := driver.OpenDB(dsn)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	defer func(conn *sql.DB) {
+		err := conn.Close()
+		if err != nil {
+			return
+		}
+	}(conn)
+
+	migrator, err := migrations.New(conn)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	switch flag.Arg(0) {
+	case "up":
+		n, err := migrator.Up()
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		infoLog.Printf("applied %d migration(s)\n", n)
+
+	case "down":
+		err := migrator.Down()
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		infoLog.Println("rolled back 1 migration")
+
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.Applied {
+				applied = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%06d  %-40s %s\n", s.Version, s.Name, applied)
+		}
+
+	case "to":
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		version, err := strconv.Atoi(flag.Arg(1))
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		n, err := migrator.To(version)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		infoLog.Printf("ran %d migration(s); now at version %d\n", n, version)
+
+	case "seed":
+		err := migrator.Seed()
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		infoLog.Println("loaded development data")
+
+	case "reencrypt":
+		keyring, err := encryption.New(encryptionKeys)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		if legacySecret != "" {
+			keyring.WithLegacyKey([]byte(legacySecret))
+		}
+
+		key, err := encryption.ParseIndexKey(indexKey)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+
+		db := models.DBModel{DB: conn, Keyring: keyring, IndexKey: key}
+		n, err := db.ReEncrypt()
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		infoLog.Printf("re-encrypted %d value(s) with key %s\n", n, keyring.ActiveKey())
+
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
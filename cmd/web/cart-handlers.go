@@ -0,0 +1,381 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"goEcommerce/internal/models"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// cart returns the shopping cart stored in the session
+func (app *application) cart(r *http.Request) models.Cart {
+	cart, ok := app.Session.Get(r.Context(), "cart").(models.Cart)
+	if !ok {
+		return models.Cart{}
+	}
+	return cart
+}
+
+// saveCart stores the cart in the session, and for logged in users, in the database too
+func (app *application) saveCart(r *http.Request, cart models.Cart) {
+	app.Session.Put(r.Context(), "cart", cart)
+
+	if app.Session.Exists(r.Context(), "userID") {
+		err := app.DB.SaveCartForUser(app.Session.GetInt(r.Context(), "userID"), cart)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+}
+
+// priceCart prices the cart from the current widget prices. Items which can no longer be bought
+// are removed from the cart, and the customer is told about it
+func (app *application) priceCart(r *http.Request) (models.Cart, []models.OrderItem, int, error) {
+	cart := app.cart(r)
+
+	var items []models.OrderItem
+	var unavailable []int
+	total := 0
+
+	for _, cartItem := range cart.Items {
+		priced, amount, err := app.DB.PriceItems([]models.CartItem{cartItem})
+		if errors.Is(err, sql.ErrNoRows) || errors.Is(err, models.ErrNotForSale) {
+			unavailable = append(unavailable, cartItem.WidgetID)
+			continue
+		}
+		if err != nil {
+			return cart, nil, 0, err
+		}
+		items = append(items, priced...)
+		total += amount
+	}
+
+	if len(unavailable) > 0 {
+		for _, widgetID := range unavailable {
+			cart.Remove(widgetID)
+		}
+		app.saveCart(r, cart)
+		app.Session.Put(r.Context(), "error", "Some items are no longer available and have been removed from your cart.")
+	}
+
+	return cart, items, total, nil
+}
+
+// cartFormValues reads the widget id and quantity posted by the cart forms
+func cartFormValues(r *http.Request) (int, int, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	widgetID, err := strconv.Atoi(r.Form.Get("widget_id"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	quantity := 1
+	if r.Form.Get("quantity") != "" {
+		quantity, err = strconv.Atoi(r.Form.Get("quantity"))
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return widgetID, quantity, nil
+}
+
+// ShowCart displays the shopping cart
+func (app *application) ShowCart(w http.ResponseWriter, r *http.Request) {
+	_, items, total, err := app.priceCart(r)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["items"] = items
+
+	intMap := make(map[string]int)
+	intMap["total"] = total
+
+	if err := app.renderTemplate(w, r, "cart", &templateData{
+		Data:   data,
+		IntMap: intMap,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// checkCartQuantity reports whether the cart may hold quantity of a widget, which is at most
+// models.MaxItemQuantity and what is in stock. If not, the customer is told why
+func (app *application) checkCartQuantity(r *http.Request, widgetID, quantity int) bool {
+	if quantity > models.MaxItemQuantity {
+		app.Session.Put(r.Context(), "error", fmt.Sprintf("Sorry, you can buy at most %d of one item.", models.MaxItemQuantity))
+		return false
+	}
+
+	available, err := app.DB.AvailableStock(widgetID)
+	if err != nil {
+		app.errorLog.Println(err)
+		return false
+	}
+	if quantity > available {
+		app.Session.Put(r.Context(), "error", fmt.Sprintf("Sorry, only %d of that item are in stock.", max(available, 0)))
+		return false
+	}
+	return true
+}
+
+// AddToCart adds a widget to the shopping cart
+func (app *application) AddToCart(w http.ResponseWriter, r *http.Request) {
+	widgetID, quantity, err := cartFormValues(r)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	// make sure the widget exists and can be bought on its own before it goes in the cart
+	_, _, err = app.DB.PriceItems([]models.CartItem{{WidgetID: widgetID, Quantity: quantity}})
+	if err != nil {
+		app.errorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "That item cannot be added to your cart.")
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	cart := app.cart(r)
+	inCart := 0
+	for _, item := range cart.Items {
+		if item.WidgetID == widgetID {
+			inCart = item.Quantity
+		}
+	}
+
+	if !app.checkCartQuantity(r, widgetID, inCart+quantity) {
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	cart.Add(widgetID, quantity)
+	app.saveCart(r, cart)
+
+	app.Session.Put(r.Context(), "flash", "Added to cart")
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// UpdateCart changes the quantity of a widget in the shopping cart; a quantity of zero removes it
+func (app *application) UpdateCart(w http.ResponseWriter, r *http.Request) {
+	widgetID, quantity, err := cartFormValues(r)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	if quantity > 0 && !app.checkCartQuantity(r, widgetID, quantity) {
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	cart := app.cart(r)
+	cart.Set(widgetID, quantity)
+	app.saveCart(r, cart)
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// RemoveFromCart removes a widget from the shopping cart
+func (app *application) RemoveFromCart(w http.ResponseWriter, r *http.Request) {
+	widgetID, _, err := cartFormValues(r)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	cart := app.cart(r)
+	cart.Remove(widgetID)
+	app.saveCart(r, cart)
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// CartCheckout prices the cart and displays the payment page. The payment intent is created here,
+// for the server side total, so the browser never tells us how much to charge
+func (app *application) CartCheckout(w http.ResponseWriter, r *http.Request) {
+	_, items, total, err := app.priceCart(r)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if len(items) == 0 {
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	metadata := map[string]string{
+		"source": "cart",
+		"items":  models.ItemsDescription(items),
+	}
+
+	pi, msg, err := app.Gateway.CreatePaymentIntent("usd", total, metadata)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.Session.Put(r.Context(), "error", msg)
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	// a new checkout replaces the last one, so give back the stock held for its payment intent
+	previous := app.Session.GetString(r.Context(), "cart_payment_intent")
+	if previous != "" {
+		err = app.DB.ReleaseStock(previous)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+
+	var cartItems []models.CartItem
+	for _, item := range items {
+		cartItems = append(cartItems, models.CartItem{WidgetID: item.WidgetID, Quantity: item.Quantity})
+	}
+
+	err = app.DB.ReserveStock(pi.ID, cartItems)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.Session.Remove(r.Context(), "cart_payment_intent")
+		if errors.Is(err, models.ErrOutOfStock) {
+			app.Session.Put(r.Context(), "error", fmt.Sprintf("Sorry, %s.", err))
+		}
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+	app.Session.Put(r.Context(), "cart_payment_intent", pi.ID)
+
+	data := make(map[string]interface{})
+	data["items"] = items
+
+	intMap := make(map[string]int)
+	intMap["total"] = total
+
+	stringMap := make(map[string]string)
+	stringMap["client_secret"] = pi.ClientSecret
+
+	if err := app.renderTemplate(w, r, "cart-checkout", &templateData{
+		StringMap: stringMap,
+		IntMap:    intMap,
+		Data:      data,
+	}, "stripe-js"); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// CartPaymentSucceeded saves the order for a paid cart, and displays the receipt
+func (app *application) CartPaymentSucceeded(w http.ResponseWriter, r *http.Request) {
+	txnData, err := app.GetTransactionData(r)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "We could not confirm your payment.")
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	// only accept the payment intent created for this cart at checkout
+	if txnData.PaymentIntentID != app.Session.GetString(r.Context(), "cart_payment_intent") {
+		app.errorLog.Printf("payment intent %s was not created for this cart\n", txnData.PaymentIntentID)
+		app.Session.Put(r.Context(), "error", "We could not confirm your payment.")
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+	app.Session.Remove(r.Context(), "cart_payment_intent")
+
+	// the cart may have changed since checkout, so price it again and compare with what was paid
+	_, items, total, err := app.priceCart(r)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.failOrder(w, r, txnData, err, "/cart")
+		return
+	}
+	if len(items) == 0 || total != txnData.PaymentAmount {
+		err = fmt.Errorf("cart total %d does not match payment intent %s amount %d", total, txnData.PaymentIntentID, txnData.PaymentAmount)
+		app.errorLog.Println(err)
+		app.failOrder(w, r, txnData, err, "/cart")
+		return
+	}
+
+	customer := models.Customer{
+		FirstName: txnData.FirstName,
+		LastName:  txnData.LastName,
+		Email:     txnData.Email,
+	}
+
+	txn := models.Transaction{
+		Amount:              txnData.PaymentAmount,
+		Currency:            txnData.PaymentCurrency,
+		LastFour:            txnData.LastFour,
+		ExpiryMonth:         txnData.ExpiryMonth,
+		ExpiryYear:          txnData.ExpiryYear,
+		BankReturnCode:      txnData.BankReturnCode,
+		PaymentIntent:       txnData.PaymentIntentID,
+		PaymentMethod:       txnData.PaymentMethodID,
+		TransactionStatusID: models.TransactionStatusCleared,
+	}
+
+	order := models.Order{
+		StatusID:  models.OrderStatusPaid,
+		Amount:    total,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		Items:     items,
+	}
+
+	orderID, err := app.DB.CreateOrderTx(customer, txn, order)
+	if errors.Is(err, models.ErrPaymentProcessed) {
+		app.paymentProcessed(w, r, txnData, "/cart")
+		return
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		app.failOrder(w, r, txnData, err, "/cart")
+		return
+	}
+
+	app.saveCart(r, models.Cart{})
+
+	// call microservice
+	inv := Invoice{
+		ID:        orderID,
+		Amount:    total,
+		Product:   items[0].Widget.Name,
+		FirstName: txnData.FirstName,
+		LastName:  txnData.LastName,
+		Email:     txnData.Email,
+		CreatedAt: time.Now(),
+	}
+
+	for _, item := range items {
+		inv.Quantity += item.Quantity
+		inv.Items = append(inv.Items, InvoiceItem{
+			Product:   item.Widget.Name,
+			Quantity:  item.Quantity,
+			UnitPrice: item.UnitPrice,
+			Amount:    item.Amount,
+		})
+	}
+
+	err = app.callInvoiceMicro(inv)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	// write this data to session, and then redirect user to new page
+	app.Session.Put(r.Context(), "receipt", txnData)
+	http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+)
+
+const (
+	// csrfSessionKey is where the session's csrf token is kept
+	csrfSessionKey = "csrf_token"
+	// csrfFormField is the form field forms post the csrf token in
+	csrfFormField = "csrf_token"
+	// csrfHeader is the header scripts send the csrf token in
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrfToken returns the session's csrf token, making one the first time it is needed
+func (app *application) csrfToken(r *http.Request) string {
+	token := app.Session.GetString(r.Context(), csrfSessionKey)
+	if token != "" {
+		return token
+	}
+
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		app.errorLog.Println(err)
+		return ""
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(b)
+	app.Session.Put(r.Context(), csrfSessionKey, token)
+	return token
+}
+
+// CSRF refuses requests with unsafe methods unless they carry the session's csrf token, in the
+// csrf_token form field or the X-CSRF-Token header, so other sites cannot post forms with the
+// session cookie
+func (app *application) CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		expected := app.Session.GetString(r.Context(), csrfSessionKey)
+
+		sent := r.Header.Get(csrfHeader)
+		if sent == "" {
+			sent = r.PostFormValue(csrfFormField)
+		}
+
+		if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(sent)) != 1 {
+			app.infoLog.Printf("csrf token missing or wrong for %s %s\n", r.Method, r.URL.Path)
+			app.csrfFailed(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfFailed shows the error page for a request without a good csrf token
+func (app *application) csrfFailed(w http.ResponseWriter, r *http.Request) {
+	stringMap := make(map[string]string)
+	stringMap["title"] = "Your session has expired"
+	stringMap["message"] = "The form you sent could not be checked, so nothing was changed. Go back, reload the page and try again."
+
+	w.WriteHeader(http.StatusForbidden)
+	if err := app.renderTemplate(w, r, "error", &templateData{
+		StringMap: stringMap,
+	}); err != nil {
+		app.errorLog.Print(err)
+	}
+}
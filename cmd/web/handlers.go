@@ -3,17 +3,16 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"goEcommerce/internal/cards"
-	"goEcommerce/internal/encryption"
 	"goEcommerce/internal/models"
-	"goEcommerce/internal/urlsigner"
 	"io"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/stripe/stripe-go/v75"
 )
 
 // Home displays the home page
@@ -42,6 +41,7 @@ type TransactionData struct {
 	ExpiryMonth     int
 	ExpiryYear      int
 	BankReturnCode  string
+	Items           string
 }
 
 // GetTransactionData gets txn data from post and stripe
@@ -58,22 +58,19 @@ func (app *application) GetTransactionData(r *http.Request) (TransactionData, er
 	email := r.Form.Get("email")
 	paymentIntent := r.Form.Get("payment_intent")
 	paymentMethod := r.Form.Get("payment_method")
-	paymentAmount := r.Form.Get("payment_amount")
-	paymentCurrency := r.Form.Get("payment_currency")
-	amount, _ := strconv.Atoi(paymentAmount)
 
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key:    app.config.stripe.key,
-	}
-
-	pi, err := card.RetrievePaymentIntent(paymentIntent)
+	// the amount and currency come from the payment intent, never from the posted form
+	pi, err := app.Gateway.RetrievePaymentIntent(paymentIntent)
 	if err != nil {
 		app.errorLog.Println(err)
 		return txnData, err
 	}
 
-	pm, err := card.GetPaymentMethod(paymentMethod)
+	if pi.Status != stripe.PaymentIntentStatusSucceeded || pi.LatestCharge == nil {
+		return txnData, fmt.Errorf("payment intent %s has not succeeded", paymentIntent)
+	}
+
+	pm, err := app.Gateway.GetPaymentMethod(paymentMethod)
 	if err != nil {
 		app.errorLog.Println(err)
 		return txnData, err
@@ -89,25 +86,35 @@ func (app *application) GetTransactionData(r *http.Request) (TransactionData, er
 		Email:           email,
 		PaymentIntentID: paymentIntent,
 		PaymentMethodID: paymentMethod,
-		PaymentAmount:   amount,
-		PaymentCurrency: paymentCurrency,
+		PaymentAmount:   int(pi.Amount),
+		PaymentCurrency: string(pi.Currency),
 		LastFour:        lastFour,
 		ExpiryMonth:     int(expiryMonth),
 		ExpiryYear:      int(expiryYear),
 		BankReturnCode:  pi.LatestCharge.ID,
+		Items:           pi.Metadata["items"],
 	}
 	return txnData, nil
 }
 
 type Invoice struct {
-	ID        int       `json:"id"`
-	Quantity  int       `json:"quantity"`
-	Amount    int       `json:"amount"`
-	Product   string    `json:"product"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        int           `json:"id"`
+	Quantity  int           `json:"quantity"`
+	Amount    int           `json:"amount"`
+	Product   string        `json:"product"`
+	FirstName string        `json:"first_name"`
+	LastName  string        `json:"last_name"`
+	Email     string        `json:"email"`
+	CreatedAt time.Time     `json:"created_at"`
+	Items     []InvoiceItem `json:"items"`
+}
+
+// InvoiceItem is one line of an invoice
+type InvoiceItem struct {
+	Product   string `json:"product"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice int    `json:"unit_price"`
+	Amount    int    `json:"amount"`
 }
 
 // PaymentSucceeded displays the receipt page
@@ -120,21 +127,50 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 
 	// read posted data
 	widgetID, _ := strconv.Atoi(r.Form.Get("product_id"))
+	quantity := 1
+	if r.Form.Get("quantity") != "" {
+		quantity, _ = strconv.Atoi(r.Form.Get("quantity"))
+	}
 
 	txnData, err := app.GetTransactionData(r)
 	if err != nil {
 		app.errorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "We could not confirm your payment.")
+		http.Redirect(w, r, fmt.Sprintf("/widget/%d", widgetID), http.StatusSeeOther)
+		return
+	}
+
+	// only accept the payment intent created for this page, and only once
+	if txnData.PaymentIntentID != app.Session.GetString(r.Context(), "payment_intent") {
+		app.errorLog.Printf("payment intent %s was not created for this session\n", txnData.PaymentIntentID)
+		app.Session.Put(r.Context(), "error", "We could not confirm your payment.")
+		http.Redirect(w, r, fmt.Sprintf("/widget/%d", widgetID), http.StatusSeeOther)
 		return
 	}
+	app.Session.Remove(r.Context(), "payment_intent")
 
-	// create a new customer
-	customerID, err := app.SaveCustomer(txnData.FirstName, txnData.LastName, txnData.Email)
+	// the card has already been charged, so a failure from here on must go through compensation.
+	// Price the order from the database and make sure that is what the payment intent charged
+	items, total, err := app.DB.PriceItems([]models.CartItem{{WidgetID: widgetID, Quantity: quantity}})
+	if err == nil && models.ItemsDescription(items) != txnData.Items {
+		err = fmt.Errorf("posted items %s do not match payment intent %s items %s", models.ItemsDescription(items), txnData.PaymentIntentID, txnData.Items)
+	}
+	if err == nil && total != txnData.PaymentAmount {
+		err = fmt.Errorf("order total %d does not match payment intent %s amount %d", total, txnData.PaymentIntentID, txnData.PaymentAmount)
+	}
 	if err != nil {
 		app.errorLog.Println(err)
+		app.failOrder(w, r, txnData, err, fmt.Sprintf("/widget/%d", widgetID))
 		return
 	}
+	widget := items[0].Widget
+
+	customer := models.Customer{
+		FirstName: txnData.FirstName,
+		LastName:  txnData.LastName,
+		Email:     txnData.Email,
+	}
 
-	// create a new transaction
 	txn := models.Transaction{
 		Amount:              txnData.PaymentAmount,
 		Currency:            txnData.PaymentCurrency,
@@ -144,29 +180,28 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 		BankReturnCode:      txnData.BankReturnCode,
 		PaymentIntent:       txnData.PaymentIntentID,
 		PaymentMethod:       txnData.PaymentMethodID,
-		TransactionStatusID: 2,
+		TransactionStatusID: models.TransactionStatusCleared,
 	}
 
-	txnID, err := app.SaveTransaction(txn)
-	if err != nil {
-		app.errorLog.Println(err)
-		return
+	order := models.Order{
+		WidgetID:  widgetID,
+		StatusID:  models.OrderStatusPaid,
+		Quantity:  quantity,
+		Amount:    total,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		Items:     items,
 	}
 
-	// create a new order
-	order := models.Order{
-		WidgetID:      widgetID,
-		TransactionID: txnID,
-		CustomerID:    customerID,
-		StatusID:      1,
-		Quantity:      1,
-		Amount:        txnData.PaymentAmount,
-		CreatedAt:     time.Now(),
-		UpdatedAt:     time.Now(),
+	// create the customer, transaction and order together
+	orderID, err := app.DB.CreateOrderTx(customer, txn, order)
+	if errors.Is(err, models.ErrPaymentProcessed) {
+		app.paymentProcessed(w, r, txnData, fmt.Sprintf("/widget/%d", widgetID))
+		return
 	}
-	orderID, err := app.SaveOrder(order)
 	if err != nil {
 		app.errorLog.Println(err)
+		app.failOrder(w, r, txnData, err, fmt.Sprintf("/widget/%d", widgetID))
 		return
 	}
 
@@ -174,7 +209,7 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 	inv := Invoice{
 		ID:        orderID,
 		Amount:    order.Amount,
-		Product:   "Widget",
+		Product:   widget.Name,
 		Quantity:  order.Quantity,
 		FirstName: txnData.FirstName,
 		LastName:  txnData.LastName,
@@ -182,6 +217,15 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 		CreatedAt: time.Now(),
 	}
 
+	for _, item := range order.Items {
+		inv.Items = append(inv.Items, InvoiceItem{
+			Product:   widget.Name,
+			Quantity:  item.Quantity,
+			UnitPrice: item.UnitPrice,
+			Amount:    item.Amount,
+		})
+	}
+
 	err = app.callInvoiceMicro(inv)
 	if err != nil {
 		app.errorLog.Println(err)
@@ -238,7 +282,7 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 		BankReturnCode:      txnData.BankReturnCode,
 		PaymentIntent:       txnData.PaymentIntentID,
 		PaymentMethod:       txnData.PaymentMethodID,
-		TransactionStatusID: 2,
+		TransactionStatusID: models.TransactionStatusCleared,
 	}
 
 	_, err = app.SaveTransaction(txn)
@@ -278,21 +322,6 @@ func (app *application) VirtualTerminalReceipt(w http.ResponseWriter, r *http.Re
 	}
 }
 
-// SaveCustomer saves a customer and returns id
-func (app *application) SaveCustomer(firstName, lastName, email string) (int, error) {
-	customer := models.Customer{
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
-	}
-
-	id, err := app.DB.InsertCustomer(customer)
-	if err != nil {
-		return 0, err
-	}
-	return id, nil
-}
-
 // SaveTransaction saves a txn and returns id
 func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
 	id, err := app.DB.InsertTransaction(txn)
@@ -302,13 +331,53 @@ func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
 	return id, nil
 }
 
-// SaveOrder saves a order and returns id
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id, err := app.DB.InsertOrder(order)
+// compensateFailedOrder is called when a card was charged but the order could not be saved. It
+// refunds the charge, and if that fails too, flags the payment for manual review. It returns true
+// if the charge was refunded
+func (app *application) compensateFailedOrder(txnData TransactionData, orderErr error) bool {
+	// the order will not be saved, so nothing should hold its stock
+	err := app.DB.ReleaseStock(txnData.PaymentIntentID)
 	if err != nil {
-		return 0, err
+		app.errorLog.Println(err)
 	}
-	return id, nil
+
+	_, err = app.Gateway.Refund(txnData.PaymentIntentID, txnData.PaymentAmount)
+	if err == nil {
+		app.infoLog.Printf("refunded payment intent %s because the order could not be saved\n", txnData.PaymentIntentID)
+		return true
+	}
+	app.errorLog.Println(err)
+
+	err = app.DB.InsertPaymentReview(models.PaymentReview{
+		PaymentIntent: txnData.PaymentIntentID,
+		Amount:        txnData.PaymentAmount,
+		Currency:      txnData.PaymentCurrency,
+		Email:         txnData.Email,
+		Reason:        orderErr.Error(),
+	})
+	if err != nil {
+		app.errorLog.Printf("payment intent %s needs manual review and could not be flagged: %s\n", txnData.PaymentIntentID, err)
+	}
+	return false
+}
+
+// failOrder compensates for a charge whose order could not be saved, and redirects to returnTo
+// with a message telling the customer what happened to their money
+func (app *application) failOrder(w http.ResponseWriter, r *http.Request, txnData TransactionData, orderErr error, returnTo string) {
+	if app.compensateFailedOrder(txnData, orderErr) {
+		app.Session.Put(r.Context(), "error", "Sorry, we could not save your order. Your payment has been refunded.")
+	} else {
+		app.Session.Put(r.Context(), "error", "Sorry, we could not save your order. Your payment is being reviewed and we will contact you by email.")
+	}
+	http.Redirect(w, r, returnTo, http.StatusSeeOther)
+}
+
+// paymentProcessed redirects to returnTo for a payment which was sent again after its order was
+// saved. The first order stands, so nothing is refunded
+func (app *application) paymentProcessed(w http.ResponseWriter, r *http.Request, txnData TransactionData, returnTo string) {
+	app.infoLog.Printf("payment intent %s has already been processed\n", txnData.PaymentIntentID)
+	app.Session.Put(r.Context(), "flash", "This payment has already been processed.")
+	http.Redirect(w, r, returnTo, http.StatusSeeOther)
 }
 
 // ChargeOnce displays the page to buy one widget
@@ -317,6 +386,12 @@ func (app *application) ChargeOnce(w http.ResponseWriter, r *http.Request) {
 	widgetID, _ := strconv.Atoi(id)
 
 	widget, err := app.DB.GetWidget(widgetID)
+	if err != nil || widget.IsRecurring || widget.IsArchived {
+		http.NotFound(w, r)
+		return
+	}
+
+	available, err := app.DB.AvailableStock(widgetID)
 	if err != nil {
 		app.errorLog.Println(err)
 		return
@@ -325,33 +400,125 @@ func (app *application) ChargeOnce(w http.ResponseWriter, r *http.Request) {
 	data := make(map[string]interface{})
 	data["widget"] = widget
 
+	intMap := make(map[string]int)
+	intMap["available"] = available
+
 	if err := app.renderTemplate(w, r, "buy-once", &templateData{
-		Data: data,
+		Data:   data,
+		IntMap: intMap,
 	}, "stripe-js"); err != nil {
 		app.errorLog.Println(err)
 	}
 }
 
-// BronzePlan displays the bronze plan page
-func (app *application) BronzePlan(w http.ResponseWriter, r *http.Request) {
-	widget, err := app.DB.GetWidget(2)
+// WidgetPaymentIntent prices a widget from the database, and returns a payment intent for it as
+// json. The intent is kept in the session, and is the only one the buy once page will accept
+func (app *application) WidgetPaymentIntent(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		WidgetID int `json:"widget_id"`
+		Quantity int `json:"quantity"`
+	}
+
+	var resp struct {
+		OK           bool   `json:"ok"`
+		Message      string `json:"message,omitempty"`
+		ClientSecret string `json:"client_secret,omitempty"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		app.errorLog.Println(err)
+		resp.Message = "That item is not available"
+		app.writeJSON(w, resp)
+		return
+	}
+
+	items := []models.CartItem{{WidgetID: payload.WidgetID, Quantity: max(payload.Quantity, 1)}}
+	priced, amount, err := app.DB.PriceItems(items)
 	if err != nil {
 		app.errorLog.Println(err)
+		resp.Message = "That item is not available"
+		app.writeJSON(w, resp)
+		return
+	}
+
+	metadata := map[string]string{
+		"source": "store",
+		"items":  models.ItemsDescription(priced),
+	}
+
+	pi, msg, err := app.Gateway.CreatePaymentIntent("usd", amount, metadata)
+	if err != nil {
+		app.errorLog.Println(err)
+		resp.Message = msg
+		app.writeJSON(w, resp)
+		return
+	}
+
+	// a new payment intent replaces the last one, so give back the stock held for it
+	previous := app.Session.GetString(r.Context(), "payment_intent")
+	if previous != "" {
+		err = app.DB.ReleaseStock(previous)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+	app.Session.Remove(r.Context(), "payment_intent")
+
+	// hold the stock until the intent is paid; an intent we refuse here is never confirmed
+	err = app.DB.ReserveStock(pi.ID, items)
+	if err != nil {
+		app.errorLog.Println(err)
+		resp.Message = "That item is not available"
+		if errors.Is(err, models.ErrOutOfStock) {
+			resp.Message = fmt.Sprintf("Sorry, %s", err)
+		}
+		app.writeJSON(w, resp)
+		return
+	}
+	app.Session.Put(r.Context(), "payment_intent", pi.ID)
+
+	resp.OK = true
+	resp.ClientSecret = pi.ClientSecret
+	app.writeJSON(w, resp)
+}
+
+// writeJSON writes data as the json response
+func (app *application) writeJSON(w http.ResponseWriter, data interface{}) {
+	out, err := json.Marshal(data)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(out)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// Plan displays the page for any subscription plan, found by its slug
+func (app *application) Plan(w http.ResponseWriter, r *http.Request) {
+	widget, err := app.DB.GetWidgetBySlug(chi.URLParam(r, "slug"))
+	if err != nil || !widget.IsRecurring || widget.IsArchived {
+		http.NotFound(w, r)
 		return
 	}
 
 	data := make(map[string]interface{})
 	data["widget"] = widget
 
-	if err := app.renderTemplate(w, r, "bronze-plan", &templateData{
+	if err := app.renderTemplate(w, r, "plan", &templateData{
 		Data: data,
 	}); err != nil {
 		app.errorLog.Print(err)
 	}
 }
 
-// BronzePlanReceipt displays the receipt for bronze plans
-func (app *application) BronzePlanReceipt(w http.ResponseWriter, r *http.Request) {
+// PlanReceipt displays the receipt for subscription plans
+func (app *application) PlanReceipt(w http.ResponseWriter, r *http.Request) {
 	if err := app.renderTemplate(w, r, "receipt-plan", &templateData{}); err != nil {
 		app.errorLog.Print(err)
 	}
@@ -380,16 +547,38 @@ func (app *application) PostLoginPage(w http.ResponseWriter, r *http.Request) {
 	email := r.Form.Get("email")
 	password := r.Form.Get("password")
 
-	id, err := app.DB.Authenticate(email, password)
+	// the login page posts the token the api gave out, and it must belong to the same user. The api
+	// throttles password guessing and checks two factor codes, so this form cannot get around them.
+	// The token is checked first, so without one this form says nothing about the password
+	tokenUser, err := app.DB.GetUserForToken(r.Form.Get("token"))
 	if err != nil {
+		app.Session.Put(r.Context(), "error", "Please log in again.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := app.DB.Authenticate(email, password)
+	if err != nil || id != tokenUser.ID {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 	app.Session.Put(r.Context(), "userID", id)
+	// a new csrf token for the logged in session
+	app.Session.Remove(r.Context(), csrfSessionKey)
+
+	// bring back the cart saved at the last visit, keeping anything added before logging in
+	saved, err := app.DB.GetCartForUser(id)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+	cart := app.cart(r)
+	cart.Merge(saved)
+	app.saveCart(r, cart)
+
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-// Logout from session
+// Logout ends the session. It is a post carrying the csrf token, so other sites cannot log users out
 func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
 	err := app.Session.Destroy(r.Context())
 	if err != nil {
@@ -410,42 +599,23 @@ func (app *application) ForgotPassword(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// ShowResetPassword shows the reset password page (and validates url integrity)
+// ShowResetPassword shows the reset password page, if the token from the reset link is still good.
+// The token is only used up when the new password is posted to the api
 func (app *application) ShowResetPassword(w http.ResponseWriter, r *http.Request) {
-	email := r.URL.Query().Get("email")
-	theURL := r.RequestURI
-	testURL := fmt.Sprintf("%s%s", app.config.frontend, theURL)
-
-	signer := urlsigner.Signer{
-		Secret: []byte(app.config.secretkey),
-	}
-
-	valid := signer.VerifyToken(testURL)
-
-	if !valid {
-		app.errorLog.Println("Invalid url - tampering detected")
-		return
-	}
+	token := r.URL.Query().Get("token")
 
-	// make sure not expired
-	expired := signer.Expired(testURL, 60)
-	if expired {
-		app.errorLog.Println("Link expired")
-		return
-	}
-
-	encryptor := encryption.Encryption{
-		Key: []byte(app.config.secretkey),
-	}
-
-	encryptedEmail, err := encryptor.Encrypt(email)
+	_, err := app.DB.CheckActionToken(token, models.PurposePasswordReset)
 	if err != nil {
-		app.errorLog.Println("Encryption failed")
+		if !errors.Is(err, models.ErrInvalidToken) {
+			app.errorLog.Println(err)
+		}
+		app.Session.Put(r.Context(), "error", "That reset link is invalid, has expired or has already been used.")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
 		return
 	}
 
 	data := make(map[string]interface{})
-	data["email"] = encryptedEmail
+	data["token"] = token
 
 	if err := app.renderTemplate(w, r, "reset-password", &templateData{
 		Data: data,
@@ -475,8 +645,16 @@ func (app *application) ShowSale(w http.ResponseWriter, r *http.Request) {
 	stringMap["cancel"] = "/admin/all-sales"
 	stringMap["refund-url"] = "/api/admin/refund"
 	stringMap["refund-btn"] = "Refund Order"
+	stringMap["refund-permission"] = string(models.PermRefund)
+	stringMap["refunded-msg"] = "Refunded"
+
+	intMap := make(map[string]int)
+	intMap["refund-status"] = models.OrderStatusRefunded
+	intMap["partial-refunds"] = 1
+
 	if err := app.renderTemplate(w, r, "sale", &templateData{
 		StringMap: stringMap,
+		IntMap:    intMap,
 	}); err != nil {
 		app.errorLog.Print(err)
 	}
@@ -489,8 +667,19 @@ func (app *application) ShowSubscription(w http.ResponseWriter, r *http.Request)
 	stringMap["cancel"] = "/admin/all-subscriptions"
 	stringMap["refund-url"] = "/api/admin/cancel-subscription"
 	stringMap["refund-btn"] = "Cancel Subscription"
+	stringMap["refund-permission"] = string(models.PermCancelSubscriptions)
+	stringMap["refunded-msg"] = "Cancelling at the end of the billing period"
+
+	intMap := make(map[string]int)
+	intMap["refund-status"] = models.OrderStatusCancelling
+	intMap["subscription-actions"] = 1
+	intMap["status-paid"] = models.OrderStatusPaid
+	intMap["status-paused"] = models.OrderStatusPaused
+	intMap["status-cancelling"] = models.OrderStatusCancelling
+
 	if err := app.renderTemplate(w, r, "sale", &templateData{
 		StringMap: stringMap,
+		IntMap:    intMap,
 	}); err != nil {
 		app.errorLog.Print(err)
 	}
@@ -503,6 +692,53 @@ func (app *application) AllUsers(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// APIKeys shows the api keys page
+func (app *application) APIKeys(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "api-keys", &templateData{}); err != nil {
+		app.errorLog.Print(err)
+	}
+}
+
+// AuditLog shows the audit log of admin actions
+func (app *application) AuditLog(w http.ResponseWriter, r *http.Request) {
+	data := make(map[string]interface{})
+	data["actions"] = models.AuditActions
+
+	if err := app.renderTemplate(w, r, "audit-log", &templateData{
+		Data: data,
+	}); err != nil {
+		app.errorLog.Print(err)
+	}
+}
+
+// MyTokens shows the logged in user the devices they are logged in on
+func (app *application) MyTokens(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "my-tokens", &templateData{}); err != nil {
+		app.errorLog.Print(err)
+	}
+}
+
+// TwoFactor shows the logged in user their two factor authentication settings
+func (app *application) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "two-factor", &templateData{}); err != nil {
+		app.errorLog.Print(err)
+	}
+}
+
+// AllWidgets shows the all widgets page
+func (app *application) AllWidgets(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "all-widgets", &templateData{}); err != nil {
+		app.errorLog.Print(err)
+	}
+}
+
+// OneWidget shows one widget for add/edit/archive
+func (app *application) OneWidget(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "one-widget", &templateData{}); err != nil {
+		app.errorLog.Print(err)
+	}
+}
+
 // OneUser shows one admin user for add/edit/delete
 func (app *application) OneUser(w http.ResponseWriter, r *http.Request) {
 	if err := app.renderTemplate(w, r, "one-user", &templateData{}); err != nil {
@@ -7,8 +7,11 @@ import (
 	"fmt"
 	"github.com/alexedwards/scs/mysqlstore"
 	"github.com/alexedwards/scs/v2"
+	"goEcommerce/internal/cards"
 	"goEcommerce/internal/driver"
+	"goEcommerce/internal/encryption"
 	"goEcommerce/internal/models"
+	"goEcommerce/internal/storage"
 	"html/template"
 	"log"
 	"net/http"
@@ -32,8 +35,15 @@ type config struct {
 		secret string
 		key    string
 	}
-	secretkey string
-	frontend  string
+	gateway string
+	storage struct {
+		name string
+		dir  string
+		url  string
+	}
+	encryptionkeys string
+	indexkey       string
+	frontend       string
 }
 
 type application struct {
@@ -44,6 +54,8 @@ type application struct {
 	version       string
 	DB            models.DBModel
 	Session       *scs.SessionManager
+	Gateway       cards.PaymentGateway
+	Storage       storage.Storage
 }
 
 func (app *application) serve() error {
@@ -63,14 +75,20 @@ func (app *application) serve() error {
 
 func main() {
 	gob.Register(TransactionData{})
+	gob.Register(models.Cart{})
 	var cfg config
 
 	flag.IntVar(&cfg.port, "port", 4000, "Server port to listen on")
 	flag.StringVar(&cfg.env, "env", "development", "Application enviornment {development|production}")
 	flag.StringVar(&cfg.db.dsn, "dsn", "username:password@tcp(localhost:3306)/widgets?parseTime=true&tls=false", "DSN")
 	flag.StringVar(&cfg.api, "api", "http://localhost:4001", "URL to api")
-	flag.StringVar(&cfg.secretkey, "secret", "qdYaJw3sIhTVH5opBEr0PNoIXLWr5QqC", "secret key")
+	flag.StringVar(&cfg.encryptionkeys, "encryptionkeys", "dev:cWRZYUp3M3NJaFRWSDVvcEJFcjBQTm9JWExXcjVRcUM=", "Encryption keys as id:base64key, comma separated; the first encrypts new data")
+	flag.StringVar(&cfg.indexkey, "indexkey", "d2lkZ2V0cy1kZXYtYmxpbmQtaW5kZXgta2V5LTAwMDE=", "Base64 key for the blind indexes of encrypted emails; never rotated")
 	flag.StringVar(&cfg.frontend, "frontend", "http://localhost:4000", "url to front end")
+	flag.StringVar(&cfg.gateway, "gateway", "stripe", "Payment gateway {stripe|fake}")
+	flag.StringVar(&cfg.storage.name, "storage", "local", "File storage for uploads {local}")
+	flag.StringVar(&cfg.storage.dir, "storagedir", "./static", "Directory for local file storage")
+	flag.StringVar(&cfg.storage.url, "storageurl", "/static", "Base url uploads are served from")
 
 	flag.Parse()
 
@@ -80,6 +98,30 @@ func main() {
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 
+	gateway, err := cards.NewGateway(cfg.gateway, cfg.stripe.secret, cfg.stripe.key)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	if cfg.gateway == "fake" {
+		// the checkout pages confirm cards with Stripe.js, which knows nothing about fake intents
+		infoLog.Println("the fake payment gateway is for the api and tests; browser checkout needs -gateway=stripe")
+	}
+
+	store, err := storage.New(cfg.storage.name, cfg.storage.dir, cfg.storage.url)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	keyring, err := encryption.New(cfg.encryptionkeys)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	indexKey, err := encryption.ParseIndexKey(cfg.indexkey)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
 	conn, err := driver.OpenDB(cfg.db.dsn)
 	if err != nil {
 		errorLog.Fatal(err)
@@ -104,8 +146,10 @@ func main() {
 		errorLog:      errorLog,
 		templateCache: tc,
 		version:       version,
-		DB:            models.DBModel{DB: conn},
+		DB:            models.DBModel{DB: conn, Keyring: keyring, IndexKey: indexKey},
 		Session:       session,
+		Gateway:       gateway,
+		Storage:       store,
 	}
 
 	go app.ListenToWsChannel()
@@ -1,17 +1,59 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"goEcommerce/internal/models"
+	"net/http"
+)
+
+// contextKey is the type for values stored in the request context
+type contextKey string
+
+// userContextKey holds the logged in models.User
+const userContextKey contextKey = "user"
 
 func SessionLoad(next http.Handler) http.Handler {
 	return session.LoadAndSave(next)
 }
 
+// Auth lets logged in users through, with their user record in the request context. Users are looked
+// up on every request, so a changed role or a deleted user takes effect straight away
 func (app *application) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !app.Session.Exists(r.Context(), "userID") {
 			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
 			return
 		}
-		next.ServeHTTP(w, r)
+
+		user, err := app.DB.GetOneUser(app.Session.GetInt(r.Context(), "userID"))
+		if err != nil {
+			app.Session.Remove(r.Context(), "userID")
+			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// RequirePermission sends users whose role does not have permission p back to the home page. Users
+// whose role requires two factor authentication are sent to set it up first
+func (app *application) RequirePermission(p models.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := r.Context().Value(userContextKey).(models.User)
+			if !ok || !user.Role.Can(p) {
+				app.Session.Put(r.Context(), "error", "You do not have permission to view that page.")
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+			if user.TwoFactorRequired && !user.TwoFactorEnabled {
+				app.Session.Put(r.Context(), "error", "Your role requires two factor authentication. Set it up to continue.")
+				http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"embed"
 	"fmt"
+	"goEcommerce/internal/models"
 	"html/template"
 	"net/http"
 	"strings"
@@ -19,6 +20,7 @@ type templateData struct {
 	Error                string
 	IsAuthenticated      int
 	UserID               int
+	Role                 models.Role
 	API                  string
 	CSSVersion           string
 	StripeSecretKey      string
@@ -34,6 +36,25 @@ func formatCurrency(n int) string {
 	return fmt.Sprintf("$%.2f", f)
 }
 
+// Can reports whether the logged in user's role has permission p, for showing and hiding admin
+// links and buttons. The api and the admin routes enforce the permissions themselves
+func (td *templateData) Can(p string) bool {
+	return td.Role.Can(models.Permission(p))
+}
+
+// imageURL returns the url of a stored image
+func (app *application) imageURL(key string) string {
+	return app.Storage.URL(key)
+}
+
+// thumbnailURL returns the url of a widget's thumbnail, or of its full image if it has no thumbnail
+func (app *application) thumbnailURL(widget models.Widget) string {
+	if widget.Thumbnail == "" {
+		return app.imageURL(widget.Image)
+	}
+	return app.imageURL(widget.Thumbnail)
+}
+
 //go:embed templates
 var templateFS embed.FS
 
@@ -41,10 +62,23 @@ func (app *application) addDefaultData(td *templateData, r *http.Request) *templ
 	td.API = app.config.api
 	td.StripeSecretKey = app.config.stripe.secret
 	td.StripePublishableKey = app.config.stripe.key
+	td.Flash = app.Session.PopString(r.Context(), "flash")
+	td.Error = app.Session.PopString(r.Context(), "error")
+	td.CSRFToken = app.csrfToken(r)
 
 	if app.Session.Exists(r.Context(), "userID") {
 		td.IsAuthenticated = 1
 		td.UserID = app.Session.GetInt(r.Context(), "userID")
+
+		user, ok := r.Context().Value(userContextKey).(models.User)
+		if !ok {
+			var err error
+			user, err = app.DB.GetOneUser(td.UserID)
+			if err != nil {
+				app.errorLog.Println(err)
+			}
+		}
+		td.Role = user.Role
 	} else {
 		td.IsAuthenticated = 0
 		td.UserID = 0
@@ -89,6 +123,11 @@ func (app *application) parseTemplate(partials []string, page, templateToRender
 	var t *template.Template
 	var err error
 
+	funcs := template.FuncMap{
+		"imageURL":     app.imageURL,
+		"thumbnailURL": app.thumbnailURL,
+	}
+
 	// build partials
 	if len(partials) > 0 {
 		for i, x := range partials {
@@ -97,9 +136,9 @@ func (app *application) parseTemplate(partials []string, page, templateToRender
 	}
 
 	if len(partials) > 0 {
-		t, err = template.New(fmt.Sprintf("%s.page.gohtml", page)).Funcs(functions).ParseFS(templateFS, "templates/base.layout.gohtml", strings.Join(partials, ","), templateToRender)
+		t, err = template.New(fmt.Sprintf("%s.page.gohtml", page)).Funcs(functions).Funcs(funcs).ParseFS(templateFS, "templates/base.layout.gohtml", strings.Join(partials, ","), templateToRender)
 	} else {
-		t, err = template.New(fmt.Sprintf("%s.page.gohtml", page)).Funcs(functions).ParseFS(templateFS, "templates/base.layout.gohtml", templateToRender)
+		t, err = template.New(fmt.Sprintf("%s.page.gohtml", page)).Funcs(functions).Funcs(funcs).ParseFS(templateFS, "templates/base.layout.gohtml", templateToRender)
 	}
 	if err != nil {
 		app.errorLog.Println(err)
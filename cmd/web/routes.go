@@ -1,6 +1,7 @@
 package main
 
 import (
+	"goEcommerce/internal/models"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -9,32 +10,54 @@ import (
 func (app *application) routes() http.Handler {
 	mux := chi.NewRouter()
 	mux.Use(SessionLoad)
+	mux.Use(app.CSRF)
 
 	mux.Get("/", app.Home)
 	mux.Get("/ws", app.WsEndPoint)
 
 	mux.Route("/admin", func(mux chi.Router) {
 		mux.Use(app.Auth)
-		mux.Get("/virtual-terminal", app.VirtualTerminal)
-		mux.Get("/all-sales", app.AllSales)
-		mux.Get("/all-subscriptions", app.AllSubscriptions)
-		mux.Get("/sales/{id}", app.ShowSale)
-		mux.Get("/subscriptions/{id}", app.ShowSubscription)
-		mux.Get("/all-users", app.AllUsers)
-		mux.Get("/all-users/{id}", app.OneUser)
+		mux.Get("/my-tokens", app.MyTokens)
+		mux.Get("/two-factor", app.TwoFactor)
+		mux.With(app.RequirePermission(models.PermVirtualTerminal)).Get("/virtual-terminal", app.VirtualTerminal)
+
+		viewSales := app.RequirePermission(models.PermViewSales)
+		mux.With(viewSales).Get("/all-sales", app.AllSales)
+		mux.With(viewSales).Get("/all-subscriptions", app.AllSubscriptions)
+		mux.With(viewSales).Get("/sales/{id}", app.ShowSale)
+		mux.With(viewSales).Get("/subscriptions/{id}", app.ShowSubscription)
+
+		viewWidgets := app.RequirePermission(models.PermViewWidgets)
+		mux.With(viewWidgets).Get("/all-widgets", app.AllWidgets)
+		mux.With(viewWidgets).Get("/all-widgets/{id}", app.OneWidget)
+
+		viewUsers := app.RequirePermission(models.PermViewUsers)
+		mux.With(viewUsers).Get("/all-users", app.AllUsers)
+		mux.With(viewUsers).Get("/all-users/{id}", app.OneUser)
+
+		mux.With(app.RequirePermission(models.PermManageAPIKeys)).Get("/api-keys", app.APIKeys)
+		mux.With(app.RequirePermission(models.PermViewAuditLog)).Get("/audit-log", app.AuditLog)
 	})
 
 	mux.Get("/widget/{id}", app.ChargeOnce)
+	mux.Post("/payment-intent", app.WidgetPaymentIntent)
 	mux.Post("/payment-succeeded", app.PaymentSucceeded)
 	mux.Get("/receipt", app.Receipt)
 
-	mux.Get("/plans/bronze", app.BronzePlan)
-	mux.Get("/receipt/bronze", app.BronzePlanReceipt)
+	mux.Get("/cart", app.ShowCart)
+	mux.Post("/cart/add", app.AddToCart)
+	mux.Post("/cart/update", app.UpdateCart)
+	mux.Post("/cart/remove", app.RemoveFromCart)
+	mux.Get("/cart/checkout", app.CartCheckout)
+	mux.Post("/cart/payment-succeeded", app.CartPaymentSucceeded)
+
+	mux.Get("/plans/{slug}", app.Plan)
+	mux.Get("/receipt/plan", app.PlanReceipt)
 
 	// auth routes
 	mux.Get("/login", app.LoginPage)
 	mux.Post("/login", app.PostLoginPage)
-	mux.Get("/logout", app.Logout)
+	mux.Post("/logout", app.Logout)
 	mux.Get("/forgot-password", app.ForgotPassword)
 	mux.Get("/reset-password", app.ShowResetPassword)
 
@@ -90,6 +90,12 @@ func (app *application) ListenToWsChannel() {
 			response.UserID = e.UserID
 			app.broadcastToAll(response)
 
+		case "revokeTokens":
+			response.Action = "logout"
+			response.Message = "You have been logged out everywhere"
+			response.UserID = e.UserID
+			app.broadcastToAll(response)
+
 		default:
 		}
 	}
@@ -2,19 +2,63 @@ package cards
 
 import (
 	"errors"
+	"fmt"
 	"github.com/stripe/stripe-go/v75"
+	"github.com/stripe/stripe-go/v75/coupon"
 	"github.com/stripe/stripe-go/v75/customer"
+	"github.com/stripe/stripe-go/v75/invoice"
 	"github.com/stripe/stripe-go/v75/paymentintent"
 	"github.com/stripe/stripe-go/v75/paymentmethod"
+	"github.com/stripe/stripe-go/v75/price"
 	"github.com/stripe/stripe-go/v75/refund"
 	subscription2 "github.com/stripe/stripe-go/v75/subscription"
+	"time"
 )
 
-// Card holds the information needed by this package
+// PaymentGateway is the interface implemented by every payment provider the application can charge through
+type PaymentGateway interface {
+	CreatePaymentIntent(currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error)
+	RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error)
+	GetPaymentMethod(s string) (*stripe.PaymentMethod, error)
+	CreateCustomer(pm, email string) (*stripe.Customer, string, error)
+	SubscribeToPlan(cust *stripe.Customer, plan string, offer PlanOffer, email, last4, cardType string) (*stripe.Subscription, error)
+	Refund(pi string, amount int) (string, error)
+	CancelSubscriptions(subID string) error
+	CancelSubscriptionNow(subID string) error
+	ReactivateSubscription(subID string) error
+	PauseSubscription(subID string) error
+	ResumeSubscription(subID string) error
+	PreviewPlanChange(subID, plan string) (int, int64, error)
+	ChangePlan(subID, plan string, prorationDate int64) (int, error)
+	CreatePrice(name string, amount int, currency, interval string) (string, error)
+	CreateCoupon(amountOff int, currency string, months int) (string, error)
+}
+
+// PlanOffer is what a customer subscribes to a plan on besides its price: a free trial of TrialDays,
+// which WithoutCard starts before the customer has given a card, and the coupon taking the
+// introductory discount off the first cycles
+type PlanOffer struct {
+	TrialDays   int
+	WithoutCard bool
+	Coupon      string
+}
+
+// NewGateway returns the payment gateway matching name ("stripe" or "fake")
+func NewGateway(name, secret, key string) (PaymentGateway, error) {
+	switch name {
+	case "stripe":
+		return &Card{Secret: secret, Key: key}, nil
+	case "fake":
+		return NewFake(), nil
+	default:
+		return nil, fmt.Errorf("unknown payment gateway %q", name)
+	}
+}
+
+// Card is the Stripe implementation of PaymentGateway
 type Card struct {
-	Secret   string
-	Key      string
-	Currency string
+	Secret string
+	Key    string
 }
 
 // Transaction is the type to store information for a given transaction
@@ -26,24 +70,26 @@ type Transaction struct {
 	BankReturnCode      string
 }
 
-// Charge is an alias to CreatePaymentIntent
-func (c *Card) Charge(currency string, amount int) (*stripe.PaymentIntent, string, error) {
-	return c.CreatePaymentIntent(currency, amount)
+// backend returns the Stripe API backend used by the per-resource clients. Each client carries
+// its own key, so we never touch the global stripe.Key
+func (c *Card) backend() stripe.Backend {
+	return stripe.GetBackend(stripe.APIBackend)
 }
 
-// CreatePaymentIntent attempts to get a payment intent object from Stripe
-func (c *Card) CreatePaymentIntent(currency string, amount int) (*stripe.PaymentIntent, string, error) {
-	stripe.Key = c.Secret
-
+// CreatePaymentIntent attempts to get a payment intent object from Stripe, tagged with metadata
+func (c *Card) CreatePaymentIntent(currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error) {
 	// create a payment intent
 	params := &stripe.PaymentIntentParams{
 		Amount:   stripe.Int64(int64(amount)),
 		Currency: stripe.String(currency),
 	}
 
-	//params.AddMetadata("key", "value")
+	for key, value := range metadata {
+		params.AddMetadata(key, value)
+	}
 
-	pi, err := paymentintent.New(params)
+	pic := paymentintent.Client{B: c.backend(), Key: c.Secret}
+	pi, err := pic.New(params)
 	if err != nil {
 		msg := ""
 		var stripeErr *stripe.Error
@@ -57,9 +103,8 @@ func (c *Card) CreatePaymentIntent(currency string, amount int) (*stripe.Payment
 
 // GetPaymentMethod gets the payment method by payment intend id
 func (c *Card) GetPaymentMethod(s string) (*stripe.PaymentMethod, error) {
-	stripe.Key = c.Secret
-
-	pm, err := paymentmethod.Get(s, nil)
+	pmc := paymentmethod.Client{B: c.backend(), Key: c.Secret}
+	pm, err := pmc.Get(s, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -68,17 +113,17 @@ func (c *Card) GetPaymentMethod(s string) (*stripe.PaymentMethod, error) {
 
 // RetrievePaymentIntent gets an existing payment intent by id
 func (c *Card) RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error) {
-	stripe.Key = c.Secret
-
-	pi, err := paymentintent.Get(id, nil)
+	pic := paymentintent.Client{B: c.backend(), Key: c.Secret}
+	pi, err := pic.Get(id, nil)
 	if err != nil {
 		return nil, err
 	}
 	return pi, nil
 }
 
-// SubscribeToPlan subscribes a stripe customer to a stripe plan
-func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardType string) (*stripe.Subscription, error) {
+// SubscribeToPlan subscribes a stripe customer to a stripe plan on offer. A trial started without a
+// card cancels the subscription when it ends, unless the customer has added one by then
+func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan string, offer PlanOffer, email, last4, cardType string) (*stripe.Subscription, error) {
 	stripeCustomerID := cust.ID
 	items := []*stripe.SubscriptionItemsParams{
 		{Plan: stripe.String(plan)},
@@ -89,28 +134,45 @@ func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardTy
 		Items:    items,
 	}
 
+	if offer.TrialDays > 0 {
+		params.TrialPeriodDays = stripe.Int64(int64(offer.TrialDays))
+		if offer.WithoutCard {
+			params.TrialSettings = &stripe.SubscriptionTrialSettingsParams{
+				EndBehavior: &stripe.SubscriptionTrialSettingsEndBehaviorParams{
+					MissingPaymentMethod: stripe.String("cancel"),
+				},
+			}
+		}
+	}
+	if offer.Coupon != "" {
+		params.Coupon = stripe.String(offer.Coupon)
+	}
+
 	params.AddMetadata("last_four", last4)
 	params.AddMetadata("card_type", cardType)
 	params.AddExpand("latest_invoice.payment_intent")
-	subscription, err := subscription2.New(params)
+	sc := subscription2.Client{B: c.backend(), Key: c.Secret}
+	subscription, err := sc.New(params)
 	if err != nil {
 		return nil, err
 	}
 	return subscription, nil
 }
 
-// CreateCustomer creates a stripe customer
+// CreateCustomer creates a stripe customer, with pm as its default payment method unless pm is empty
 func (c *Card) CreateCustomer(pm, email string) (*stripe.Customer, string, error) {
-	stripe.Key = c.Secret
 	customerParams := &stripe.CustomerParams{
-		PaymentMethod: stripe.String(pm),
-		Email:         stripe.String(email),
-		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
+		Email: stripe.String(email),
+	}
+	if pm != "" {
+		customerParams.PaymentMethod = stripe.String(pm)
+		customerParams.InvoiceSettings = &stripe.CustomerInvoiceSettingsParams{
 			DefaultPaymentMethod: stripe.String(pm),
-		},
+		}
 	}
 
-	cust, err := customer.New(customerParams)
+	cc := customer.Client{B: c.backend(), Key: c.Secret}
+	cust, err := cc.New(customerParams)
 	if err != nil {
 		msg := ""
 		var stripeErr *stripe.Error
@@ -123,8 +185,7 @@ func (c *Card) CreateCustomer(pm, email string) (*stripe.Customer, string, error
 }
 
 // Refund refunds an amount for a paymentIntent
-func (c *Card) Refund(pi string, amount int) error {
-	stripe.Key = c.Secret
+func (c *Card) Refund(pi string, amount int) (string, error) {
 	amountToRefund := int64(amount)
 
 	refundParams := &stripe.RefundParams{
@@ -132,28 +193,201 @@ func (c *Card) Refund(pi string, amount int) error {
 		PaymentIntent: &pi,
 	}
 
-	_, err := refund.New(refundParams)
+	rc := refund.Client{B: c.backend(), Key: c.Secret}
+	r, err := rc.New(refundParams)
+	if err != nil {
+		return "", err
+	}
+
+	return r.ID, nil
+}
+
+// CancelSubscriptions cancels a subscription at the end of the current billing period
+func (c *Card) CancelSubscriptions(subID string) error {
+	params := &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: stripe.Bool(true),
+	}
+
+	sc := subscription2.Client{B: c.backend(), Key: c.Secret}
+	_, err := sc.Update(subID, params)
 	if err != nil {
 		return err
 	}
+	return nil
+}
 
+// CancelSubscriptionNow ends a subscription straight away, without waiting for the end of its
+// billing period
+func (c *Card) CancelSubscriptionNow(subID string) error {
+	sc := subscription2.Client{B: c.backend(), Key: c.Secret}
+	_, err := sc.Cancel(subID, &stripe.SubscriptionCancelParams{})
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
-func (c *Card) CancelSubscriptions(subID string) error {
-	stripe.Key = c.Secret
+// ReactivateSubscription keeps a subscription which was set to cancel at the end of the current
+// billing period
+func (c *Card) ReactivateSubscription(subID string) error {
+	params := &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: stripe.Bool(false),
+	}
+
+	sc := subscription2.Client{B: c.backend(), Key: c.Secret}
+	_, err := sc.Update(subID, params)
+	if err != nil {
+		return err
+	}
+	return nil
+}
 
+// PauseSubscription stops collecting payments for a subscription. Invoices made while it is paused
+// are voided, so the customer is not charged for them
+func (c *Card) PauseSubscription(subID string) error {
 	params := &stripe.SubscriptionParams{
-		CancelAtPeriodEnd: stripe.Bool(true),
+		PauseCollection: &stripe.SubscriptionPauseCollectionParams{
+			Behavior: stripe.String("void"),
+		},
+	}
+
+	sc := subscription2.Client{B: c.backend(), Key: c.Secret}
+	_, err := sc.Update(subID, params)
+	if err != nil {
+		return err
 	}
+	return nil
+}
 
-	_, err := subscription2.Update(subID, params)
+// ResumeSubscription starts collecting payments for a paused subscription again
+func (c *Card) ResumeSubscription(subID string) error {
+	params := &stripe.SubscriptionParams{}
+	// an empty value clears pause_collection
+	params.AddExtra("pause_collection", "")
+
+	sc := subscription2.Client{B: c.backend(), Key: c.Secret}
+	_, err := sc.Update(subID, params)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// planItem returns the subscription item holding a subscription's plan
+func (c *Card) planItem(subID string) (*stripe.Subscription, *stripe.SubscriptionItem, error) {
+	sc := subscription2.Client{B: c.backend(), Key: c.Secret}
+	sub, err := sc.Get(subID, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sub.Items == nil || len(sub.Items.Data) != 1 {
+		return nil, nil, fmt.Errorf("subscription %s does not have exactly one plan", subID)
+	}
+	return sub, sub.Items.Data[0], nil
+}
+
+// PreviewPlanChange returns the prorated amount a subscription would be charged, or credited if it
+// is negative, for moving to plan now, with the proration date it was worked out for. Passing that
+// date to ChangePlan charges exactly the previewed amount
+func (c *Card) PreviewPlanChange(subID, plan string) (int, int64, error) {
+	sub, item, err := c.planItem(subID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	prorationDate := time.Now().Unix()
+	params := &stripe.InvoiceUpcomingParams{
+		Customer:     stripe.String(sub.Customer.ID),
+		Subscription: stripe.String(subID),
+		SubscriptionItems: []*stripe.SubscriptionItemsParams{
+			{ID: stripe.String(item.ID), Price: stripe.String(plan)},
+		},
+		SubscriptionProrationDate: stripe.Int64(prorationDate),
+	}
+
+	ic := invoice.Client{B: c.backend(), Key: c.Secret}
+	upcoming, err := ic.Upcoming(params)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var amount int64
+	for _, line := range upcoming.Lines.Data {
+		if line.Proration {
+			amount += line.Amount
+		}
+	}
+	return int(amount), prorationDate, nil
+}
+
+// ChangePlan moves a subscription to plan, prorating the current billing period as of
+// prorationDate. The prorated amount is invoiced straight away, and returned
+func (c *Card) ChangePlan(subID, plan string, prorationDate int64) (int, error) {
+	_, item, err := c.planItem(subID)
+	if err != nil {
+		return 0, err
+	}
+
+	params := &stripe.SubscriptionParams{
+		Items: []*stripe.SubscriptionItemsParams{
+			{ID: stripe.String(item.ID), Price: stripe.String(plan)},
+		},
+		ProrationBehavior: stripe.String("always_invoice"),
+		ProrationDate:     stripe.Int64(prorationDate),
+	}
+	params.AddExpand("latest_invoice")
+
+	sc := subscription2.Client{B: c.backend(), Key: c.Secret}
+	sub, err := sc.Update(subID, params)
+	if err != nil {
+		return 0, err
+	}
+	if sub.LatestInvoice == nil {
+		return 0, nil
+	}
+	return int(sub.LatestInvoice.Total), nil
+}
+
+// CreatePrice creates a Stripe product with a recurring price, billed every interval ("month" or
+// "year"), and returns the id of the price to subscribe customers to
+func (c *Card) CreatePrice(name string, amount int, currency, interval string) (string, error) {
+	params := &stripe.PriceParams{
+		Currency:   stripe.String(currency),
+		UnitAmount: stripe.Int64(int64(amount)),
+		Recurring: &stripe.PriceRecurringParams{
+			Interval: stripe.String(interval),
+		},
+		ProductData: &stripe.PriceProductDataParams{
+			Name: stripe.String(name),
+		},
+	}
+
+	pc := price.Client{B: c.backend(), Key: c.Secret}
+	p, err := pc.New(params)
+	if err != nil {
+		return "", err
+	}
+	return p.ID, nil
+}
+
+// CreateCoupon creates a Stripe coupon taking amountOff off the invoices of a subscription for its
+// first months, and returns its id. For a yearly plan, that is 12 months for each discounted year
+func (c *Card) CreateCoupon(amountOff int, currency string, months int) (string, error) {
+	params := &stripe.CouponParams{
+		AmountOff:        stripe.Int64(int64(amountOff)),
+		Currency:         stripe.String(currency),
+		Duration:         stripe.String(string(stripe.CouponDurationRepeating)),
+		DurationInMonths: stripe.Int64(int64(months)),
+	}
+
+	cc := coupon.Client{B: c.backend(), Key: c.Secret}
+	cp, err := cc.New(params)
+	if err != nil {
+		return "", err
+	}
+	return cp.ID, nil
+}
+
 // cardErrorMessage returns human-readable versions of card error messages
 func cardErrorMessage(code stripe.ErrorCode) string {
 	var msg = ""
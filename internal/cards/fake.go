@@ -0,0 +1,360 @@
+package cards
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v75"
+)
+
+// Fake is an in-memory PaymentGateway. It never talks to Stripe, so the API's payment,
+// subscription and refund flows can be exercised locally and in tests. State lives in one process
+// and the web checkout pages still confirm cards with Stripe.js, so the fake is for the API and
+// tests only; it cannot drive a browser checkout
+type Fake struct {
+	mu             sync.Mutex
+	seq            int
+	paymentIntents map[string]*stripe.PaymentIntent
+	paymentMethods map[string]*stripe.PaymentMethod
+	customers      map[string]*stripe.Customer
+	subscriptions  map[string]*stripe.Subscription
+	prices         map[string]int64
+	coupons        map[string]*stripe.Coupon
+	refunded       map[string]int64
+}
+
+// NewFake returns an empty fake payment gateway
+func NewFake() *Fake {
+	return &Fake{
+		paymentIntents: make(map[string]*stripe.PaymentIntent),
+		paymentMethods: make(map[string]*stripe.PaymentMethod),
+		customers:      make(map[string]*stripe.Customer),
+		subscriptions:  make(map[string]*stripe.Subscription),
+		prices:         make(map[string]int64),
+		coupons:        make(map[string]*stripe.Coupon),
+		refunded:       make(map[string]int64),
+	}
+}
+
+// nextID returns a new unique id with the given prefix; callers must hold f.mu
+func (f *Fake) nextID(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("%s_fake_%d", prefix, f.seq)
+}
+
+// CreatePaymentIntent creates a payment intent which is immediately marked as succeeded
+func (f *Fake) CreatePaymentIntent(currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if amount <= 0 {
+		return nil, cardErrorMessage(stripe.ErrorCodeAmountTooSmall), errors.New("amount must be greater than zero")
+	}
+
+	id := f.nextID("pi")
+	pi := &stripe.PaymentIntent{
+		ID:           id,
+		Amount:       int64(amount),
+		Currency:     stripe.Currency(currency),
+		ClientSecret: fmt.Sprintf("%s_secret", id),
+		Status:       stripe.PaymentIntentStatusSucceeded,
+		Created:      time.Now().Unix(),
+		LatestCharge: &stripe.Charge{ID: f.nextID("ch")},
+		Metadata:     metadata,
+	}
+	f.paymentIntents[id] = pi
+
+	return pi, "", nil
+}
+
+// RetrievePaymentIntent gets an existing payment intent by id
+func (f *Fake) RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pi, ok := f.paymentIntents[id]
+	if !ok {
+		return nil, fmt.Errorf("no such payment intent: %s", id)
+	}
+	return pi, nil
+}
+
+// GetPaymentMethod returns a test card for any payment method id
+func (f *Fake) GetPaymentMethod(s string) (*stripe.PaymentMethod, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pm, ok := f.paymentMethods[s]
+	if !ok {
+		pm = &stripe.PaymentMethod{
+			ID:   s,
+			Type: stripe.PaymentMethodTypeCard,
+			Card: &stripe.PaymentMethodCard{
+				Brand:    stripe.PaymentMethodCardBrandVisa,
+				Last4:    "4242",
+				ExpMonth: 12,
+				ExpYear:  int64(time.Now().Year() + 1),
+			},
+		}
+		f.paymentMethods[s] = pm
+	}
+	return pm, nil
+}
+
+// CreateCustomer creates a customer with pm as its default payment method, unless pm is empty
+func (f *Fake) CreateCustomer(pm, email string) (*stripe.Customer, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cust := &stripe.Customer{
+		ID:    f.nextID("cus"),
+		Email: email,
+	}
+	if pm != "" {
+		cust.InvoiceSettings = &stripe.CustomerInvoiceSettings{
+			DefaultPaymentMethod: &stripe.PaymentMethod{ID: pm},
+		}
+	}
+	f.customers[cust.ID] = cust
+
+	return cust, "", nil
+}
+
+// SubscribeToPlan subscribes a customer to a plan on offer. A subscription with a trial is
+// trialing, and its first period is the trial
+func (f *Fake) SubscribeToPlan(cust *stripe.Customer, plan string, offer PlanOffer, email, last4, cardType string) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stored, ok := f.customers[cust.ID]
+	if !ok {
+		return nil, fmt.Errorf("no such customer: %s", cust.ID)
+	}
+	if stored.InvoiceSettings == nil && !(offer.WithoutCard && offer.TrialDays > 0) {
+		return nil, fmt.Errorf("customer %s has no payment method", cust.ID)
+	}
+
+	now := time.Now()
+	periodEnd := now.AddDate(0, 1, 0)
+	status := stripe.SubscriptionStatusActive
+	var trialEnd int64
+	if offer.TrialDays > 0 {
+		periodEnd = now.AddDate(0, 0, offer.TrialDays)
+		status = stripe.SubscriptionStatusTrialing
+		trialEnd = periodEnd.Unix()
+	}
+
+	var discount *stripe.Discount
+	if offer.Coupon != "" {
+		cp, ok := f.coupons[offer.Coupon]
+		if !ok {
+			return nil, fmt.Errorf("no such coupon: %s", offer.Coupon)
+		}
+		discount = &stripe.Discount{Coupon: cp}
+	}
+
+	sub := &stripe.Subscription{
+		ID:                 f.nextID("sub"),
+		Customer:           cust,
+		Status:             status,
+		CurrentPeriodStart: now.Unix(),
+		CurrentPeriodEnd:   periodEnd.Unix(),
+		TrialEnd:           trialEnd,
+		Discount:           discount,
+		Metadata: map[string]string{
+			"last_four": last4,
+			"card_type": cardType,
+		},
+		Items: &stripe.SubscriptionItemList{
+			Data: []*stripe.SubscriptionItem{
+				{ID: f.nextID("si"), Plan: &stripe.Plan{ID: plan, Amount: f.prices[plan]}},
+			},
+		},
+	}
+	f.subscriptions[sub.ID] = sub
+
+	return sub, nil
+}
+
+// Refund refunds an amount for a paymentIntent, refusing to refund more than was charged
+func (f *Fake) Refund(pi string, amount int) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	intent, ok := f.paymentIntents[pi]
+	if !ok {
+		return "", fmt.Errorf("no such payment intent: %s", pi)
+	}
+
+	if f.refunded[pi]+int64(amount) > intent.Amount {
+		return "", errors.New("refund amount is greater than the unrefunded amount of the charge")
+	}
+	f.refunded[pi] += int64(amount)
+
+	return f.nextID("re"), nil
+}
+
+// CancelSubscriptions flags a subscription to cancel at the end of the current period
+func (f *Fake) CancelSubscriptions(subID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, err := f.subscription(subID)
+	if err != nil {
+		return err
+	}
+	sub.CancelAtPeriodEnd = true
+
+	return nil
+}
+
+// CancelSubscriptionNow ends a subscription straight away
+func (f *Fake) CancelSubscriptionNow(subID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, err := f.subscription(subID)
+	if err != nil {
+		return err
+	}
+	sub.Status = stripe.SubscriptionStatusCanceled
+	sub.CanceledAt = time.Now().Unix()
+
+	return nil
+}
+
+// subscription returns a subscription by id; callers must hold f.mu
+func (f *Fake) subscription(subID string) (*stripe.Subscription, error) {
+	sub, ok := f.subscriptions[subID]
+	if !ok {
+		return nil, fmt.Errorf("no such subscription: %s", subID)
+	}
+	return sub, nil
+}
+
+// ReactivateSubscription clears a subscription's cancellation at period end
+func (f *Fake) ReactivateSubscription(subID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, err := f.subscription(subID)
+	if err != nil {
+		return err
+	}
+	sub.CancelAtPeriodEnd = false
+
+	return nil
+}
+
+// PauseSubscription pauses payment collection for a subscription
+func (f *Fake) PauseSubscription(subID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, err := f.subscription(subID)
+	if err != nil {
+		return err
+	}
+	sub.PauseCollection = &stripe.SubscriptionPauseCollection{
+		Behavior: stripe.SubscriptionPauseCollectionBehaviorVoid,
+	}
+
+	return nil
+}
+
+// ResumeSubscription resumes payment collection for a paused subscription
+func (f *Fake) ResumeSubscription(subID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, err := f.subscription(subID)
+	if err != nil {
+		return err
+	}
+	sub.PauseCollection = nil
+
+	return nil
+}
+
+// prorate returns the difference between two prices for what is left of the period from start to
+// end at time at
+func prorate(oldAmount, newAmount, start, end, at int64) int64 {
+	if end <= start || at >= end {
+		return 0
+	}
+	if at < start {
+		at = start
+	}
+	return (newAmount - oldAmount) * (end - at) / (end - start)
+}
+
+// PreviewPlanChange returns the prorated amount for moving a subscription to plan now. Prices the
+// fake did not create are treated as free
+func (f *Fake) PreviewPlanChange(subID, plan string) (int, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, err := f.subscription(subID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	prorationDate := time.Now().Unix()
+	current := sub.Items.Data[0].Plan
+	amount := prorate(current.Amount, f.prices[plan], sub.CurrentPeriodStart, sub.CurrentPeriodEnd, prorationDate)
+
+	return int(amount), prorationDate, nil
+}
+
+// ChangePlan moves a subscription to plan, and returns the prorated amount as of prorationDate
+func (f *Fake) ChangePlan(subID, plan string, prorationDate int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, err := f.subscription(subID)
+	if err != nil {
+		return 0, err
+	}
+
+	current := sub.Items.Data[0].Plan
+	amount := prorate(current.Amount, f.prices[plan], sub.CurrentPeriodStart, sub.CurrentPeriodEnd, prorationDate)
+	sub.Items.Data[0].Plan = &stripe.Plan{ID: plan, Amount: f.prices[plan]}
+
+	return int(amount), nil
+}
+
+// CreatePrice returns the id of a new recurring price
+func (f *Fake) CreatePrice(name string, amount int, currency, interval string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if amount <= 0 {
+		return "", errors.New("amount must be greater than zero")
+	}
+	id := f.nextID("price")
+	f.prices[id] = int64(amount)
+
+	return id, nil
+}
+
+// CreateCoupon returns the id of a new coupon taking amountOff off the invoices of the first months
+func (f *Fake) CreateCoupon(amountOff int, currency string, months int) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if amountOff <= 0 || months <= 0 {
+		return "", errors.New("amount off and months must be greater than zero")
+	}
+	cp := &stripe.Coupon{
+		ID:               f.nextID("coupon"),
+		AmountOff:        int64(amountOff),
+		Currency:         stripe.Currency(currency),
+		Duration:         stripe.CouponDurationRepeating,
+		DurationInMonths: int64(months),
+	}
+	f.coupons[cp.ID] = cp
+
+	return cp.ID, nil
+}
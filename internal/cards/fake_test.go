@@ -0,0 +1,303 @@
+package cards
+
+import (
+	"testing"
+
+	"github.com/stripe/stripe-go/v75"
+)
+
+func TestFake_CreateAndRetrievePaymentIntent(t *testing.T) {
+	f := NewFake()
+
+	pi, msg, err := f.CreatePaymentIntent("usd", 1000, map[string]string{"items": "1x1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s (%s)", err, msg)
+	}
+	if pi.Status != stripe.PaymentIntentStatusSucceeded {
+		t.Errorf("expected status succeeded, got %s", pi.Status)
+	}
+	if pi.LatestCharge == nil {
+		t.Error("expected a latest charge")
+	}
+
+	got, err := f.RetrievePaymentIntent(pi.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Amount != 1000 || got.Currency != "usd" {
+		t.Errorf("expected 1000 usd, got %d %s", got.Amount, got.Currency)
+	}
+	if got.Metadata["items"] != "1x1" {
+		t.Errorf("expected metadata items 1x1, got %q", got.Metadata["items"])
+	}
+
+	_, err = f.RetrievePaymentIntent("pi_missing")
+	if err == nil {
+		t.Error("expected an error retrieving an unknown payment intent")
+	}
+
+	_, _, err = f.CreatePaymentIntent("usd", 0, nil)
+	if err == nil {
+		t.Error("expected an error creating a zero amount payment intent")
+	}
+}
+
+func TestFake_Refund(t *testing.T) {
+	f := NewFake()
+
+	pi, _, err := f.CreatePaymentIntent("usd", 1000, map[string]string{"items": "1x1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name    string
+		amount  int
+		wantErr bool
+	}{
+		{"partial refund", 400, false},
+		{"second partial refund", 600, false},
+		{"over refund", 1, true},
+	}
+
+	seen := make(map[string]bool)
+	for _, e := range tests {
+		id, err := f.Refund(pi.ID, e.amount)
+		if e.wantErr && err == nil {
+			t.Errorf("%s: expected an error but did not get one", e.name)
+		}
+		if !e.wantErr && err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		}
+		if !e.wantErr && (id == "" || seen[id]) {
+			t.Errorf("%s: expected a new refund id, got %q", e.name, id)
+		}
+		seen[id] = true
+	}
+
+	_, err = f.Refund("pi_missing", 100)
+	if err == nil {
+		t.Error("expected an error refunding an unknown payment intent")
+	}
+}
+
+func TestFake_CancelSubscriptions(t *testing.T) {
+	f := NewFake()
+
+	cust, _, err := f.CreateCustomer("pm_card_visa", "me@here.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := f.SubscribeToPlan(cust, "price_bronze", PlanOffer{}, "me@here.com", "4242", "visa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.CancelAtPeriodEnd {
+		t.Fatal("new subscription should not be cancelling")
+	}
+
+	err = f.CancelSubscriptions(sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sub.CancelAtPeriodEnd {
+		t.Error("expected subscription to cancel at period end")
+	}
+	if sub.Status != stripe.SubscriptionStatusActive {
+		t.Errorf("expected subscription to stay active until period end, got %s", sub.Status)
+	}
+
+	err = f.CancelSubscriptions("sub_missing")
+	if err == nil {
+		t.Error("expected an error cancelling an unknown subscription")
+	}
+
+	err = f.ReactivateSubscription(sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.CancelAtPeriodEnd {
+		t.Error("expected reactivated subscription not to cancel")
+	}
+
+	err = f.CancelSubscriptionNow(sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Status != stripe.SubscriptionStatusCanceled {
+		t.Errorf("expected subscription to be cancelled straight away, got %s", sub.Status)
+	}
+}
+
+func TestFake_PauseSubscription(t *testing.T) {
+	f := NewFake()
+
+	cust, _, err := f.CreateCustomer("pm_card_visa", "me@here.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := f.SubscribeToPlan(cust, "price_bronze", PlanOffer{}, "me@here.com", "4242", "visa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.PauseSubscription(sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.PauseCollection == nil {
+		t.Error("expected payment collection to be paused")
+	}
+
+	err = f.ResumeSubscription(sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.PauseCollection != nil {
+		t.Error("expected payment collection to be resumed")
+	}
+
+	err = f.PauseSubscription("sub_missing")
+	if err == nil {
+		t.Error("expected an error pausing an unknown subscription")
+	}
+}
+
+func TestFake_ChangePlan(t *testing.T) {
+	f := NewFake()
+
+	bronze, err := f.CreatePrice("Bronze Plan", 1000, "usd", "month")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gold, err := f.CreatePrice("Gold Plan", 3000, "usd", "month")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cust, _, err := f.CreateCustomer("pm_card_visa", "me@here.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := f.SubscribeToPlan(cust, bronze, PlanOffer{}, "me@here.com", "4242", "visa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upgrade, prorationDate, err := f.PreviewPlanChange(sub.ID, gold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upgrade <= 0 || upgrade > 2000 {
+		t.Errorf("expected an upgrade to charge up to 2000, got %d", upgrade)
+	}
+
+	charged, err := f.ChangePlan(sub.ID, gold, prorationDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if charged != upgrade {
+		t.Errorf("expected to be charged the previewed %d, got %d", upgrade, charged)
+	}
+	if sub.Items.Data[0].Plan.ID != gold {
+		t.Errorf("expected plan %s, got %s", gold, sub.Items.Data[0].Plan.ID)
+	}
+
+	downgrade, _, err := f.PreviewPlanChange(sub.ID, bronze)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if downgrade >= 0 {
+		t.Errorf("expected a downgrade to credit the customer, got %d", downgrade)
+	}
+}
+
+func Test_prorate(t *testing.T) {
+	var tests = []struct {
+		name string
+		at   int64
+		want int64
+	}{
+		{"start of period", 0, 2000},
+		{"half way", 50, 1000},
+		{"end of period", 100, 0},
+		{"after period", 150, 0},
+	}
+
+	for _, e := range tests {
+		if got := prorate(1000, 3000, 0, 100, e.at); got != e.want {
+			t.Errorf("%s: expected %d, got %d", e.name, e.want, got)
+		}
+	}
+}
+
+func TestFake_CreatePrice(t *testing.T) {
+	f := NewFake()
+
+	first, err := f.CreatePrice("Silver Plan", 2000, "usd", "month")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := f.CreatePrice("Gold Plan", 3000, "usd", "month")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == "" || first == second {
+		t.Errorf("expected distinct price ids, got %q and %q", first, second)
+	}
+
+	_, err = f.CreatePrice("Free Plan", 0, "usd", "month")
+	if err == nil {
+		t.Error("expected an error creating a zero amount price")
+	}
+}
+
+func TestFake_SubscribeWithOffer(t *testing.T) {
+	f := NewFake()
+
+	coupon, err := f.CreateCoupon(500, "usd", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withCard, _, err := f.CreateCustomer("pm_card_visa", "me@here.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutCard, _, err := f.CreateCustomer("", "you@here.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := f.SubscribeToPlan(withCard, "price_bronze", PlanOffer{TrialDays: 14, Coupon: coupon}, "me@here.com", "4242", "visa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Status != stripe.SubscriptionStatusTrialing {
+		t.Errorf("expected subscription to be trialing, got %s", sub.Status)
+	}
+	if sub.TrialEnd != sub.CurrentPeriodEnd || sub.TrialEnd-sub.CurrentPeriodStart != 14*24*60*60 {
+		t.Errorf("expected a 14 day trial, got %d to %d", sub.CurrentPeriodStart, sub.TrialEnd)
+	}
+	if sub.Discount == nil || sub.Discount.Coupon.ID != coupon {
+		t.Errorf("expected coupon %s to be applied", coupon)
+	}
+
+	_, err = f.SubscribeToPlan(withoutCard, "price_bronze", PlanOffer{}, "you@here.com", "", "")
+	if err == nil {
+		t.Error("expected an error subscribing without a card or trial")
+	}
+
+	_, err = f.SubscribeToPlan(withoutCard, "price_bronze", PlanOffer{TrialDays: 7, WithoutCard: true}, "you@here.com", "", "")
+	if err != nil {
+		t.Errorf("expected a trial without a card, got %s", err)
+	}
+
+	_, err = f.SubscribeToPlan(withCard, "price_bronze", PlanOffer{Coupon: "coupon_missing"}, "me@here.com", "4242", "visa")
+	if err == nil {
+		t.Error("expected an error subscribing with an unknown coupon")
+	}
+}
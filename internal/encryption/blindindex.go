@@ -0,0 +1,32 @@
+package encryption
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+// MinIndexKeySize is the shortest key BlindIndex accepts
+const MinIndexKeySize = 32
+
+// ParseIndexKey decodes a base64 blind index key
+func ParseIndexKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("index key is not valid base64")
+	}
+	if len(key) < MinIndexKeySize {
+		return nil, errors.New("index key must be at least 32 bytes")
+	}
+	return key, nil
+}
+
+// BlindIndex returns a keyed hash of value, so an encrypted column can be searched for an exact
+// value without decrypting it. Unlike the keyring, the index key can never be rotated without
+// rebuilding every index, and equal values always give equal hashes
+func BlindIndex(key []byte, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
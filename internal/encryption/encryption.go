@@ -5,44 +5,188 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"regexp"
+	"strings"
 )
 
-type Encryption struct {
-	Key []byte
+var (
+	// ErrMalformed is returned for ciphertexts which are not in the format Encrypt produces
+	ErrMalformed = errors.New("malformed ciphertext")
+	// ErrUnknownKey is returned for ciphertexts encrypted with a key that is not in the keyring
+	ErrUnknownKey = errors.New("ciphertext uses an unknown key")
+	// ErrDecrypt is returned when a ciphertext fails authentication; it was changed, or encrypted
+	// with a different key of the same id
+	ErrDecrypt = errors.New("ciphertext could not be decrypted")
+)
+
+// keyIDRX is the format of key ids
+var keyIDRX = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,20}$`)
+
+// Keyring encrypts with AES-GCM. Every ciphertext starts with the id of the key that made it, as
+// "<key id>:<base64>", so old keys can stay in the ring to decrypt existing data while new data is
+// encrypted with the active key
+type Keyring struct {
+	active string
+	aeads  map[string]cipher.AEAD
+	legacy []byte
 }
 
-func (e *Encryption) Encrypt(text string) (string, error) {
-	plaintext := []byte(text)
+// New returns a Keyring from a list of keys, formatted as "id:base64key,id:base64key". Keys must be
+// 16, 24 or 32 bytes. The first key is the active one; to rotate, put a new key first and keep the
+// old ones after it until ReEncrypt has moved all stored data to the new key
+func New(keys string) (*Keyring, error) {
+	k := &Keyring{
+		aeads: make(map[string]cipher.AEAD),
+	}
 
-	block, err := aes.NewCipher(e.Key)
-	if err != nil {
+	for _, entry := range strings.Split(keys, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || !keyIDRX.MatchString(id) {
+			return nil, fmt.Errorf("encryption key %q must be formatted as id:base64key", id)
+		}
+		if _, exists := k.aeads[id]; exists {
+			return nil, fmt.Errorf("encryption key %q is listed twice", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %q is not valid base64: %w", id, err)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %q: %w", id, err)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		k.aeads[id] = aead
+		if k.active == "" {
+			k.active = id
+		}
+	}
+
+	if k.active == "" {
+		return nil, errors.New("no encryption keys given")
+	}
+	return k, nil
+}
+
+// WithLegacyKey lets ReEncrypt read ciphertexts made by the old unauthenticated AES-CFB encryption
+// with key. Decrypt never accepts them
+func (k *Keyring) WithLegacyKey(key []byte) *Keyring {
+	k.legacy = key
+	return k
+}
+
+// ActiveKey returns the id of the key new data is encrypted with
+func (k *Keyring) ActiveKey() string {
+	return k.active
+}
+
+// Encrypt encrypts text with the active key
+func (k *Keyring) Encrypt(text string) (string, error) {
+	aead := k.aeads[k.active]
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(text)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return "", err
 	}
 
-	cipherText := make([]byte, aes.BlockSize+len(plaintext))
-	iv := cipherText[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	// the key id is authenticated too, so a ciphertext cannot be relabelled with another key
+	sealed := aead.Seal(nonce, nonce, []byte(text), []byte(k.active))
+
+	return k.active + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a ciphertext made by Encrypt, with whichever key in the ring made it
+func (k *Keyring) Decrypt(cryptoText string) (string, error) {
+	id, err := KeyID(cryptoText)
+	if err != nil {
 		return "", err
 	}
 
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(cipherText[aes.BlockSize:], plaintext)
+	aead, ok := k.aeads[id]
+	if !ok {
+		return "", ErrUnknownKey
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(cryptoText[len(id)+1:])
+	if err != nil {
+		return "", ErrMalformed
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return "", ErrMalformed
+	}
+
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plainText, err := aead.Open(nil, nonce, sealed, []byte(id))
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(plainText), nil
+}
 
-	return base64.URLEncoding.EncodeToString(cipherText), nil
+// KeyID returns the id of the key a ciphertext was encrypted with
+func KeyID(cryptoText string) (string, error) {
+	id, _, ok := strings.Cut(cryptoText, ":")
+	if !ok || !keyIDRX.MatchString(id) {
+		return "", ErrMalformed
+	}
+	return id, nil
 }
 
-func (e *Encryption) Decrypt(cryptoText string) (string, error) {
-	cipherText, _ := base64.URLEncoding.DecodeString(cryptoText)
+// ReEncrypt decrypts a stored ciphertext and encrypts it again with the active key. It reports
+// false, and returns cryptoText unchanged, if it already uses the active key
+func (k *Keyring) ReEncrypt(cryptoText string) (string, bool, error) {
+	var plainText string
 
-	block, err := aes.NewCipher(e.Key)
+	id, err := KeyID(cryptoText)
+	switch {
+	case err == nil && id == k.active:
+		return cryptoText, false, nil
+	case err == nil:
+		plainText, err = k.Decrypt(cryptoText)
+	case k.legacy != nil:
+		plainText, err = decryptLegacy(k.legacy, cryptoText)
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	reEncrypted, err := k.Encrypt(plainText)
+	if err != nil {
+		return "", false, err
+	}
+	return reEncrypted, true, nil
+}
+
+// decryptLegacy decrypts a ciphertext made by the old AES-CFB encryption, which was the base64 of
+// the iv followed by the encrypted text
+func decryptLegacy(key []byte, cryptoText string) (string, error) {
+	cipherText, err := base64.URLEncoding.DecodeString(cryptoText)
+	if err != nil {
+		return "", ErrMalformed
+	}
+
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", err
 	}
 
 	if len(cipherText) < aes.BlockSize {
-		return "", err
+		return "", ErrMalformed
 	}
 
 	iv := cipherText[:aes.BlockSize]
@@ -51,5 +195,5 @@ func (e *Encryption) Decrypt(cryptoText string) (string, error) {
 	stream := cipher.NewCFBDecrypter(block, iv)
 	stream.XORKeyStream(cipherText, cipherText)
 
-	return fmt.Sprintf("%s", cipherText), nil
+	return string(cipherText), nil
 }
@@ -0,0 +1,185 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const (
+	oldKey = "old:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	newKey = "new:ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+)
+
+func TestNew(t *testing.T) {
+	var tests = []struct {
+		name    string
+		keys    string
+		wantErr bool
+	}{
+		{"one key", oldKey, false},
+		{"two keys", newKey + "," + oldKey, false},
+		{"no keys", "", true},
+		{"no id", "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=", true},
+		{"bad base64", "k:not base64", true},
+		{"bad length", "k:c2hvcnQ=", true},
+		{"duplicate id", oldKey + "," + oldKey, true},
+	}
+
+	for _, e := range tests {
+		_, err := New(e.keys)
+		if e.wantErr && err == nil {
+			t.Errorf("%s: expected an error but did not get one", e.name)
+		}
+		if !e.wantErr && err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		}
+	}
+}
+
+func TestKeyring_EncryptDecrypt(t *testing.T) {
+	k, err := New(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cipherText, err := k.Encrypt("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(cipherText, "old:") {
+		t.Errorf("expected the key id prefix, got %s", cipherText)
+	}
+
+	again, _ := k.Encrypt("JBSWY3DPEHPK3PXP")
+	if again == cipherText {
+		t.Error("expected a fresh nonce for every encryption")
+	}
+
+	plainText, err := k.Decrypt(cipherText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plainText != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("expected the plain text back, got %q", plainText)
+	}
+
+	// flip a character of the body; authentication must fail
+	tampered := []byte(cipherText)
+	tampered[len(tampered)-2] ^= 1
+	_, err = k.Decrypt(string(tampered))
+	if !errors.Is(err, ErrDecrypt) && !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected a tampered ciphertext to fail, got %v", err)
+	}
+
+	var bad = []struct {
+		name string
+		text string
+		want error
+	}{
+		{"no key id", "abc", ErrMalformed},
+		{"bad base64", "old:!!!", ErrMalformed},
+		{"too short", "old:AAAA", ErrMalformed},
+		{"unknown key", "gone:AAAA", ErrUnknownKey},
+		{"relabelled", "new:" + strings.TrimPrefix(cipherText, "old:"), ErrUnknownKey},
+	}
+
+	for _, e := range bad {
+		_, err := k.Decrypt(e.text)
+		if !errors.Is(err, e.want) {
+			t.Errorf("%s: expected %v, got %v", e.name, e.want, err)
+		}
+	}
+}
+
+func TestKeyring_Rotation(t *testing.T) {
+	before, err := New(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := before.Encrypt("secret")
+
+	after, err := New(newKey + "," + oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.ActiveKey() != "new" {
+		t.Errorf("expected the first key to be active, got %s", after.ActiveKey())
+	}
+
+	plainText, err := after.Decrypt(stored)
+	if err != nil || plainText != "secret" {
+		t.Fatalf("expected old data to still decrypt, got %q %v", plainText, err)
+	}
+
+	rotated, changed, err := after.ReEncrypt(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || !strings.HasPrefix(rotated, "new:") {
+		t.Errorf("expected data to move to the new key, got %s", rotated)
+	}
+
+	same, changed, err := after.ReEncrypt(rotated)
+	if err != nil || changed || same != rotated {
+		t.Errorf("expected data on the active key to be left alone, got %s %v %v", same, changed, err)
+	}
+}
+
+func TestKeyring_ReEncryptLegacy(t *testing.T) {
+	legacyKey := []byte("qdYaJw3sIhTVH5opBEr0PNoIXLWr5QqC")
+
+	// encrypt the way the old package did
+	block, _ := aes.NewCipher(legacyKey)
+	legacy := make([]byte, aes.BlockSize+len("secret"))
+	cipher.NewCFBEncrypter(block, legacy[:aes.BlockSize]).XORKeyStream(legacy[aes.BlockSize:], []byte("secret"))
+	stored := base64.URLEncoding.EncodeToString(legacy)
+
+	k, _ := New(newKey)
+	_, _, err := k.ReEncrypt(stored)
+	if err == nil {
+		t.Error("expected legacy data to be refused without the legacy key")
+	}
+	_, err = k.Decrypt(stored)
+	if err == nil {
+		t.Error("expected Decrypt to refuse legacy data")
+	}
+
+	rotated, changed, err := k.WithLegacyKey(legacyKey).ReEncrypt(stored)
+	if err != nil || !changed {
+		t.Fatalf("expected legacy data to be re-encrypted, got %v %v", changed, err)
+	}
+	plainText, err := k.Decrypt(rotated)
+	if err != nil || plainText != "secret" {
+		t.Errorf("expected the legacy plain text back, got %q %v", plainText, err)
+	}
+}
+
+func TestBlindIndex(t *testing.T) {
+	key, err := ParseIndexKey("d2lkZ2V0cy1kZXYtYmxpbmQtaW5kZXgta2V5LTAwMDE=")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := BlindIndex(key, "me@here.com")
+	if len(a) != 32 {
+		t.Errorf("expected a 32 byte index, got %d", len(a))
+	}
+	if string(a) != string(BlindIndex(key, "me@here.com")) {
+		t.Error("expected equal values to give equal indexes")
+	}
+	if string(a) == string(BlindIndex(key, "you@here.com")) {
+		t.Error("expected different values to give different indexes")
+	}
+	if string(a) == string(BlindIndex([]byte("another key which is 32 bytes!!!"), "me@here.com")) {
+		t.Error("expected the index to depend on the key")
+	}
+
+	_, err = ParseIndexKey("c2hvcnQ=")
+	if err == nil {
+		t.Error("expected an error for a short index key")
+	}
+}
@@ -0,0 +1,161 @@
+package images
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+const (
+	// MaxUploadSize is the largest image file accepted, in bytes
+	MaxUploadSize = 5 << 20
+	// MaxDimension is the largest width or height accepted, in pixels
+	MaxDimension = 5000
+	// ThumbnailSize is the largest width or height of a thumbnail, in pixels
+	ThumbnailSize = 300
+)
+
+// errors returned by Process; their text reads as a validation message for the upload
+var (
+	ErrTooLarge        = fmt.Errorf("must be no larger than %d MB", MaxUploadSize>>20)
+	ErrUnsupportedType = errors.New("must be a jpeg, png or gif image")
+	ErrTooManyPixels   = fmt.Errorf("must be no more than %d pixels wide or high", MaxDimension)
+)
+
+// Image is a validated upload, with its thumbnail
+type Image struct {
+	Data          []byte
+	ContentType   string
+	Ext           string
+	Width         int
+	Height        int
+	Thumbnail     []byte
+	ThumbnailType string
+	ThumbnailExt  string
+}
+
+// Key returns the storage key for the image under prefix. Keys are made from a hash of the file,
+// so a key always holds the same image and its url can be cached for good
+func (i *Image) Key(prefix string) string {
+	return fmt.Sprintf("%s/%s.%s", prefix, i.hash(), i.Ext)
+}
+
+// ThumbnailKey returns the storage key for the thumbnail under prefix
+func (i *Image) ThumbnailKey(prefix string) string {
+	return fmt.Sprintf("%s/%s-thumb.%s", prefix, i.hash(), i.ThumbnailExt)
+}
+
+func (i *Image) hash() string {
+	sum := sha256.Sum256(i.Data)
+	return hex.EncodeToString(sum[:10])
+}
+
+// Process checks that data is a jpeg, png or gif image of an acceptable size, and makes its
+// thumbnail. The type is sniffed from the data, never taken from the file name. Jpeg thumbnails
+// stay jpeg; png and gif thumbnails are png, so transparency is kept
+func Process(data []byte) (*Image, error) {
+	if len(data) > MaxUploadSize {
+		return nil, ErrTooLarge
+	}
+
+	img := &Image{Data: data}
+
+	img.ContentType = http.DetectContentType(data)
+	switch img.ContentType {
+	case "image/jpeg":
+		img.Ext = "jpg"
+	case "image/png":
+		img.Ext = "png"
+	case "image/gif":
+		img.Ext = "gif"
+	default:
+		return nil, ErrUnsupportedType
+	}
+
+	// check the size before decoding, so a small file cannot make us allocate a huge image
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedType
+	}
+	if cfg.Width > MaxDimension || cfg.Height > MaxDimension {
+		return nil, ErrTooManyPixels
+	}
+	img.Width, img.Height = cfg.Width, cfg.Height
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedType
+	}
+
+	thumb := Thumbnail(src, ThumbnailSize)
+
+	var buf bytes.Buffer
+	if img.ContentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+		img.ThumbnailType, img.ThumbnailExt = "image/jpeg", "jpg"
+	} else {
+		err = png.Encode(&buf, thumb)
+		img.ThumbnailType, img.ThumbnailExt = "image/png", "png"
+	}
+	if err != nil {
+		return nil, err
+	}
+	img.Thumbnail = buf.Bytes()
+
+	return img, nil
+}
+
+// Thumbnail scales src down to fit in a size by size square, keeping its aspect ratio. Each
+// thumbnail pixel is the average of the source pixels it covers. Images which already fit are
+// returned unchanged
+func Thumbnail(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+
+	tw, th := size, size
+	if w > h {
+		th = max(1, h*size/w)
+	} else {
+		tw = max(1, w*size/h)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+(y+1)*h/th
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+(x+1)*w/tw
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,92 @@
+package images
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func pngOf(t *testing.T, w, h int) []byte {
+	t.Helper()
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.NRGBA{R: 200, G: 100, B: 50, A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcess(t *testing.T) {
+	img, err := Process(pngOf(t, 600, 300))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if img.ContentType != "image/png" || img.Ext != "png" {
+		t.Errorf("expected a png, got %s %s", img.ContentType, img.Ext)
+	}
+	if img.Width != 600 || img.Height != 300 {
+		t.Errorf("expected 600x300, got %dx%d", img.Width, img.Height)
+	}
+
+	thumb, err := png.Decode(bytes.NewReader(img.Thumbnail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumb.Bounds().Dx() != ThumbnailSize || thumb.Bounds().Dy() != ThumbnailSize/2 {
+		t.Errorf("expected a %dx%d thumbnail, got %v", ThumbnailSize, ThumbnailSize/2, thumb.Bounds())
+	}
+
+	r, g, b, _ := thumb.At(10, 10).RGBA()
+	if r>>8 != 200 || g>>8 != 100 || b>>8 != 50 {
+		t.Errorf("thumbnail colour changed: %d %d %d", r>>8, g>>8, b>>8)
+	}
+
+	if !strings.HasPrefix(img.Key("uploads"), "uploads/") || !strings.HasSuffix(img.ThumbnailKey("uploads"), "-thumb.png") {
+		t.Errorf("unexpected keys %s %s", img.Key("uploads"), img.ThumbnailKey("uploads"))
+	}
+
+	again, _ := Process(pngOf(t, 600, 300))
+	if again.Key("uploads") != img.Key("uploads") {
+		t.Error("the same image should always get the same key")
+	}
+}
+
+func TestProcess_Errors(t *testing.T) {
+	var tests = []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"text", []byte("<html>not an image</html>"), ErrUnsupportedType},
+		{"truncated png", pngOf(t, 10, 10)[:40], ErrUnsupportedType},
+		{"too wide", pngOf(t, MaxDimension+1, 1), ErrTooManyPixels},
+		{"too big", make([]byte, MaxUploadSize+1), ErrTooLarge},
+	}
+
+	for _, e := range tests {
+		_, err := Process(e.data)
+		if !errors.Is(err, e.want) {
+			t.Errorf("%s: expected %v, got %v", e.name, e.want, err)
+		}
+	}
+}
+
+func TestThumbnail_SmallImageUnchanged(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 50, 80))
+	if Thumbnail(src, ThumbnailSize) != image.Image(src) {
+		t.Error("an image which fits should be returned unchanged")
+	}
+}
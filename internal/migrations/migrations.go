@@ -0,0 +1,365 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed sql
+var migrationFS embed.FS
+
+//go:embed seed
+var seedFS embed.FS
+
+// Migration is one versioned schema change, read from a pair of files named
+// <version>_<name>.up.sql and <version>_<name>.down.sql
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status describes a migration, and whether it has been applied to the database
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator applies the embedded migrations to a database, recording the applied versions in the
+// schema_migrations table
+type Migrator struct {
+	DB         *sql.DB
+	migrations []Migration
+}
+
+// New returns a Migrator for db, loaded with the migrations embedded in the binary
+func New(db *sql.DB) (*Migrator, error) {
+	migrations, err := load(migrationFS)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{DB: db, migrations: migrations}, nil
+}
+
+// load reads every migration in the sql directory of fsys, sorted by version
+func load(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "sql/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+
+	for _, file := range files {
+		base := strings.TrimPrefix(file, "sql/")
+
+		var direction string
+		switch {
+		case strings.HasSuffix(base, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(base, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s must end in .up.sql or .down.sql", base)
+		}
+
+		parts := strings.SplitN(strings.TrimSuffix(base, "."+direction+".sql"), "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("migration %s must be named <version>_<name>", base)
+		}
+
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has an invalid version: %w", base, err)
+		}
+
+		contents, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = m
+		}
+
+		if direction == "up" {
+			m.Up = string(contents)
+		} else {
+			m.Down = string(contents)
+		}
+	}
+
+	var migrations []Migration
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// ensureTable creates the schema_migrations table if it does not exist
+func (m *Migrator) ensureTable(ctx context.Context) error {
+	stmt := `
+		create table if not exists schema_migrations (
+			version    int          not null,
+			name       varchar(255) not null,
+			applied_at timestamp    not null default current_timestamp,
+			primary key (version)
+		)`
+
+	_, err := m.DB.ExecContext(ctx, stmt)
+	return err
+}
+
+// applied returns the time each applied migration was run, keyed by version
+func (m *Migrator) applied(ctx context.Context) (map[int]time.Time, error) {
+	err := m.ensureTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := m.DB.QueryContext(ctx, "select version, applied_at from schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// Current returns the highest applied version, or 0 if no migrations have been applied
+func (m *Migrator) Current() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	current := 0
+	for version := range applied {
+		if version > current {
+			current = version
+		}
+	}
+	return current, nil
+}
+
+// Status lists every known migration and whether it has been applied
+func (m *Migrator) Status() ([]Status, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []Status
+	for _, migration := range m.migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses = append(statuses, Status{
+			Migration: migration,
+			Applied:   ok,
+			AppliedAt: appliedAt,
+		})
+	}
+	return statuses, nil
+}
+
+// Up applies every pending migration, and returns how many were applied
+func (m *Migrator) Up() (int, error) {
+	if len(m.migrations) == 0 {
+		return 0, nil
+	}
+	return m.To(m.migrations[len(m.migrations)-1].Version)
+}
+
+// Down rolls back the most recently applied migration
+func (m *Migrator) Down() error {
+	current, err := m.Current()
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		return errors.New("no migrations to roll back")
+	}
+
+	previous := 0
+	for _, migration := range m.migrations {
+		if migration.Version < current {
+			previous = migration.Version
+		}
+	}
+
+	_, err = m.To(previous)
+	return err
+}
+
+// To migrates up or down until version is the latest applied migration, and returns how many
+// migrations were run. Version 0 rolls back every migration
+func (m *Migrator) To(version int) (int, error) {
+	if version != 0 && !m.exists(version) {
+		return 0, fmt.Errorf("unknown migration version %d", version)
+	}
+
+	ctx := context.Background()
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+
+	// apply pending migrations up to and including version, oldest first
+	for _, migration := range m.migrations {
+		if migration.Version > version {
+			break
+		}
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		err = m.run(ctx, migration, true)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	// roll back applied migrations newer than version, newest first
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if migration.Version <= version {
+			break
+		}
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		err = m.run(ctx, migration, false)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// Seed loads the development data in seed/dev.sql. It is kept out of the migration sequence so
+// that production databases never get its known admin credentials, and it can be run more than once
+func (m *Migrator) Seed() error {
+	script, err := fs.ReadFile(seedFS, "seed/dev.sql")
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range statements(string(script)) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		_, err := m.DB.ExecContext(ctx, stmt)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("seed: %w", err)
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) exists(version int) bool {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// run executes one migration in the given direction and records it. MySQL commits DDL implicitly,
+// so statements are run one at a time rather than in a transaction
+func (m *Migrator) run(ctx context.Context, migration Migration, up bool) error {
+	script := migration.Down
+	if up {
+		script = migration.Up
+	}
+
+	for _, stmt := range statements(script) {
+		stmtCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		_, err := m.DB.ExecContext(stmtCtx, stmt)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var err error
+	if up {
+		_, err = m.DB.ExecContext(ctx, "insert into schema_migrations (version, name, applied_at) values (?, ?, ?)",
+			migration.Version, migration.Name, time.Now())
+	} else {
+		_, err = m.DB.ExecContext(ctx, "delete from schema_migrations where version = ?", migration.Version)
+	}
+	return err
+}
+
+// statements splits a migration script into single statements, dropping comments and blank lines.
+// A statement ends with a semicolon at the end of a line
+func statements(script string) []string {
+	var stmts []string
+	var current strings.Builder
+
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+
+		current.WriteString(line)
+		current.WriteString("\n")
+
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSuffix(strings.TrimSpace(current.String()), ";"))
+			current.Reset()
+		}
+	}
+
+	if strings.TrimSpace(current.String()) != "" {
+		stmts = append(stmts, strings.TrimSpace(current.String()))
+	}
+
+	return stmts
+}
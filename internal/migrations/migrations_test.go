@@ -0,0 +1,88 @@
+package migrations
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"sql/000002_create_orders.up.sql":    {Data: []byte("create table orders (id int);")},
+		"sql/000002_create_orders.down.sql":  {Data: []byte("drop table orders;")},
+		"sql/000001_create_widgets.up.sql":   {Data: []byte("create table widgets (id int);")},
+		"sql/000001_create_widgets.down.sql": {Data: []byte("drop table widgets;")},
+	}
+
+	migrations, err := load(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migrations) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(migrations))
+	}
+
+	if migrations[0].Version != 1 || migrations[0].Name != "create_widgets" {
+		t.Errorf("expected 1 create_widgets first, got %d %s", migrations[0].Version, migrations[0].Name)
+	}
+
+	if migrations[1].Down != "drop table orders;" {
+		t.Errorf("unexpected down script %q", migrations[1].Down)
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	var tests = []struct {
+		name  string
+		files fstest.MapFS
+	}{
+		{"missing down", fstest.MapFS{
+			"sql/000001_create_widgets.up.sql": {Data: []byte("create table widgets (id int);")},
+		}},
+		{"missing up", fstest.MapFS{
+			"sql/000001_create_widgets.down.sql": {Data: []byte("drop table widgets;")},
+		}},
+		{"bad version", fstest.MapFS{
+			"sql/first_create_widgets.up.sql":   {Data: []byte("create table widgets (id int);")},
+			"sql/first_create_widgets.down.sql": {Data: []byte("drop table widgets;")},
+		}},
+		{"no name", fstest.MapFS{
+			"sql/000001.up.sql":   {Data: []byte("create table widgets (id int);")},
+			"sql/000001.down.sql": {Data: []byte("drop table widgets;")},
+		}},
+		{"bad suffix", fstest.MapFS{
+			"sql/000001_create_widgets.sql": {Data: []byte("create table widgets (id int);")},
+		}},
+	}
+
+	for _, e := range tests {
+		_, err := load(e.files)
+		if err == nil {
+			t.Errorf("%s: expected an error but did not get one", e.name)
+		}
+	}
+}
+
+func TestStatements(t *testing.T) {
+	var tests = []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{"single", "drop table widgets;", []string{"drop table widgets"}},
+		{"comments and blank lines", "-- a comment\n\ndrop table widgets;\n  -- indented comment\n", []string{"drop table widgets"}},
+		{"multi line", "create table widgets (\n    id int\n);\ndrop table orders;", []string{"create table widgets (\n    id int\n)", "drop table orders"}},
+		{"semicolon mid line", "insert into widgets (name) values ('a;b');", []string{"insert into widgets (name) values ('a;b')"}},
+		{"semicolon not at end of line", "select 1; select 2\nfrom dual;", []string{"select 1; select 2\nfrom dual"}},
+		{"no trailing semicolon", "drop table widgets;\ndrop table orders", []string{"drop table widgets", "drop table orders"}},
+		{"empty", "-- nothing to do\n", nil},
+	}
+
+	for _, e := range tests {
+		got := statements(e.script)
+		if !reflect.DeepEqual(got, e.want) {
+			t.Errorf("%s: expected %q, got %q", e.name, e.want, got)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+-- development data, loaded by "migrate seed". Never run this against production: it creates an
+-- admin user with a well known password.
+--
+-- The store front links to widget 1 and the bronze plan is widget 2. Set widgets.plan_id for
+-- widget 2 to the id of the matching Stripe price before subscribing.
+insert ignore into widgets (id, name, slug, description, inventory_level, price, image, is_recurring, plan_id)
+values (1, 'Widget', 'widget', 'A very nice widget.', 10, 1000, 'widget.jpg', 0, ''),
+       (2, 'Bronze Plan', 'bronze-plan', 'Get three widgets for the price of two every month', 0, 2000, 'bronze.png', 1, '');
+
+-- admin@example.com / password, an owner who can do everything
+insert ignore into users (first_name, last_name, email, role, password)
+values ('Admin', 'User', 'admin@example.com', 'owner', '$2a$12$issgSb5orJQQ9u5D4r5eJOs4bIeDfGjgOf27rDUvLUt9Th0eQ9MTO');
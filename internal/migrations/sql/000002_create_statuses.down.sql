@@ -0,0 +1,2 @@
+drop table if exists transaction_statuses;
+drop table if exists statuses;
@@ -0,0 +1,30 @@
+create table statuses (
+    id         int unsigned not null auto_increment,
+    name       varchar(255) not null,
+    created_at timestamp    not null default current_timestamp,
+    updated_at timestamp    not null default current_timestamp,
+    primary key (id)
+) engine = InnoDB
+  default charset = utf8mb4;
+
+insert into statuses (id, name)
+values (1, 'Cleared'),
+       (2, 'Refunded'),
+       (3, 'Cancelled');
+
+create table transaction_statuses (
+    id         int unsigned not null auto_increment,
+    name       varchar(255) not null,
+    created_at timestamp    not null default current_timestamp,
+    updated_at timestamp    not null default current_timestamp,
+    primary key (id)
+) engine = InnoDB
+  default charset = utf8mb4;
+
+insert into transaction_statuses (id, name)
+values (1, 'Pending'),
+       (2, 'Cleared'),
+       (3, 'Declined'),
+       (4, 'Refunded'),
+       (5, 'Partially refunded'),
+       (6, 'Disputed');
@@ -0,0 +1,10 @@
+create table customers (
+    id         int unsigned not null auto_increment,
+    first_name varchar(255) not null default '',
+    last_name  varchar(255) not null default '',
+    email      varchar(255) not null default '',
+    created_at timestamp    not null default current_timestamp,
+    updated_at timestamp    not null default current_timestamp,
+    primary key (id)
+) engine = InnoDB
+  default charset = utf8mb4;
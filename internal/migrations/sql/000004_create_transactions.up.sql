@@ -0,0 +1,19 @@
+create table transactions (
+    id                    int unsigned not null auto_increment,
+    amount                int          not null default 0,
+    currency              varchar(10)  not null default '',
+    last_four             varchar(4)   not null default '',
+    bank_return_code      varchar(255) not null default '',
+    transaction_status_id int unsigned not null,
+    expiry_month          int          not null default 0,
+    expiry_year           int          not null default 0,
+    payment_intent        varchar(255) not null default '',
+    payment_method        varchar(255) not null default '',
+    created_at            timestamp    not null default current_timestamp,
+    updated_at            timestamp    not null default current_timestamp,
+    primary key (id),
+    key transactions_payment_intent_idx (payment_intent),
+    constraint transactions_transaction_status_id_fk foreign key (transaction_status_id)
+        references transaction_statuses (id)
+) engine = InnoDB
+  default charset = utf8mb4;
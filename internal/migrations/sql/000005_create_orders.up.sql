@@ -0,0 +1,17 @@
+create table orders (
+    id             int unsigned not null auto_increment,
+    widget_id      int unsigned not null,
+    transaction_id int unsigned not null,
+    customer_id    int unsigned not null,
+    status_id      int unsigned not null,
+    quantity       int          not null default 1,
+    amount         int          not null default 0,
+    created_at     timestamp    not null default current_timestamp,
+    updated_at     timestamp    not null default current_timestamp,
+    primary key (id),
+    constraint orders_widget_id_fk foreign key (widget_id) references widgets (id),
+    constraint orders_transaction_id_fk foreign key (transaction_id) references transactions (id),
+    constraint orders_customer_id_fk foreign key (customer_id) references customers (id),
+    constraint orders_status_id_fk foreign key (status_id) references statuses (id)
+) engine = InnoDB
+  default charset = utf8mb4;
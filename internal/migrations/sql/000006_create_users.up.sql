@@ -0,0 +1,12 @@
+create table users (
+    id         int unsigned not null auto_increment,
+    first_name varchar(255) not null default '',
+    last_name  varchar(255) not null default '',
+    email      varchar(255) not null,
+    password   varchar(60)  not null,
+    created_at timestamp    not null default current_timestamp,
+    updated_at timestamp    not null default current_timestamp,
+    primary key (id),
+    unique key users_email_uq (email)
+) engine = InnoDB
+  default charset = utf8mb4;
@@ -0,0 +1,14 @@
+create table tokens (
+    id         int unsigned   not null auto_increment,
+    user_id    int unsigned   not null,
+    name       varchar(255)   not null default '',
+    email      varchar(255)   not null default '',
+    token_hash varbinary(255) not null,
+    expiry     timestamp      not null default current_timestamp,
+    created_at timestamp      not null default current_timestamp,
+    updated_at timestamp      not null default current_timestamp,
+    primary key (id),
+    key tokens_token_hash_idx (token_hash),
+    constraint tokens_user_id_fk foreign key (user_id) references users (id) on delete cascade
+) engine = InnoDB
+  default charset = utf8mb4;
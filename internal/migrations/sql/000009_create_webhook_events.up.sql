@@ -0,0 +1,12 @@
+create table webhook_events (
+    id           int unsigned not null auto_increment,
+    event_id     varchar(255) not null,
+    event_type   varchar(255) not null default '',
+    payload      longtext     not null,
+    processed_at timestamp    null,
+    created_at   timestamp    not null default current_timestamp,
+    updated_at   timestamp    not null default current_timestamp,
+    primary key (id),
+    unique key webhook_events_event_id_uq (event_id)
+) engine = InnoDB
+  default charset = utf8mb4;
@@ -0,0 +1,12 @@
+create table payment_reviews (
+    id             int unsigned not null auto_increment,
+    payment_intent varchar(255) not null,
+    amount         int          not null default 0,
+    currency       varchar(10)  not null default '',
+    email          varchar(255) not null default '',
+    reason         text,
+    created_at     timestamp    not null default current_timestamp,
+    updated_at     timestamp    not null default current_timestamp,
+    primary key (id)
+) engine = InnoDB
+  default charset = utf8mb4;
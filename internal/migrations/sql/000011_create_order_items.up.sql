@@ -0,0 +1,20 @@
+create table order_items (
+    id         int unsigned not null auto_increment,
+    order_id   int unsigned not null,
+    widget_id  int unsigned not null,
+    quantity   int          not null default 1,
+    unit_price int          not null default 0,
+    amount     int          not null default 0,
+    created_at timestamp    not null default current_timestamp,
+    updated_at timestamp    not null default current_timestamp,
+    primary key (id),
+    key order_items_order_id_idx (order_id),
+    constraint order_items_order_id_fk foreign key (order_id) references orders (id) on delete cascade,
+    constraint order_items_widget_id_fk foreign key (widget_id) references widgets (id)
+) engine = InnoDB
+  default charset = utf8mb4;
+
+-- every existing order becomes an order with a single line item
+insert into order_items (order_id, widget_id, quantity, unit_price, amount, created_at, updated_at)
+select id, widget_id, quantity, amount div greatest(quantity, 1), amount, created_at, updated_at
+from orders;
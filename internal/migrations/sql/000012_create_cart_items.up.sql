@@ -0,0 +1,13 @@
+create table cart_items (
+    id         int unsigned not null auto_increment,
+    user_id    int unsigned not null,
+    widget_id  int unsigned not null,
+    quantity   int          not null default 1,
+    created_at timestamp    not null default current_timestamp,
+    updated_at timestamp    not null default current_timestamp,
+    primary key (id),
+    unique key cart_items_user_id_widget_id_uq (user_id, widget_id),
+    constraint cart_items_user_id_fk foreign key (user_id) references users (id) on delete cascade,
+    constraint cart_items_widget_id_fk foreign key (widget_id) references widgets (id)
+) engine = InnoDB
+  default charset = utf8mb4;
@@ -0,0 +1,4 @@
+alter table orders
+    drop column restocked_at;
+
+drop table if exists inventory_reservations;
@@ -0,0 +1,18 @@
+create table inventory_reservations (
+    id             int unsigned not null auto_increment,
+    payment_intent varchar(255) not null,
+    widget_id      int unsigned not null,
+    quantity       int          not null,
+    expires_at     timestamp    not null,
+    created_at     timestamp    not null default current_timestamp,
+    updated_at     timestamp    not null default current_timestamp,
+    primary key (id),
+    key inventory_reservations_payment_intent_idx (payment_intent),
+    key inventory_reservations_widget_id_expires_at_idx (widget_id, expires_at),
+    constraint inventory_reservations_widget_id_fk foreign key (widget_id) references widgets (id) on delete cascade
+) engine = InnoDB
+  default charset = utf8mb4;
+
+-- set when the stock for a refunded order has been put back, so it is only put back once
+alter table orders
+    add column restocked_at timestamp null default null after amount;
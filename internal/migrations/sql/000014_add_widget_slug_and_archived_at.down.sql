@@ -0,0 +1,4 @@
+alter table widgets
+    drop index widgets_slug_uq,
+    drop column slug,
+    drop column archived_at;
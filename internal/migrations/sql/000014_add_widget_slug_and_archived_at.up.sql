@@ -0,0 +1,16 @@
+alter table widgets
+    add column slug        varchar(255) null default null after name,
+    add column archived_at timestamp    null default null after plan_id;
+
+-- existing widgets get a slug made from their name; any clashes get the widget id appended
+update widgets
+set slug = lower(replace(trim(name), ' ', '-'));
+
+update widgets w
+    inner join (select slug, min(id) as first_id from widgets group by slug) f on (f.slug = w.slug)
+set w.slug = concat(w.slug, '-', w.id)
+where w.id <> f.first_id;
+
+alter table widgets
+    modify column slug varchar(255) not null,
+    add unique key widgets_slug_uq (slug);
@@ -0,0 +1,4 @@
+-- thumbnail is the storage key of the scaled down copy of image. Widgets from before uploads
+-- have none, and the store front shows their full image instead
+alter table widgets
+    add column thumbnail varchar(255) not null default '' after image;
@@ -0,0 +1,7 @@
+-- every existing user could do everything, so they all start as owners; new users default to
+-- read only until given a role
+alter table users
+    add column role varchar(20) not null default 'owner' after email;
+
+alter table users
+    alter column role set default 'read-only';
@@ -0,0 +1,5 @@
+alter table tokens
+    drop key tokens_user_id_expiry_idx,
+    drop column device,
+    drop column ip_address,
+    drop column last_used_at;
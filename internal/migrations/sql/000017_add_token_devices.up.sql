@@ -0,0 +1,6 @@
+-- users may now hold a token per browser or device; these columns let them tell them apart
+alter table tokens
+    add column device       varchar(255) not null default '' after email,
+    add column ip_address   varchar(45)  not null default '' after device,
+    add column last_used_at timestamp    null     default null after expiry,
+    add key tokens_user_id_expiry_idx (user_id, expiry);
@@ -0,0 +1,16 @@
+create table api_keys (
+    id           int unsigned   not null auto_increment,
+    user_id      int unsigned   not null,
+    name         varchar(255)   not null,
+    prefix       varchar(20)    not null,
+    key_hash     varbinary(255) not null,
+    scopes       varchar(255)   not null default '',
+    expires_at   timestamp      null     default null,
+    last_used_at timestamp      null     default null,
+    created_at   timestamp      not null default current_timestamp,
+    updated_at   timestamp      not null default current_timestamp,
+    primary key (id),
+    unique key api_keys_key_hash_uq (key_hash),
+    constraint api_keys_user_id_fk foreign key (user_id) references users (id) on delete cascade
+) engine = InnoDB
+  default charset = utf8mb4;
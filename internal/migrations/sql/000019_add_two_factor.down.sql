@@ -0,0 +1,8 @@
+drop table if exists role_settings;
+
+drop table if exists user_recovery_codes;
+
+alter table users
+    drop column totp_secret,
+    drop column totp_enabled_at,
+    drop column totp_last_step;
@@ -0,0 +1,34 @@
+-- totp_secret is encrypted with the application secret key. totp_last_step is the time step of the
+-- last code accepted, so a code can never be used twice
+alter table users
+    add column totp_secret     varchar(255) not null default '' after password,
+    add column totp_enabled_at timestamp    null     default null after totp_secret,
+    add column totp_last_step  bigint       not null default 0 after totp_enabled_at;
+
+create table user_recovery_codes (
+    id         int unsigned   not null auto_increment,
+    user_id    int unsigned   not null,
+    code_hash  varbinary(255) not null,
+    used_at    timestamp      null     default null,
+    created_at timestamp      not null default current_timestamp,
+    updated_at timestamp      not null default current_timestamp,
+    primary key (id),
+    key user_recovery_codes_user_id_idx (user_id),
+    constraint user_recovery_codes_user_id_fk foreign key (user_id) references users (id) on delete cascade
+) engine = InnoDB
+  default charset = utf8mb4;
+
+create table role_settings (
+    role               varchar(20) not null,
+    require_two_factor tinyint(1)  not null default 0,
+    created_at         timestamp   not null default current_timestamp,
+    updated_at         timestamp   not null default current_timestamp,
+    primary key (role)
+) engine = InnoDB
+  default charset = utf8mb4;
+
+insert into role_settings (role)
+values ('owner'),
+       ('finance'),
+       ('support'),
+       ('read-only');
@@ -0,0 +1,17 @@
+-- action_tokens are single use tokens mailed to users, such as password reset links. Only a hash
+-- of each token is stored, and a token only works for its purpose
+create table action_tokens (
+    id         int unsigned   not null auto_increment,
+    user_id    int unsigned   not null,
+    purpose    varchar(50)    not null,
+    token_hash varbinary(255) not null,
+    expires_at timestamp      not null,
+    used_at    timestamp      null     default null,
+    created_at timestamp      not null default current_timestamp,
+    updated_at timestamp      not null default current_timestamp,
+    primary key (id),
+    unique key action_tokens_token_hash_uq (token_hash),
+    key action_tokens_user_id_purpose_idx (user_id, purpose),
+    constraint action_tokens_user_id_fk foreign key (user_id) references users (id) on delete cascade
+) engine = InnoDB
+  default charset = utf8mb4;
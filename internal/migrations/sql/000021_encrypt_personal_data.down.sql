@@ -0,0 +1,24 @@
+-- this only works before any personal data has been encrypted; encrypted values do not fit the
+-- old columns
+alter table payment_reviews
+    modify email varchar(255) not null default '';
+
+alter table transactions
+    modify last_four    varchar(4) not null default '',
+    modify expiry_month int        not null default 0,
+    modify expiry_year  int        not null default 0;
+
+alter table users
+    drop key users_email_index_uq,
+    drop column email_index,
+    modify first_name varchar(255) not null default '',
+    modify last_name  varchar(255) not null default '',
+    modify email      varchar(255) not null,
+    add unique key users_email_uq (email);
+
+alter table customers
+    drop key customers_email_index_idx,
+    drop column email_index,
+    modify first_name varchar(255) not null default '',
+    modify last_name  varchar(255) not null default '',
+    modify email      varchar(255) not null default '';
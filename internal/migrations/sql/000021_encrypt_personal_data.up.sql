@@ -0,0 +1,28 @@
+-- personal data is encrypted by the applications, so the columns grow to fit the ciphertext, and
+-- the card expiry becomes text. Emails get a blind index for lookups; "migrate reencrypt"
+-- encrypts and indexes the rows written before this migration
+alter table customers
+    modify first_name  varchar(1024) not null default '',
+    modify last_name   varchar(1024) not null default '',
+    modify email       varchar(1024) not null default '',
+    add column email_index varbinary(32) null default null after email,
+    add key customers_email_index_idx (email_index);
+
+alter table users
+    drop key users_email_uq,
+    modify first_name  varchar(1024) not null default '',
+    modify last_name   varchar(1024) not null default '',
+    modify email       varchar(1024) not null,
+    add column email_index varbinary(32) null default null after email,
+    add unique key users_email_index_uq (email_index);
+
+alter table transactions
+    modify last_four    varchar(255) not null default '',
+    modify expiry_month varchar(255) not null default '',
+    modify expiry_year  varchar(255) not null default '';
+
+alter table payment_reviews
+    modify email varchar(1024) not null default '';
+
+-- tokens kept a copy of the user's email, which nothing reads
+update tokens set email = '';
@@ -0,0 +1,21 @@
+-- audit_log records every change made through the admin api: who made it, from where, and the
+-- entity before and after. It is append only; the application never updates or deletes rows.
+-- There is no foreign key on user_id, so entries outlive the users who made them
+create table audit_log (
+    id          bigint unsigned not null auto_increment,
+    user_id     int unsigned    not null,
+    api_key_id  int unsigned    null     default null,
+    action      varchar(100)    not null,
+    entity      varchar(50)     not null,
+    entity_id   varchar(255)    not null default '',
+    before_data mediumtext      null,
+    after_data  mediumtext      null,
+    ip_address  varchar(45)     not null default '',
+    created_at  timestamp       not null default current_timestamp,
+    primary key (id),
+    key audit_log_created_at_idx (created_at),
+    key audit_log_user_id_idx (user_id, created_at),
+    key audit_log_action_idx (action, created_at),
+    key audit_log_entity_idx (entity, entity_id, created_at)
+) engine = InnoDB
+  default charset = utf8mb4;
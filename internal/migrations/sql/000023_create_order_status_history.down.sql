@@ -0,0 +1,8 @@
+drop table if exists order_status_history;
+
+update orders set status_id = 2 where status_id = 8;
+update orders set status_id = 1 where status_id in (4, 5, 6, 7);
+
+delete from statuses where id in (4, 5, 6, 7, 8);
+
+update statuses set name = 'Cleared' where id = 1;
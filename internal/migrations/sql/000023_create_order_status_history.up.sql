@@ -0,0 +1,31 @@
+-- orders move through a fixed set of statuses, enforced by the application, and every change is
+-- recorded in order_status_history
+update statuses set name = 'Paid' where id = 1;
+
+insert into statuses (id, name)
+values (4, 'Pending'),
+       (5, 'Fulfilled'),
+       (6, 'Shipped'),
+       (7, 'Delivered'),
+       (8, 'Partially refunded');
+
+create table order_status_history (
+    id             int unsigned not null auto_increment,
+    order_id       int unsigned not null,
+    from_status_id int unsigned null     default null,
+    to_status_id   int unsigned not null,
+    user_id        int unsigned null     default null,
+    note           varchar(255) not null default '',
+    created_at     timestamp    not null default current_timestamp,
+    primary key (id),
+    key order_status_history_order_id_idx (order_id, created_at),
+    constraint order_status_history_order_id_fk foreign key (order_id) references orders (id) on delete cascade,
+    constraint order_status_history_from_status_id_fk foreign key (from_status_id) references statuses (id),
+    constraint order_status_history_to_status_id_fk foreign key (to_status_id) references statuses (id)
+) engine = InnoDB
+  default charset = utf8mb4;
+
+-- existing orders start their history in the status they are in now
+insert into order_status_history (order_id, to_status_id, note, created_at)
+select id, status_id, 'status before history was kept', updated_at
+from orders;
@@ -0,0 +1,26 @@
+-- every refund of a transaction, so a charge can be refunded in several parts up to the amount captured
+create table refunds (
+    id               int unsigned not null auto_increment,
+    transaction_id   int unsigned not null,
+    order_id         int unsigned null     default null,
+    amount           int          not null,
+    reason           varchar(255) not null default '',
+    stripe_refund_id varchar(255) null     default null,
+    user_id          int unsigned null     default null,
+    created_at       timestamp    not null default current_timestamp,
+    updated_at       timestamp    not null default current_timestamp,
+    primary key (id),
+    unique key refunds_stripe_refund_id_uq (stripe_refund_id),
+    key refunds_transaction_id_idx (transaction_id),
+    key refunds_order_id_idx (order_id),
+    constraint refunds_transaction_id_fk foreign key (transaction_id) references transactions (id) on delete cascade,
+    constraint refunds_order_id_fk foreign key (order_id) references orders (id) on delete set null
+) engine = InnoDB
+  default charset = utf8mb4;
+
+-- orders refunded before refunds were recorded were refunded in full
+insert into refunds (transaction_id, order_id, amount, reason, created_at, updated_at)
+select o.transaction_id, o.id, t.amount, 'refunded before refunds were recorded', o.updated_at, o.updated_at
+from orders o
+         inner join transactions t on (o.transaction_id = t.id)
+where o.status_id = 2;
@@ -0,0 +1,8 @@
+drop table if exists subscription_plan_history;
+
+update orders set status_id = 1 where status_id = 9;
+update orders set status_id = 3 where status_id = 10;
+
+delete from order_status_history where from_status_id in (9, 10) or to_status_id in (9, 10);
+
+delete from statuses where id in (9, 10);
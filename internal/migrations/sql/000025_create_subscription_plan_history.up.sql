@@ -0,0 +1,29 @@
+-- subscriptions can be paused, and stay active until the end of their billing period once cancelled
+insert into statuses (id, name)
+values (9, 'Paused'),
+       (10, 'Cancelling');
+
+-- the plans a subscription has been on. The order keeps the plan it is on now
+create table subscription_plan_history (
+    id              int unsigned not null auto_increment,
+    order_id        int unsigned not null,
+    from_widget_id  int unsigned null     default null,
+    to_widget_id    int unsigned not null,
+    amount          int          not null default 0,
+    prorated_amount int          not null default 0,
+    user_id         int unsigned null     default null,
+    created_at      timestamp    not null default current_timestamp,
+    primary key (id),
+    key subscription_plan_history_order_id_idx (order_id, created_at),
+    constraint subscription_plan_history_order_id_fk foreign key (order_id) references orders (id) on delete cascade,
+    constraint subscription_plan_history_from_widget_id_fk foreign key (from_widget_id) references widgets (id),
+    constraint subscription_plan_history_to_widget_id_fk foreign key (to_widget_id) references widgets (id)
+) engine = InnoDB
+  default charset = utf8mb4;
+
+-- existing subscriptions start their history on the plan they are on now
+insert into subscription_plan_history (order_id, to_widget_id, amount, created_at)
+select o.id, o.widget_id, o.amount, o.created_at
+from orders o
+         inner join widgets w on (o.widget_id = w.id)
+where w.is_recurring = 1;
@@ -0,0 +1,10 @@
+-- renewal transactions are kept, but lose their link to the subscription they paid for
+alter table transactions
+    drop foreign key transactions_subscription_id_fk,
+    drop key transactions_invoice_id_uq,
+    drop column period_end,
+    drop column period_start,
+    drop column invoice_id,
+    drop column subscription_id;
+
+drop table if exists subscriptions;
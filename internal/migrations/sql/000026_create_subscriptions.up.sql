@@ -0,0 +1,55 @@
+-- subscriptions, kept in step with the payment provider. The order is what the customer bought at
+-- checkout; the subscription is its state now
+create table subscriptions (
+    id                     int unsigned not null auto_increment,
+    order_id               int unsigned not null,
+    customer_id            int unsigned not null,
+    widget_id              int unsigned not null,
+    stripe_subscription_id varchar(255) not null,
+    status                 varchar(50)  not null default 'active',
+    current_period_start   timestamp    null     default null,
+    current_period_end     timestamp    null     default null,
+    cancel_at_period_end   tinyint(1)   not null default 0,
+    trial_end              timestamp    null     default null,
+    created_at             timestamp    not null default current_timestamp,
+    updated_at             timestamp    not null default current_timestamp,
+    primary key (id),
+    unique key subscriptions_order_id_uq (order_id),
+    unique key subscriptions_stripe_subscription_id_uq (stripe_subscription_id),
+    key subscriptions_status_idx (status, current_period_end),
+    constraint subscriptions_order_id_fk foreign key (order_id) references orders (id) on delete cascade,
+    constraint subscriptions_customer_id_fk foreign key (customer_id) references customers (id),
+    constraint subscriptions_widget_id_fk foreign key (widget_id) references widgets (id)
+) engine = InnoDB
+  default charset = utf8mb4;
+
+-- each billing cycle of a subscription is paid for by one transaction, matched by its invoice
+alter table transactions
+    add column subscription_id int unsigned null default null after payment_method,
+    add column invoice_id varchar(255) null default null after subscription_id,
+    add column period_start timestamp null default null after invoice_id,
+    add column period_end timestamp null default null after period_start,
+    add unique key transactions_invoice_id_uq (invoice_id),
+    add constraint transactions_subscription_id_fk foreign key (subscription_id) references subscriptions (id) on delete set null;
+
+-- existing subscriptions are the orders for plans, whose transaction holds the subscription id. Their
+-- billing periods are not known until the payment provider next tells us about them
+insert into subscriptions (order_id, customer_id, widget_id, stripe_subscription_id, status, cancel_at_period_end,
+                           created_at, updated_at)
+select o.id,
+       o.customer_id,
+       o.widget_id,
+       t.payment_intent,
+       case o.status_id when 3 then 'canceled' when 9 then 'paused' else 'active' end,
+       o.status_id = 10,
+       o.created_at,
+       o.updated_at
+from orders o
+         inner join widgets w on (o.widget_id = w.id)
+         inner join transactions t on (o.transaction_id = t.id)
+where w.is_recurring = 1
+  and t.payment_intent <> '';
+
+update transactions t
+    inner join subscriptions s on (s.stripe_subscription_id = t.payment_intent)
+set t.subscription_id = s.id;
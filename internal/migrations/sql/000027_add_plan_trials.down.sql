@@ -0,0 +1,9 @@
+alter table subscriptions
+    drop column trial_reminder_sent_at;
+
+alter table widgets
+    drop column intro_coupon_id,
+    drop column intro_cycles,
+    drop column intro_price,
+    drop column trial_without_card,
+    drop column trial_days;
@@ -0,0 +1,12 @@
+-- plans may start with a free trial, with or without a card up front, and charge an introductory
+-- price for their first cycles. The introductory discount is a coupon with the payment provider
+alter table widgets
+    add column trial_days int not null default 0 after plan_id,
+    add column trial_without_card tinyint(1) not null default 0 after trial_days,
+    add column intro_price int not null default 0 after trial_without_card,
+    add column intro_cycles int not null default 0 after intro_price,
+    add column intro_coupon_id varchar(255) not null default '' after intro_cycles;
+
+-- customers are reminded once that their trial is ending
+alter table subscriptions
+    add column trial_reminder_sent_at timestamp null default null after trial_end;
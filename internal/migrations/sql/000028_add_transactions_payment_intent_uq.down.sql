@@ -0,0 +1,10 @@
+alter table transactions
+    drop key transactions_payment_intent_uq,
+    add key transactions_payment_intent_idx (payment_intent);
+
+update transactions
+set payment_intent = ''
+where payment_intent is null;
+
+alter table transactions
+    modify payment_intent varchar(255) not null default '';
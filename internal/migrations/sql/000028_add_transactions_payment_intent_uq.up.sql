@@ -0,0 +1,22 @@
+-- a payment intent pays for one transaction only, so a replayed payment cannot be saved twice.
+-- Transactions without one hold null rather than an empty string
+alter table transactions
+    modify payment_intent varchar(255) null default null;
+
+update transactions
+set payment_intent = null
+where payment_intent = '';
+
+-- keep the first transaction saved for a payment intent; any later copies lose the link
+update transactions t
+    inner join (select payment_intent, min(id) as first_id
+                from transactions
+                where payment_intent is not null
+                group by payment_intent
+                having count(id) > 1) d on (t.payment_intent = d.payment_intent)
+set t.payment_intent = null
+where t.id <> d.first_id;
+
+alter table transactions
+    drop key transactions_payment_intent_idx,
+    add unique key transactions_payment_intent_uq (payment_intent);
@@ -0,0 +1,2 @@
+alter table widgets
+    drop column plan_interval;
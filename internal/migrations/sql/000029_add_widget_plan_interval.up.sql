@@ -0,0 +1,3 @@
+-- plans are billed every month or every year. Every plan so far has been monthly
+alter table widgets
+    add column plan_interval varchar(10) not null default 'month' after plan_id;
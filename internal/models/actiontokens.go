@@ -0,0 +1,142 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// PurposePasswordReset is the purpose of tokens mailed in password reset links
+const PurposePasswordReset = "password-reset"
+
+// PasswordResetTTL is how long a password reset link works for
+const PasswordResetTTL = time.Hour
+
+// ErrInvalidToken is returned for action tokens which do not exist, are for another purpose, have
+// expired, or have been used
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// CreateActionToken makes a new single use token for purpose, which lasts for ttl, and returns its
+// plain text. Any unused token the user already has for purpose stops working, so only the newest
+// link is good
+func (m *DBModel) CreateActionToken(userID int, purpose string, ttl time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	token, err := GenerateToken(userID, ttl, purpose)
+	if err != nil {
+		return "", err
+	}
+
+	err = m.WithTx(ctx, func(tx *sql.Tx) error {
+		err := invalidateActionTokens(ctx, tx, userID, purpose)
+		if err != nil {
+			return err
+		}
+
+		stmt := `
+			insert into action_tokens
+				(user_id, purpose, token_hash, expires_at, created_at, updated_at)
+			values (?, ?, ?, ?, ?, ?)`
+
+		_, err = tx.ExecContext(ctx, stmt, userID, purpose, token.Hash, token.Expiry, time.Now(), time.Now())
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token.PlainText, nil
+}
+
+// CheckActionToken returns the id of the user a token for purpose belongs to, without using it up
+func (m *DBModel) CheckActionToken(plainText, purpose string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	hash := sha256.Sum256([]byte(plainText))
+
+	query := `
+		select
+			user_id
+		from
+			action_tokens
+		where
+			token_hash = ? and purpose = ? and used_at is null and expires_at > ?`
+
+	var userID int
+	err := m.DB.QueryRowContext(ctx, query, hash[:], purpose, time.Now()).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrInvalidToken
+	}
+	if err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// consumeActionToken marks a token for purpose as used, and returns the id of its user. The token is
+// only used if it is still good, in a single update, so two requests cannot both use it
+func consumeActionToken(ctx context.Context, tx *sql.Tx, plainText, purpose string) (int, error) {
+	hash := sha256.Sum256([]byte(plainText))
+
+	stmt := `
+		update action_tokens set used_at = ?, updated_at = ?
+		where token_hash = ? and purpose = ? and used_at is null and expires_at > ?`
+
+	result, err := tx.ExecContext(ctx, stmt, time.Now(), time.Now(), hash[:], purpose, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if rows == 0 {
+		return 0, ErrInvalidToken
+	}
+
+	var userID int
+	err = tx.QueryRowContext(ctx, "select user_id from action_tokens where token_hash = ?", hash[:]).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// invalidateActionTokens stops every unused token a user has for purpose from working
+func invalidateActionTokens(ctx context.Context, tx *sql.Tx, userID int, purpose string) error {
+	stmt := `
+		update action_tokens set used_at = ?, updated_at = ?
+		where user_id = ? and purpose = ? and used_at is null`
+
+	_, err := tx.ExecContext(ctx, stmt, time.Now(), time.Now(), userID, purpose)
+	return err
+}
+
+// updatePassword sets a user's password hash, and stops their password reset links from working
+func updatePassword(ctx context.Context, tx *sql.Tx, userID int, hash string) error {
+	_, err := tx.ExecContext(ctx, "update users set password = ?, updated_at = ? where id = ?", hash, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+	return invalidateActionTokens(ctx, tx, userID, PurposePasswordReset)
+}
+
+// ResetPasswordWithToken uses up a password reset token and sets the password hash of its user, in
+// a single database transaction. It returns ErrInvalidToken if the token is no good
+func (m *DBModel) ResetPasswordWithToken(plainText, hash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		userID, err := consumeActionToken(ctx, tx, plainText, PurposePasswordReset)
+		if err != nil {
+			return err
+		}
+		return updatePassword(ctx, tx, userID, hash)
+	})
+}
@@ -0,0 +1,268 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"log"
+	"strings"
+	"time"
+)
+
+// APIKeyPrefix starts every api key, so keys are easy to tell apart from login tokens, and easy to
+// find if one is committed or pasted somewhere by mistake
+const APIKeyPrefix = "gek_"
+
+// APIKeyScope is what an api key may be used for
+type APIKeyScope string
+
+const (
+	ScopeReadOrders         APIKeyScope = "read-orders"
+	ScopeWriteRefunds       APIKeyScope = "write-refunds"
+	ScopeWriteFulfilment    APIKeyScope = "write-fulfilment"
+	ScopeWriteSubscriptions APIKeyScope = "write-subscriptions"
+	ScopeWritePlans         APIKeyScope = "write-plans"
+	ScopeReadWidgets        APIKeyScope = "read-widgets"
+	ScopeWriteWidgets       APIKeyScope = "write-widgets"
+)
+
+// APIKeyScopes maps each scope to the permission it grants. Keys can never manage users, api keys
+// or use the virtual terminal
+var APIKeyScopes = map[APIKeyScope]Permission{
+	ScopeReadOrders:         PermViewSales,
+	ScopeWriteRefunds:       PermRefund,
+	ScopeWriteFulfilment:    PermFulfilOrders,
+	ScopeWriteSubscriptions: PermCancelSubscriptions,
+	ScopeWritePlans:         PermChangePlans,
+	ScopeReadWidgets:        PermViewWidgets,
+	ScopeWriteWidgets:       PermManageWidgets,
+}
+
+// APIKey is the type for long lived api keys used by scripts and integrations. A key acts for the
+// user who created it, limited to its scopes, so it can never do more than that user's role allows
+type APIKey struct {
+	ID         int           `json:"id"`
+	UserID     int           `json:"user_id"`
+	Name       string        `json:"name"`
+	Prefix     string        `json:"prefix"`
+	PlainText  string        `json:"key,omitempty"`
+	Hash       []byte        `json:"-"`
+	Scopes     []APIKeyScope `json:"scopes"`
+	ExpiresAt  *time.Time    `json:"expires_at"`
+	LastUsedAt *time.Time    `json:"last_used_at"`
+	CreatedAt  time.Time     `json:"created_at"`
+}
+
+// Allows reports whether one of the key's scopes grants permission p
+func (k *APIKey) Allows(p Permission) bool {
+	for _, scope := range k.Scopes {
+		if APIKeyScopes[scope] == p {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAPIKey reports whether a bearer token looks like an api key rather than a login token
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// GenerateAPIKey makes a new random api key for userID. The plain text is only ever shown once,
+// when the key is created; only its hash is stored
+func GenerateAPIKey(userID int, name string, scopes []APIKeyScope, expiresAt *time.Time) (*APIKey, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &APIKey{
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}
+	key.PlainText = APIKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	key.Prefix = key.PlainText[:len(APIKeyPrefix)+8]
+	hash := sha256.Sum256([]byte(key.PlainText))
+	key.Hash = hash[:]
+	return key, nil
+}
+
+func joinScopes(scopes []APIKeyScope) string {
+	var s []string
+	for _, scope := range scopes {
+		s = append(s, string(scope))
+	}
+	return strings.Join(s, ",")
+}
+
+func splitScopes(s string) []APIKeyScope {
+	var scopes []APIKeyScope
+	for _, scope := range strings.Split(s, ",") {
+		if scope != "" {
+			scopes = append(scopes, APIKeyScope(scope))
+		}
+	}
+	return scopes
+}
+
+// InsertAPIKey saves a new api key, and sets its id
+func (m *DBModel) InsertAPIKey(key *APIKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		insert into api_keys
+			(user_id, name, prefix, key_hash, scopes, expires_at, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := m.DB.ExecContext(ctx, stmt,
+		key.UserID,
+		key.Name,
+		key.Prefix,
+		key.Hash,
+		joinScopes(key.Scopes),
+		key.ExpiresAt,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	key.ID = int(id)
+	key.CreatedAt = time.Now()
+	return nil
+}
+
+// GetUserForAPIKey returns the user an unexpired api key acts for, with the key attached
+func (m *DBModel) GetUserForAPIKey(plainText string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	keyHash := sha256.Sum256([]byte(plainText))
+	var user User
+	var key APIKey
+	var scopes string
+	var expiresAt sql.NullTime
+
+	query := `
+		select
+			u.id, u.first_name, u.last_name, u.email, u.role,
+			k.id, k.name, k.prefix, k.scopes, k.expires_at
+		from
+			api_keys k
+			inner join users u on (u.id = k.user_id)
+		where
+			k.key_hash = ?
+			and (k.expires_at is null or k.expires_at > ?)`
+
+	err := m.DB.QueryRowContext(ctx, query, keyHash[:], time.Now()).Scan(
+		&user.ID,
+		m.opened(&user.FirstName),
+		m.opened(&user.LastName),
+		m.opened(&user.Email),
+		&user.Role,
+		&key.ID,
+		&key.Name,
+		&key.Prefix,
+		&scopes,
+		&expiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	key.UserID = user.ID
+	key.Scopes = splitScopes(scopes)
+	if expiresAt.Valid {
+		key.ExpiresAt = &expiresAt.Time
+	}
+	user.APIKey = &key
+
+	_, err = m.DB.ExecContext(ctx, `
+		update api_keys set last_used_at = ?
+		where id = ? and (last_used_at is null or last_used_at < ?)`,
+		time.Now(), key.ID, time.Now().Add(-tokenTouchInterval))
+	if err != nil {
+		log.Println(err)
+	}
+
+	return &user, nil
+}
+
+// GetAllAPIKeys returns every api key, newest first
+func (m *DBModel) GetAllAPIKeys() ([]*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var keys []*APIKey
+
+	query := `
+		select
+			id, user_id, name, prefix, scopes, expires_at, last_used_at, created_at
+		from
+			api_keys
+		order by
+			created_at desc`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var k APIKey
+		var scopes string
+		var expiresAt, lastUsed sql.NullTime
+		err = rows.Scan(
+			&k.ID,
+			&k.UserID,
+			&k.Name,
+			&k.Prefix,
+			&scopes,
+			&expiresAt,
+			&lastUsed,
+			&k.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		k.Scopes = splitScopes(scopes)
+		if expiresAt.Valid {
+			k.ExpiresAt = &expiresAt.Time
+		}
+		if lastUsed.Valid {
+			k.LastUsedAt = &lastUsed.Time
+		}
+		keys = append(keys, &k)
+	}
+
+	return keys, rows.Err()
+}
+
+// DeleteAPIKey revokes an api key by id
+func (m *DBModel) DeleteAPIKey(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, "delete from api_keys where id = ?", id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+func TestGenerateAPIKey(t *testing.T) {
+	key, err := GenerateAPIKey(1, "warehouse", []APIKeyScope{ScopeReadOrders}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsAPIKey(key.PlainText) {
+		t.Errorf("expected key to start with %s, got %s", APIKeyPrefix, key.PlainText)
+	}
+	if !strings.HasPrefix(key.PlainText, key.Prefix) || len(key.Prefix) != len(APIKeyPrefix)+8 {
+		t.Errorf("unexpected prefix %q for key %q", key.Prefix, key.PlainText)
+	}
+
+	hash := sha256.Sum256([]byte(key.PlainText))
+	if string(key.Hash) != string(hash[:]) {
+		t.Error("key hash does not match its plain text")
+	}
+
+	other, err := GenerateAPIKey(1, "warehouse", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.PlainText == key.PlainText {
+		t.Error("expected every key to be different")
+	}
+
+	if IsAPIKey("ABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+		t.Error("a login token should not look like an api key")
+	}
+}
+
+func TestScopes_RoundTrip(t *testing.T) {
+	scopes := []APIKeyScope{ScopeReadOrders, ScopeWriteRefunds}
+
+	got := splitScopes(joinScopes(scopes))
+	if len(got) != 2 || got[0] != ScopeReadOrders || got[1] != ScopeWriteRefunds {
+		t.Errorf("unexpected scopes %v", got)
+	}
+
+	if len(splitScopes("")) != 0 {
+		t.Error("expected no scopes from an empty string")
+	}
+}
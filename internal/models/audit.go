@@ -0,0 +1,240 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Audited actions. An action is "<entity>.<what happened>"
+const (
+	AuditTokenRevoke            = "token.revoke"
+	AuditTwoFactorSetup         = "two_factor.setup"
+	AuditTwoFactorEnable        = "two_factor.enable"
+	AuditTwoFactorDisable       = "two_factor.disable"
+	AuditAPIKeyCreate           = "api_key.create"
+	AuditAPIKeyRevoke           = "api_key.revoke"
+	AuditTerminalCharge         = "transaction.charge"
+	AuditOrderRefund            = "order.refund"
+	AuditOrderStatus            = "order.status"
+	AuditSubscriptionCancel     = "subscription.cancel"
+	AuditSubscriptionReactivate = "subscription.reactivate"
+	AuditSubscriptionPause      = "subscription.pause"
+	AuditSubscriptionResume     = "subscription.resume"
+	AuditSubscriptionChangePlan = "subscription.change_plan"
+	AuditWidgetCreate           = "widget.create"
+	AuditWidgetUpdate           = "widget.update"
+	AuditWidgetArchive          = "widget.archive"
+	AuditWidgetStock            = "widget.stock"
+	AuditImageUpload            = "image.upload"
+	AuditUserCreate             = "user.create"
+	AuditUserUpdate             = "user.update"
+	AuditUserPassword           = "user.password"
+	AuditUserDelete             = "user.delete"
+	AuditUserRevokeTokens       = "user.revoke_tokens"
+	AuditUserResetTwoFactor     = "user.reset_two_factor"
+	AuditUserUnlock             = "user.unlock"
+	AuditRoleSettingUpdate      = "role_setting.update"
+)
+
+// AuditActions lists every audited action, for filtering the audit log
+var AuditActions = []string{
+	AuditTokenRevoke, AuditTwoFactorSetup, AuditTwoFactorEnable, AuditTwoFactorDisable,
+	AuditAPIKeyCreate, AuditAPIKeyRevoke, AuditTerminalCharge, AuditOrderRefund, AuditOrderStatus,
+	AuditSubscriptionCancel, AuditSubscriptionReactivate, AuditSubscriptionPause, AuditSubscriptionResume,
+	AuditSubscriptionChangePlan, AuditWidgetCreate, AuditWidgetUpdate, AuditWidgetArchive,
+	AuditWidgetStock, AuditImageUpload, AuditUserCreate, AuditUserUpdate, AuditUserPassword, AuditUserDelete,
+	AuditUserRevokeTokens, AuditUserResetTwoFactor, AuditUserUnlock, AuditRoleSettingUpdate,
+}
+
+// AuditEntry is one entry in the audit log. Before and After are the entity as JSON, and may be
+// empty. They are encrypted in the database, since they often hold personal data
+type AuditEntry struct {
+	ID        int             `json:"id"`
+	UserID    int             `json:"user_id"`
+	UserName  string          `json:"user_name"`
+	APIKeyID  int             `json:"api_key_id,omitempty"`
+	Action    string          `json:"action"`
+	Entity    string          `json:"entity"`
+	EntityID  string          `json:"entity_id"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	IPAddress string          `json:"ip_address"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// AuditFilter narrows down the audit log. Zero fields match everything; To is exclusive
+type AuditFilter struct {
+	UserID   int
+	Action   string
+	Entity   string
+	EntityID string
+	From     time.Time
+	To       time.Time
+}
+
+// where returns the where clause and its arguments for the filter
+func (f AuditFilter) where() (string, []interface{}) {
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+
+	if f.UserID > 0 {
+		conditions = append(conditions, "a.user_id = ?")
+		args = append(args, f.UserID)
+	}
+	if f.Action != "" {
+		conditions = append(conditions, "a.action = ?")
+		args = append(args, f.Action)
+	}
+	if f.Entity != "" {
+		conditions = append(conditions, "a.entity = ?")
+		args = append(args, f.Entity)
+	}
+	if f.EntityID != "" {
+		conditions = append(conditions, "a.entity_id = ?")
+		args = append(args, f.EntityID)
+	}
+	if !f.From.IsZero() {
+		conditions = append(conditions, "a.created_at >= ?")
+		args = append(args, f.From)
+	}
+	if !f.To.IsZero() {
+		conditions = append(conditions, "a.created_at < ?")
+		args = append(args, f.To)
+	}
+
+	return strings.Join(conditions, " and "), args
+}
+
+// sealedJSON returns data, to be encrypted as it is written, or null if there is none
+func (m *DBModel) sealedJSON(data json.RawMessage) driver.Valuer {
+	if len(data) == 0 {
+		return nullValue{}
+	}
+	return m.sealed(string(data))
+}
+
+// nullValue is written to the database as null
+type nullValue struct{}
+
+// Value implements driver.Valuer
+func (nullValue) Value() (driver.Value, error) {
+	return nil, nil
+}
+
+// InsertAuditEntry adds an entry to the audit log. There is deliberately no way to change or
+// remove entries once they are written
+func (m *DBModel) InsertAuditEntry(e AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var apiKeyID interface{}
+	if e.APIKeyID > 0 {
+		apiKeyID = e.APIKeyID
+	}
+
+	stmt := `
+		insert into audit_log
+			(user_id, api_key_id, action, entity, entity_id, before_data, after_data, ip_address, created_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		e.UserID,
+		apiKeyID,
+		e.Action,
+		e.Entity,
+		e.EntityID,
+		m.sealedJSON(e.Before),
+		m.sealedJSON(e.After),
+		e.IPAddress,
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetAuditLogPaginated returns a page of the audit log matching filter, newest first, with the
+// last page number and the number of matching entries
+func (m *DBModel) GetAuditLogPaginated(filter AuditFilter, pageSize, page int) ([]*AuditEntry, int, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	offset := (page - 1) * pageSize
+	where, args := filter.where()
+
+	var entries []*AuditEntry
+
+	query := `
+		select
+			a.id, a.user_id, u.first_name, u.last_name, coalesce(a.api_key_id, 0), a.action,
+			a.entity, a.entity_id, a.before_data, a.after_data, a.ip_address, a.created_at
+		from
+			audit_log a
+			left join users u on (a.user_id = u.id)
+		where
+			` + where + `
+		order by
+			a.created_at desc, a.id desc
+		limit ? offset ?`
+
+	rows, err := m.DB.QueryContext(ctx, query, append(args, pageSize, offset)...)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var e AuditEntry
+		var firstName, lastName, before, after string
+		err = rows.Scan(
+			&e.ID,
+			&e.UserID,
+			m.opened(&firstName),
+			m.opened(&lastName),
+			&e.APIKeyID,
+			&e.Action,
+			&e.Entity,
+			&e.EntityID,
+			m.opened(&before),
+			m.opened(&after),
+			&e.IPAddress,
+			&e.CreatedAt,
+		)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		e.UserName = strings.TrimSpace(firstName + " " + lastName)
+		if before != "" {
+			e.Before = json.RawMessage(before)
+		}
+		if after != "" {
+			e.After = json.RawMessage(after)
+		}
+		entries = append(entries, &e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	var totalRecords int
+	countRow := m.DB.QueryRowContext(ctx, `select count(a.id) from audit_log a where `+where, args...)
+	err = countRow.Scan(&totalRecords)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	lastPage := totalRecords / pageSize
+
+	return entries, lastPage, totalRecords, nil
+}
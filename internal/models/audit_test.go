@@ -0,0 +1,66 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAuditFilter_Where(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 0, 1)
+
+	var tests = []struct {
+		name     string
+		filter   AuditFilter
+		want     string
+		wantArgs int
+	}{
+		{"no filter", AuditFilter{}, "1 = 1", 0},
+		{"user", AuditFilter{UserID: 3}, "1 = 1 and a.user_id = ?", 1},
+		{"entity", AuditFilter{Entity: "user", EntityID: "7"}, "1 = 1 and a.entity = ? and a.entity_id = ?", 2},
+		{"dates", AuditFilter{From: from, To: to}, "1 = 1 and a.created_at >= ? and a.created_at < ?", 2},
+		{
+			"everything",
+			AuditFilter{UserID: 1, Action: AuditUserDelete, Entity: "user", EntityID: "2", From: from, To: to},
+			"1 = 1 and a.user_id = ? and a.action = ? and a.entity = ? and a.entity_id = ? and a.created_at >= ? and a.created_at < ?",
+			6,
+		},
+	}
+
+	for _, e := range tests {
+		where, args := e.filter.where()
+		if where != e.want {
+			t.Errorf("%s: expected %q, got %q", e.name, e.want, where)
+		}
+		if len(args) != e.wantArgs {
+			t.Errorf("%s: expected %d args, got %d", e.name, e.wantArgs, len(args))
+		}
+	}
+}
+
+func TestSealedJSON(t *testing.T) {
+	m := testModel(t)
+
+	stored, err := m.sealedJSON(nil).Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != nil {
+		t.Errorf("expected null for no data, got %v", stored)
+	}
+
+	stored, err = m.sealedJSON(json.RawMessage(`{"email":"me@here.com"}`)).Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	err = m.opened(&got).Scan(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != `{"email":"me@here.com"}` {
+		t.Errorf("expected the data back, got %q", got)
+	}
+}
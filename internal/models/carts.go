@@ -0,0 +1,202 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrNotForSale is returned when pricing a widget which cannot be bought as a one-off item, because
+// it is a subscription or has been archived
+var ErrNotForSale = errors.New("is not for sale")
+
+// MaxItemQuantity is the most of one widget that can be bought in a single order
+const MaxItemQuantity = 99
+
+// Cart is the type for a shopping cart. Carts hold only widget ids and quantities; prices are
+// always looked up from the widgets table when the cart is priced
+type Cart struct {
+	Items []CartItem `json:"items"`
+}
+
+// CartItem is the type for one line of a shopping cart
+type CartItem struct {
+	WidgetID int `json:"widget_id"`
+	Quantity int `json:"quantity"`
+}
+
+// Add adds quantity of a widget to the cart
+func (c *Cart) Add(widgetID, quantity int) {
+	for i := range c.Items {
+		if c.Items[i].WidgetID == widgetID {
+			c.Items[i].Quantity += quantity
+			return
+		}
+	}
+	c.Items = append(c.Items, CartItem{WidgetID: widgetID, Quantity: quantity})
+}
+
+// Set sets the quantity of a widget in the cart, removing it if quantity is zero or less
+func (c *Cart) Set(widgetID, quantity int) {
+	if quantity <= 0 {
+		c.Remove(widgetID)
+		return
+	}
+
+	for i := range c.Items {
+		if c.Items[i].WidgetID == widgetID {
+			c.Items[i].Quantity = quantity
+			return
+		}
+	}
+	c.Items = append(c.Items, CartItem{WidgetID: widgetID, Quantity: quantity})
+}
+
+// Remove removes a widget from the cart
+func (c *Cart) Remove(widgetID int) {
+	for i := range c.Items {
+		if c.Items[i].WidgetID == widgetID {
+			c.Items = append(c.Items[:i], c.Items[i+1:]...)
+			return
+		}
+	}
+}
+
+// Merge adds the items of other that are not already in the cart
+func (c *Cart) Merge(other Cart) {
+	for _, item := range other.Items {
+		found := false
+		for _, existing := range c.Items {
+			if existing.WidgetID == item.WidgetID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			c.Items = append(c.Items, item)
+		}
+	}
+}
+
+// Count returns the number of widgets in the cart
+func (c *Cart) Count() int {
+	count := 0
+	for _, item := range c.Items {
+		count += item.Quantity
+	}
+	return count
+}
+
+// PriceItems looks up the current price of every item and returns them as order items, along with
+// the total. It refuses recurring widgets, which are sold as subscriptions, and archived widgets with
+// ErrNotForSale
+func (m *DBModel) PriceItems(items []CartItem) ([]OrderItem, int, error) {
+	var orderItems []OrderItem
+	total := 0
+
+	for _, item := range items {
+		if item.Quantity <= 0 || item.Quantity > MaxItemQuantity {
+			return nil, 0, fmt.Errorf("invalid quantity %d for widget %d", item.Quantity, item.WidgetID)
+		}
+
+		widget, err := m.GetWidget(item.WidgetID)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if widget.IsRecurring || widget.IsArchived {
+			return nil, 0, fmt.Errorf("%s %w", widget.Name, ErrNotForSale)
+		}
+
+		amount := widget.Price * item.Quantity
+		orderItems = append(orderItems, OrderItem{
+			WidgetID:  widget.ID,
+			Quantity:  item.Quantity,
+			UnitPrice: widget.Price,
+			Amount:    amount,
+			Widget:    widget,
+		})
+		total += amount
+	}
+
+	return orderItems, total, nil
+}
+
+// ItemsDescription describes priced items as widget id x quantity pairs, such as "1x2,3x1", for
+// tagging payments with what they were for
+func ItemsDescription(items []OrderItem) string {
+	var parts []string
+	for _, item := range items {
+		parts = append(parts, fmt.Sprintf("%dx%d", item.WidgetID, item.Quantity))
+	}
+	return strings.Join(parts, ",")
+}
+
+// GetCartForUser returns the saved cart for a logged-in user
+func (m *DBModel) GetCartForUser(userID int) (Cart, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var cart Cart
+
+	query := `
+		select
+			widget_id, quantity
+		from
+			cart_items
+		where
+			user_id = ?
+		order by
+			id`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return cart, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var item CartItem
+		err = rows.Scan(&item.WidgetID, &item.Quantity)
+		if err != nil {
+			return cart, err
+		}
+		cart.Items = append(cart.Items, item)
+	}
+
+	return cart, rows.Err()
+}
+
+// SaveCartForUser replaces the saved cart for a logged-in user
+func (m *DBModel) SaveCartForUser(userID int, cart Cart) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "delete from cart_items where user_id = ?", userID)
+		if err != nil {
+			return err
+		}
+
+		stmt := `
+			insert into cart_items
+				(user_id, widget_id, quantity, created_at, updated_at)
+			values (?, ?, ?, ?, ?)`
+
+		for _, item := range cart.Items {
+			_, err = tx.ExecContext(ctx, stmt, userID, item.WidgetID, item.Quantity, time.Now(), time.Now())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
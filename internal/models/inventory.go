@@ -0,0 +1,296 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// StockReservationTTL is how long stock is held for a payment intent which has not been paid for
+const StockReservationTTL = 30 * time.Minute
+
+// ErrOutOfStock is returned when there is not enough stock of a widget to sell
+var ErrOutOfStock = errors.New("is out of stock")
+
+// ErrNegativeStock is returned when a stock adjustment would take a widget's inventory below zero
+var ErrNegativeStock = errors.New("would leave the inventory below zero")
+
+// AdjustInventory adds delta, which may be negative, to the inventory level of a one-off widget,
+// and returns the new level. The change is made relative to the level in the database, so sales
+// made at the same time are not lost
+func (m *DBModel) AdjustInventory(widgetID, delta int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var level int
+
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		var isRecurring bool
+		row := tx.QueryRowContext(ctx, "select inventory_level, is_recurring from widgets where id = ? for update", widgetID)
+		err := row.Scan(&level, &isRecurring)
+		if err != nil {
+			return err
+		}
+
+		if isRecurring {
+			return fmt.Errorf("widget %d is a subscription plan, which has no inventory", widgetID)
+		}
+		if level+delta < 0 {
+			return ErrNegativeStock
+		}
+		level += delta
+
+		_, err = tx.ExecContext(ctx, "update widgets set inventory_level = ?, updated_at = ? where id = ?",
+			level, time.Now(), widgetID)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return level, nil
+}
+
+// AvailableStock returns the stock of a widget that is not held for an unpaid payment intent
+func (m *DBModel) AvailableStock(widgetID int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select
+			w.inventory_level - coalesce(sum(r.quantity), 0)
+		from
+			widgets w
+			left join inventory_reservations r on (r.widget_id = w.id and r.expires_at > ?)
+		where
+			w.id = ?
+		group by
+			w.id, w.inventory_level`
+
+	var available int
+	err := m.DB.QueryRowContext(ctx, query, time.Now(), widgetID).Scan(&available)
+	if err != nil {
+		return 0, err
+	}
+	return available, nil
+}
+
+// ReserveStock holds stock of every one-off widget in items for a payment intent, until the order is
+// saved, the reservation is released, or StockReservationTTL passes. The widget rows are locked while
+// stock is counted, so two buyers can never reserve the same stock. It returns ErrOutOfStock if any
+// widget does not have enough stock, in which case nothing is reserved
+func (m *DBModel) ReserveStock(pi string, items []CartItem) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	quantities := make(map[int]int)
+	for _, item := range items {
+		quantities[item.WidgetID] += item.Quantity
+	}
+
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		stocked, err := lockStock(ctx, tx, quantities, pi)
+		if err != nil {
+			return err
+		}
+
+		stmt := `
+			insert into inventory_reservations
+				(payment_intent, widget_id, quantity, expires_at, created_at, updated_at)
+			values (?, ?, ?, ?, ?, ?)`
+
+		for _, widgetID := range stocked {
+			_, err = tx.ExecContext(ctx, stmt, pi, widgetID, quantities[widgetID],
+				time.Now().Add(StockReservationTTL), time.Now(), time.Now())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// lockStock locks the widget rows for quantities, in id order so concurrent callers cannot deadlock,
+// and checks each one-off widget has enough stock that is not reserved for another payment intent.
+// It returns the ids of the widgets which keep stock; recurring widgets do not
+func lockStock(ctx context.Context, tx *sql.Tx, quantities map[int]int, pi string) ([]int, error) {
+	var widgetIDs []int
+	for widgetID := range quantities {
+		widgetIDs = append(widgetIDs, widgetID)
+	}
+	sort.Ints(widgetIDs)
+
+	// expired reservations no longer hold stock
+	_, err := tx.ExecContext(ctx, "delete from inventory_reservations where expires_at <= ?", time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	var stocked []int
+	for _, widgetID := range widgetIDs {
+		var name string
+		var level int
+		var recurring bool
+		row := tx.QueryRowContext(ctx, "select name, inventory_level, is_recurring from widgets where id = ? for update", widgetID)
+		err := row.Scan(&name, &level, &recurring)
+		if err != nil {
+			return nil, err
+		}
+		if recurring {
+			continue
+		}
+
+		var reserved int
+		row = tx.QueryRowContext(ctx, `
+			select
+				coalesce(sum(quantity), 0)
+			from
+				inventory_reservations
+			where
+				widget_id = ? and payment_intent <> ?`, widgetID, pi)
+		err = row.Scan(&reserved)
+		if err != nil {
+			return nil, err
+		}
+
+		if level-reserved < quantities[widgetID] {
+			return nil, fmt.Errorf("%s %w", name, ErrOutOfStock)
+		}
+		stocked = append(stocked, widgetID)
+	}
+
+	return stocked, nil
+}
+
+// commitStock takes the stock for a paid order out of the inventory, and drops the reservation made
+// for its payment intent. Stock reserved for other payment intents is never taken, so an order whose
+// reservation expired fails with ErrOutOfStock if the stock has since been reserved by someone else
+func commitStock(ctx context.Context, tx *sql.Tx, pi string, items []OrderItem) error {
+	quantities := make(map[int]int)
+	for _, item := range items {
+		quantities[item.WidgetID] += item.Quantity
+	}
+
+	stocked, err := lockStock(ctx, tx, quantities, pi)
+	if err != nil {
+		return err
+	}
+
+	for _, widgetID := range stocked {
+		_, err = tx.ExecContext(ctx, "update widgets set inventory_level = inventory_level - ?, updated_at = ? where id = ?",
+			quantities[widgetID], time.Now(), widgetID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "delete from inventory_reservations where payment_intent = ?", pi)
+	return err
+}
+
+// ReleaseStock gives back the stock reserved for a payment intent which will not be paid
+func (m *DBModel) ReleaseStock(pi string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, "delete from inventory_reservations where payment_intent = ?", pi)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReleaseStockTx gives back the stock reserved for a payment intent inside tx
+func (m *DBModel) ReleaseStockTx(ctx context.Context, tx *sql.Tx, pi string) error {
+	_, err := tx.ExecContext(ctx, "delete from inventory_reservations where payment_intent = ?", pi)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RestockOrder puts the stock of a refunded order back into the inventory. An order is only
+// restocked once, however many times it is refunded
+func (m *DBModel) RestockOrder(orderID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		return restockOrder(ctx, tx, orderID)
+	})
+}
+
+// RestockOrdersByPaymentIntentTx puts the stock of every order paid for by a refunded payment intent
+// back into the inventory, inside tx
+func (m *DBModel) RestockOrdersByPaymentIntentTx(ctx context.Context, tx *sql.Tx, pi string) error {
+	query := `
+		select
+			o.id
+		from
+			orders o
+			inner join transactions t on (o.transaction_id = t.id)
+		where
+			t.payment_intent = ?`
+
+	rows, err := tx.QueryContext(ctx, query, pi)
+	if err != nil {
+		return err
+	}
+
+	var orderIDs []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			_ = rows.Close()
+			return err
+		}
+		orderIDs = append(orderIDs, id)
+	}
+	err = rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range orderIDs {
+		err = restockOrder(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restockOrder marks an order as restocked and adds its one-off items back to the inventory. It does
+// nothing if the order has already been restocked
+func restockOrder(ctx context.Context, tx *sql.Tx, orderID int) error {
+	result, err := tx.ExecContext(ctx, "update orders set restocked_at = ? where id = ? and restocked_at is null",
+		time.Now(), orderID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return nil
+	}
+
+	stmt := `
+		update widgets w
+			inner join (
+				select widget_id, sum(quantity) as quantity from order_items where order_id = ? group by widget_id
+			) i on (i.widget_id = w.id)
+		set
+			w.inventory_level = w.inventory_level + i.quantity,
+			w.updated_at = ?
+		where
+			w.is_recurring = 0`
+
+	_, err = tx.ExecContext(ctx, stmt, orderID, time.Now())
+	return err
+}
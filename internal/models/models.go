@@ -4,14 +4,21 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"goEcommerce/internal/encryption"
 	"golang.org/x/crypto/bcrypt"
+	"sort"
 	"strings"
 	"time"
+
+	"github.com/go-sql-driver/mysql"
 )
 
-// DBModel is the type for database connection values
+// DBModel is the type for database connection values. Keyring encrypts personal data, and IndexKey
+// makes the blind indexes used to look up encrypted emails
 type DBModel struct {
-	DB *sql.DB
+	DB       *sql.DB
+	Keyring  *encryption.Keyring
+	IndexKey []byte
 }
 
 // Models is the wrapper for all models
@@ -20,24 +27,33 @@ type Models struct {
 }
 
 // NewModels returns a model type with database connection pool
-func NewModels(db *sql.DB) Models {
+func NewModels(db *sql.DB, keyring *encryption.Keyring, indexKey []byte) Models {
 	return Models{
-		DB: DBModel{DB: db},
+		DB: DBModel{DB: db, Keyring: keyring, IndexKey: indexKey},
 	}
 }
 
 // Widget is the type for all widgets
 type Widget struct {
-	ID             int       `json:"id"`
-	Name           string    `json:"name"`
-	Description    string    `json:"description"`
-	InventoryLevel int       `json:"inventory_level"`
-	Price          int       `json:"price"`
-	Image          string    `json:"image"`
-	IsRecurring    bool      `json:"is_recurring"`
-	PlanID         string    `json:"plan_id"`
-	CreatedAt      time.Time `json:"-"`
-	UpdatedAt      time.Time `json:"-"`
+	ID               int       `json:"id"`
+	Name             string    `json:"name"`
+	Slug             string    `json:"slug"`
+	Description      string    `json:"description"`
+	InventoryLevel   int       `json:"inventory_level"`
+	Price            int       `json:"price"`
+	Image            string    `json:"image"`
+	Thumbnail        string    `json:"thumbnail"`
+	IsRecurring      bool      `json:"is_recurring"`
+	PlanID           string    `json:"plan_id"`
+	PlanInterval     string    `json:"plan_interval"`
+	TrialDays        int       `json:"trial_days"`
+	TrialWithoutCard bool      `json:"trial_without_card"`
+	IntroPrice       int       `json:"intro_price"`
+	IntroCycles      int       `json:"intro_cycles"`
+	IntroCouponID    string    `json:"intro_coupon_id"`
+	IsArchived       bool      `json:"is_archived"`
+	CreatedAt        time.Time `json:"-"`
+	UpdatedAt        time.Time `json:"-"`
 }
 
 // Order is the type for all orders
@@ -47,6 +63,7 @@ type Order struct {
 	TransactionID int         `json:"transaction_id"`
 	CustomerID    int         `json:"customer_id"`
 	StatusID      int         `json:"status_id"`
+	StatusName    string      `json:"status_name"`
 	Quantity      int         `json:"quantity"`
 	Amount        int         `json:"amount"`
 	CreatedAt     time.Time   `json:"-"`
@@ -54,6 +71,20 @@ type Order struct {
 	Widget        Widget      `json:"widget"`
 	Transaction   Transaction `json:"transaction"`
 	Customer      Customer    `json:"customer"`
+	Items         []OrderItem `json:"items"`
+}
+
+// OrderItem is the type for one line of an order
+type OrderItem struct {
+	ID        int       `json:"id"`
+	OrderID   int       `json:"order_id"`
+	WidgetID  int       `json:"widget_id"`
+	Quantity  int       `json:"quantity"`
+	UnitPrice int       `json:"unit_price"`
+	Amount    int       `json:"amount"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+	Widget    Widget    `json:"widget"`
 }
 
 // Status is the type for order statuses
@@ -64,6 +95,16 @@ type Status struct {
 	UpdatedAt time.Time `json:"-"`
 }
 
+// Transaction statuses, matching the rows of the transaction_statuses table
+const (
+	TransactionStatusPending           = 1
+	TransactionStatusCleared           = 2
+	TransactionStatusDeclined          = 3
+	TransactionStatusRefunded          = 4
+	TransactionStatusPartiallyRefunded = 5
+	TransactionStatusDisputed          = 6
+)
+
 // TransactionStatus is the type for transaction statuses
 type TransactionStatus struct {
 	ID        int       `json:"id"`
@@ -74,18 +115,22 @@ type TransactionStatus struct {
 
 // Transaction is the type for transactions
 type Transaction struct {
-	ID                  int       `json:"id"`
-	Amount              int       `json:"amount"`
-	Currency            string    `json:"currency"`
-	LastFour            string    `json:"last_four"`
-	ExpiryMonth         int       `json:"expiry_month"`
-	ExpiryYear          int       `json:"expiry_year"`
-	PaymentIntent       string    `json:"payment_intent"`
-	PaymentMethod       string    `json:"payment_method"`
-	BankReturnCode      string    `json:"bank_return_code"`
-	TransactionStatusID int       `json:"transaction_status_id"`
-	CreatedAt           time.Time `json:"-"`
-	UpdatedAt           time.Time `json:"-"`
+	ID                  int        `json:"id"`
+	Amount              int        `json:"amount"`
+	Currency            string     `json:"currency"`
+	LastFour            string     `json:"last_four"`
+	ExpiryMonth         int        `json:"expiry_month"`
+	ExpiryYear          int        `json:"expiry_year"`
+	PaymentIntent       string     `json:"payment_intent"`
+	PaymentMethod       string     `json:"payment_method"`
+	BankReturnCode      string     `json:"bank_return_code"`
+	TransactionStatusID int        `json:"transaction_status_id"`
+	SubscriptionID      int        `json:"subscription_id,omitempty"`
+	InvoiceID           string     `json:"invoice_id,omitempty"`
+	PeriodStart         *time.Time `json:"period_start,omitempty"`
+	PeriodEnd           *time.Time `json:"period_end,omitempty"`
+	CreatedAt           time.Time  `json:"-"`
+	UpdatedAt           time.Time  `json:"-"`
 }
 
 // User is the type for users
@@ -94,9 +139,14 @@ type User struct {
 	FirstName string    `json:"first_name"`
 	LastName  string    `json:"last_name"`
 	Email     string    `json:"email"`
-	Password  string    `json:"password"`
+	Role      Role      `json:"role"`
+	Password  string    `json:"password,omitempty"`
 	CreatedAt time.Time `json:"-"`
 	UpdatedAt time.Time `json:"-"`
+	APIKey    *APIKey   `json:"-"`
+
+	TwoFactorEnabled  bool `json:"two_factor_enabled"`
+	TwoFactorRequired bool `json:"two_factor_required"`
 }
 
 // Customer is the type for customers
@@ -114,59 +164,204 @@ func (m *DBModel) GetWidget(id int) (Widget, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	var widget Widget
-
 	row := m.DB.QueryRowContext(ctx, `
 		select 
-			id, name, description, inventory_level, price, coalesce(image, ''), is_recurring, plan_id,
-			created_at, updated_at
+			`+widgetColumns+`
 		from 
 			widgets 
 		where id = ?`, id)
-	err := row.Scan(
-		&widget.ID,
-		&widget.Name,
-		&widget.Description,
-		&widget.InventoryLevel,
-		&widget.Price,
-		&widget.Image,
-		&widget.IsRecurring,
-		&widget.PlanID,
-		&widget.CreatedAt,
-		&widget.UpdatedAt,
-	)
+
+	return scanWidget(row)
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx, so inserts can run inside or outside a transaction
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// WithTx runs fn inside a database transaction, committing if fn succeeds and rolling back otherwise
+func (m *DBModel) WithTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CreateOrderTx inserts a customer, a transaction and an order with its line items in a single
+// database transaction, so a failure part way through does not leave orphaned rows. An order
+// without items is saved with a single item for its WidgetID. An order may not mix recurring and
+// one-off widgets. The stock for one-off widgets is taken out of the inventory, using the stock
+// reserved for the payment intent. It returns the id of the new order, or ErrPaymentProcessed if
+// the payment intent already paid for one
+func (m *DBModel) CreateOrderTx(c Customer, txn Transaction, order Order) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var orderID int
+
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		saved, err := m.createOrder(ctx, tx, c, txn, order)
+		if err != nil {
+			return err
+		}
+		orderID = saved.ID
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return orderID, nil
+}
+
+// createOrder does the work of CreateOrderTx inside tx, and returns the order as saved
+func (m *DBModel) createOrder(ctx context.Context, tx *sql.Tx, c Customer, txn Transaction, order Order) (Order, error) {
+	if len(order.Items) == 0 {
+		order.Items = []OrderItem{
+			{
+				WidgetID:  order.WidgetID,
+				Quantity:  order.Quantity,
+				UnitPrice: order.Amount / max(order.Quantity, 1),
+				Amount:    order.Amount,
+			},
+		}
+	}
+
+	// the order row keeps the first widget and the total quantity. The listings tell sales from
+	// subscriptions by that widget, which is only safe because every item is of the same kind
+	order.WidgetID = order.Items[0].WidgetID
+	order.Quantity = 0
+	for _, item := range order.Items {
+		order.Quantity += item.Quantity
+	}
+
+	err := checkSingleKind(ctx, tx, order.Items)
+	if err != nil {
+		return order, err
+	}
+
+	// the transaction goes first, so a payment intent which already has an order is refused with
+	// ErrPaymentProcessed before anything else is checked
+	order.TransactionID, err = m.insertTransaction(ctx, tx, txn)
+	if err != nil {
+		return order, err
+	}
+
+	err = commitStock(ctx, tx, txn.PaymentIntent, order.Items)
+	if err != nil {
+		return order, err
+	}
+
+	order.CustomerID, err = m.insertCustomer(ctx, tx, c)
 	if err != nil {
-		return widget, err
+		return order, err
 	}
 
-	return widget, nil
+	order.ID, err = insertOrder(ctx, tx, order)
+	if err != nil {
+		return order, err
+	}
+
+	err = insertStartingPlan(ctx, tx, order.ID, order)
+	if err != nil {
+		return order, err
+	}
+
+	for _, item := range order.Items {
+		item.OrderID = order.ID
+		_, err = insertOrderItem(ctx, tx, item)
+		if err != nil {
+			return order, err
+		}
+	}
+	return order, nil
 }
 
-// InsertTransaction inserts a new txn, and returns its id
+// checkSingleKind returns an error if items mix recurring and one-off widgets
+func checkSingleKind(ctx context.Context, tx *sql.Tx, items []OrderItem) error {
+	placeholders := make([]string, 0, len(items))
+	args := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		placeholders = append(placeholders, "?")
+		args = append(args, item.WidgetID)
+	}
+
+	query := `select count(distinct is_recurring) from widgets where id in (` + strings.Join(placeholders, ", ") + `)`
+
+	var kinds int
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&kinds)
+	if err != nil {
+		return err
+	}
+	if kinds > 1 {
+		return errors.New("an order cannot mix subscriptions with one-off widgets")
+	}
+	return nil
+}
+
+// ErrPaymentProcessed is returned when a transaction has already been saved for a payment intent
+var ErrPaymentProcessed = errors.New("payment has already been processed")
+
+// isDuplicate reports whether err is mysql refusing a row which breaks a unique key
+func isDuplicate(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// InsertTransaction inserts a new txn, and returns its id. It returns ErrPaymentProcessed if the
+// txn's payment intent already has one
 func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	return m.insertTransaction(ctx, m.DB, txn)
+}
+
+func (m *DBModel) insertTransaction(ctx context.Context, db execer, txn Transaction) (int, error) {
 	stmt := `
 		insert into transactions
 			(amount, currency, last_four, bank_return_code, expiry_month, expiry_year, payment_intent, payment_method,
-			transaction_status_id, created_at, updated_at)
-		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			subscription_id, invoice_id, period_start, period_end, transaction_status_id, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := m.DB.ExecContext(ctx, stmt,
+	var paymentIntent, invoiceID interface{}
+	if txn.PaymentIntent != "" {
+		paymentIntent = txn.PaymentIntent
+	}
+	if txn.InvoiceID != "" {
+		invoiceID = txn.InvoiceID
+	}
+
+	result, err := db.ExecContext(ctx, stmt,
 		txn.Amount,
 		txn.Currency,
-		txn.LastFour,
+		m.sealed(txn.LastFour),
 		txn.BankReturnCode,
-		txn.ExpiryMonth,
-		txn.ExpiryYear,
-		txn.PaymentIntent,
+		m.sealedInt(txn.ExpiryMonth),
+		m.sealedInt(txn.ExpiryYear),
+		paymentIntent,
 		txn.PaymentMethod,
+		nullIfZero(txn.SubscriptionID),
+		invoiceID,
+		txn.PeriodStart,
+		txn.PeriodEnd,
 		txn.TransactionStatusID,
 		time.Now(),
 		time.Now(),
 	)
+	if isDuplicate(err) {
+		return 0, ErrPaymentProcessed
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -184,6 +379,10 @@ func (m *DBModel) InsertOrder(order Order) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	return insertOrder(ctx, m.DB, order)
+}
+
+func insertOrder(ctx context.Context, db execer, order Order) (int, error) {
 	stmt := `
 		insert into orders
 			(widget_id, transaction_id, status_id, quantity, customer_id,
@@ -191,7 +390,7 @@ func (m *DBModel) InsertOrder(order Order) (int, error) {
 		values (?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := m.DB.ExecContext(ctx, stmt,
+	result, err := db.ExecContext(ctx, stmt,
 		order.WidgetID,
 		order.TransactionID,
 		order.StatusID,
@@ -210,23 +409,148 @@ func (m *DBModel) InsertOrder(order Order) (int, error) {
 		return 0, err
 	}
 
+	err = insertOrderStatusChange(ctx, db, int(id), 0, order.StatusID, 0, "")
+	if err != nil {
+		return 0, err
+	}
+
 	return int(id), nil
 }
 
-// InsertCustomer inserts a new order, and returns its id
+func insertOrderItem(ctx context.Context, db execer, item OrderItem) (int, error) {
+	stmt := `
+		insert into order_items
+			(order_id, widget_id, quantity, unit_price, amount, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?)
+	`
+
+	result, err := db.ExecContext(ctx, stmt,
+		item.OrderID,
+		item.WidgetID,
+		item.Quantity,
+		item.UnitPrice,
+		item.Amount,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// attachOrderItems loads the line items for orders with a single query, and sets them on each order
+func (m *DBModel) attachOrderItems(ctx context.Context, orders ...*Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*Order)
+	placeholders := make([]string, 0, len(orders))
+	args := make([]interface{}, 0, len(orders))
+	for _, o := range orders {
+		byID[o.ID] = o
+		o.Items = []OrderItem{}
+		placeholders = append(placeholders, "?")
+		args = append(args, o.ID)
+	}
+
+	query := `
+		select
+			i.id, i.order_id, i.widget_id, i.quantity, i.unit_price, i.amount,
+			i.created_at, i.updated_at, w.id, w.name
+		from
+			order_items i
+			inner join widgets w on (i.widget_id = w.id)
+		where
+			i.order_id in (` + strings.Join(placeholders, ", ") + `)
+		order by
+			i.order_id, i.id
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var i OrderItem
+		err = rows.Scan(
+			&i.ID,
+			&i.OrderID,
+			&i.WidgetID,
+			&i.Quantity,
+			&i.UnitPrice,
+			&i.Amount,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Widget.ID,
+			&i.Widget.Name,
+		)
+		if err != nil {
+			return err
+		}
+		o := byID[i.OrderID]
+		o.Items = append(o.Items, i)
+	}
+
+	return rows.Err()
+}
+
+// InsertCustomer saves a customer, and returns their id. A customer with the same email as an
+// existing one is the same customer; their name is updated and their id returned
 func (m *DBModel) InsertCustomer(c Customer) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	return m.insertCustomer(ctx, m.DB, c)
+}
+
+func (m *DBModel) insertCustomer(ctx context.Context, db execer, c Customer) (int, error) {
+	if strings.TrimSpace(c.Email) != "" {
+		var id int
+		row := db.QueryRowContext(ctx, `
+			select id from customers
+			where email_index = ? or (email_index is null and email = ?)
+			order by id limit 1`, m.emailIndex(c.Email), normalizeEmail(c.Email))
+		err := row.Scan(&id)
+		if err == nil {
+			_, err = db.ExecContext(ctx, `
+				update customers set first_name = ?, last_name = ?, email = ?, email_index = ?, updated_at = ?
+				where id = ?`,
+				m.sealed(c.FirstName), m.sealed(c.LastName), m.sealed(c.Email), m.emailIndex(c.Email), time.Now(), id)
+			if err != nil {
+				return 0, err
+			}
+			return id, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return 0, err
+		}
+	}
+
 	stmt := `
 		insert into customers
-			(first_name, last_name, email, created_at, updated_at)
-		values (?, ?, ?, ?, ?)`
+			(first_name, last_name, email, email_index, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?)`
 
-	result, err := m.DB.ExecContext(ctx, stmt,
-		c.FirstName,
-		c.LastName,
-		c.Email,
+	result, err := db.ExecContext(ctx, stmt,
+		m.sealed(c.FirstName),
+		m.sealed(c.LastName),
+		m.sealed(c.Email),
+		m.emailIndex(c.Email),
 		time.Now(),
 		time.Now(),
 	)
@@ -247,24 +571,28 @@ func (m *DBModel) GetUserByEmail(email string) (User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	email = strings.ToLower(email)
+	email = normalizeEmail(email)
 	var user User
 
 	row := m.DB.QueryRowContext(ctx, `
 		select 
-			id, first_name, last_name, email, password,
-			created_at, updated_at
+			u.id, u.first_name, u.last_name, u.email, u.role, u.password,
+			u.created_at, u.updated_at, `+twoFactorColumns+`
 		from 
-			users 
-		where email = ?`, email)
+			users u
+			`+twoFactorJoin+`
+		where u.email_index = ? or (u.email_index is null and u.email = ?)`, m.emailIndex(email), email)
 	err := row.Scan(
 		&user.ID,
-		&user.FirstName,
-		&user.LastName,
-		&user.Email,
+		m.opened(&user.FirstName),
+		m.opened(&user.LastName),
+		m.opened(&user.Email),
+		&user.Role,
 		&user.Password,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.TwoFactorEnabled,
+		&user.TwoFactorRequired,
 	)
 	if err != nil {
 		return user, err
@@ -280,7 +608,8 @@ func (m *DBModel) Authenticate(email, password string) (int, error) {
 	var id int
 	var hashedPassword string
 
-	row := m.DB.QueryRowContext(ctx, "select id, password from users where email = ?", email)
+	row := m.DB.QueryRowContext(ctx, "select id, password from users where email_index = ? or (email_index is null and email = ?)",
+		m.emailIndex(email), normalizeEmail(email))
 	err := row.Scan(&id, &hashedPassword)
 	if err != nil {
 		return id, err
@@ -296,16 +625,15 @@ func (m *DBModel) Authenticate(email, password string) (int, error) {
 	return id, nil
 }
 
+// UpdatePasswordForUser sets a user's password hash. Any password reset links they were sent stop
+// working
 func (m *DBModel) UpdatePasswordForUser(user User, hash string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	query := `update users set password = ? where id = ?`
-	_, err := m.DB.ExecContext(ctx, query, hash, user.ID)
-	if err != nil {
-		return err
-	}
-	return nil
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		return updatePassword(ctx, tx, user.ID, hash)
+	})
 }
 
 // GetAllOrders returns a slice of all orders
@@ -321,7 +649,7 @@ func (m *DBModel) GetAllOrders() ([]*Order, error) {
 		o.status_id, o.quantity, o.amount, o.created_at, o.updated_at, 
 		w.id, w.name, 
 		t.id, t.amount, t.currency, t.last_four, t.expiry_month, 
-		t.expiry_year, t.payment_intent, t.bank_return_code, 
+		t.expiry_year, coalesce(t.payment_intent, ''), t.bank_return_code, 
 		c.id, c.first_name, c.last_name, c.email
 		
 	from
@@ -363,22 +691,28 @@ func (m *DBModel) GetAllOrders() ([]*Order, error) {
 			&o.Transaction.ID,
 			&o.Transaction.Amount,
 			&o.Transaction.Currency,
-			&o.Transaction.LastFour,
-			&o.Transaction.ExpiryMonth,
-			&o.Transaction.ExpiryYear,
+			m.opened(&o.Transaction.LastFour),
+			m.openedInt(&o.Transaction.ExpiryMonth),
+			m.openedInt(&o.Transaction.ExpiryYear),
 			&o.Transaction.PaymentIntent,
 			&o.Transaction.BankReturnCode,
 			&o.Customer.ID,
-			&o.Customer.FirstName,
-			&o.Customer.LastName,
-			&o.Customer.Email,
+			m.opened(&o.Customer.FirstName),
+			m.opened(&o.Customer.LastName),
+			m.opened(&o.Customer.Email),
 		)
 		if err != nil {
 			return nil, err
 		}
+		o.StatusName = OrderStatusName(o.StatusID)
 		orders = append(orders, &o)
 	}
 
+	err = m.attachOrderItems(ctx, orders...)
+	if err != nil {
+		return nil, err
+	}
+
 	return orders, nil
 }
 
@@ -396,7 +730,7 @@ func (m *DBModel) GetAllOrdersPaginated(pageSize, page int) ([]*Order, int, int,
 		o.id, o.widget_id, o.transaction_id, o.customer_id, 
 		o.status_id, o.quantity, o.amount, o.created_at,
 		o.updated_at, w.id, w.name, t.id, t.amount, t.currency,
-		t.last_four, t.expiry_month, t.expiry_year, t.payment_intent,
+		t.last_four, t.expiry_month, t.expiry_year, coalesce(t.payment_intent, ''),
 		t.bank_return_code, c.id, c.first_name, c.last_name, c.email
 		
 	from
@@ -439,22 +773,28 @@ func (m *DBModel) GetAllOrdersPaginated(pageSize, page int) ([]*Order, int, int,
 			&o.Transaction.ID,
 			&o.Transaction.Amount,
 			&o.Transaction.Currency,
-			&o.Transaction.LastFour,
-			&o.Transaction.ExpiryMonth,
-			&o.Transaction.ExpiryYear,
+			m.opened(&o.Transaction.LastFour),
+			m.openedInt(&o.Transaction.ExpiryMonth),
+			m.openedInt(&o.Transaction.ExpiryYear),
 			&o.Transaction.PaymentIntent,
 			&o.Transaction.BankReturnCode,
 			&o.Customer.ID,
-			&o.Customer.FirstName,
-			&o.Customer.LastName,
-			&o.Customer.Email,
+			m.opened(&o.Customer.FirstName),
+			m.opened(&o.Customer.LastName),
+			m.opened(&o.Customer.Email),
 		)
 		if err != nil {
 			return nil, 0, 0, err
 		}
+		o.StatusName = OrderStatusName(o.StatusID)
 		orders = append(orders, &o)
 	}
 
+	err = m.attachOrderItems(ctx, orders...)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
 	query = `
 		select 
 			count(o.id)
@@ -489,7 +829,7 @@ func (m *DBModel) GetAllSubscriptions() ([]*Order, error) {
 			o.status_id, o.quantity, o.amount, o.created_at, o.updated_at, 
 			w.id, w.name, 
 			t.id, t.amount, t.currency, t.last_four, t.expiry_month, 
-			t.expiry_year, t.payment_intent, t.bank_return_code, 
+			t.expiry_year, coalesce(t.payment_intent, ''), t.bank_return_code, 
 			c.id, c.first_name, c.last_name, c.email
 		from
 			orders o
@@ -530,117 +870,29 @@ func (m *DBModel) GetAllSubscriptions() ([]*Order, error) {
 			&o.Transaction.ID,
 			&o.Transaction.Amount,
 			&o.Transaction.Currency,
-			&o.Transaction.LastFour,
-			&o.Transaction.ExpiryMonth,
-			&o.Transaction.ExpiryYear,
+			m.opened(&o.Transaction.LastFour),
+			m.openedInt(&o.Transaction.ExpiryMonth),
+			m.openedInt(&o.Transaction.ExpiryYear),
 			&o.Transaction.PaymentIntent,
 			&o.Transaction.BankReturnCode,
 			&o.Customer.ID,
-			&o.Customer.FirstName,
-			&o.Customer.LastName,
-			&o.Customer.Email,
+			m.opened(&o.Customer.FirstName),
+			m.opened(&o.Customer.LastName),
+			m.opened(&o.Customer.Email),
 		)
 		if err != nil {
 			return nil, err
 		}
+		o.StatusName = OrderStatusName(o.StatusID)
 		orders = append(orders, &o)
 	}
 
-	return orders, nil
-}
-
-// GetAllSubscriptionsPaginated returns a slice of a subset of subscriptions
-func (m *DBModel) GetAllSubscriptionsPaginated(pageSize, page int) ([]*Order, int, int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	offset := (page - 1) * pageSize
-
-	var orders []*Order
-
-	query := `
-	select
-		o.id, o.widget_id, o.transaction_id, o.customer_id, 
-		o.status_id, o.quantity, o.amount, o.created_at,
-		o.updated_at, w.id, w.name, t.id, t.amount, t.currency,
-		t.last_four, t.expiry_month, t.expiry_year, t.payment_intent,
-		t.bank_return_code, c.id, c.first_name, c.last_name, c.email
-		
-	from
-		orders o
-		left join widgets w on (o.widget_id = w.id)
-		left join transactions t on (o.transaction_id = t.id)
-		left join customers c on (o.customer_id = c.id)
-	where
-		w.is_recurring = 1
-	order by
-		o.created_at desc
-	limit ? offset ?
-	`
-
-	rows, err := m.DB.QueryContext(ctx, query, pageSize, offset)
-	if err != nil {
-		return nil, 0, 0, err
-	}
-	defer func(rows *sql.Rows) {
-		err := rows.Close()
-		if err != nil {
-
-		}
-	}(rows)
-
-	for rows.Next() {
-		var o Order
-		err = rows.Scan(
-			&o.ID,
-			&o.WidgetID,
-			&o.TransactionID,
-			&o.CustomerID,
-			&o.StatusID,
-			&o.Quantity,
-			&o.Amount,
-			&o.CreatedAt,
-			&o.UpdatedAt,
-			&o.Widget.ID,
-			&o.Widget.Name,
-			&o.Transaction.ID,
-			&o.Transaction.Amount,
-			&o.Transaction.Currency,
-			&o.Transaction.LastFour,
-			&o.Transaction.ExpiryMonth,
-			&o.Transaction.ExpiryYear,
-			&o.Transaction.PaymentIntent,
-			&o.Transaction.BankReturnCode,
-			&o.Customer.ID,
-			&o.Customer.FirstName,
-			&o.Customer.LastName,
-			&o.Customer.Email,
-		)
-		if err != nil {
-			return nil, 0, 0, err
-		}
-		orders = append(orders, &o)
-	}
-
-	query = `
-		select 
-			count(o.id)
-		from 
-			orders o
-			left join widgets w on (o.widget_id = w.id)
-		where
-			w.is_recurring = 1
-	`
-	var totalRecords int
-	countRow := m.DB.QueryRowContext(ctx, query)
-	err = countRow.Scan(&totalRecords)
+	err = m.attachOrderItems(ctx, orders...)
 	if err != nil {
-		return nil, 0, 0, err
+		return nil, err
 	}
 
-	lastPage := totalRecords / pageSize
-
-	return orders, lastPage, totalRecords, nil
+	return orders, nil
 }
 
 // GetOrderByID gets one order by id and returns the Order
@@ -654,9 +906,9 @@ func (m *DBModel) GetOrderByID(id int) (Order, error) {
 		select
 			o.id, o.widget_id, o.transaction_id, o.customer_id,
 			o.status_id, o.quantity, o.amount, o.created_at, o.updated_at, 
-			w.id, w.name, 
+			w.id, w.name, w.is_recurring, 
 			t.id, t.amount, t.currency, t.last_four, t.expiry_month, 
-			t.expiry_year, t.payment_intent, t.bank_return_code, 
+			t.expiry_year, coalesce(t.payment_intent, ''), t.bank_return_code, 
 			c.id, c.first_name, c.last_name, c.email
 		from
 			orders o
@@ -681,37 +933,32 @@ func (m *DBModel) GetOrderByID(id int) (Order, error) {
 		&o.UpdatedAt,
 		&o.Widget.ID,
 		&o.Widget.Name,
+		&o.Widget.IsRecurring,
 		&o.Transaction.ID,
 		&o.Transaction.Amount,
 		&o.Transaction.Currency,
-		&o.Transaction.LastFour,
-		&o.Transaction.ExpiryMonth,
-		&o.Transaction.ExpiryYear,
+		m.opened(&o.Transaction.LastFour),
+		m.openedInt(&o.Transaction.ExpiryMonth),
+		m.openedInt(&o.Transaction.ExpiryYear),
 		&o.Transaction.PaymentIntent,
 		&o.Transaction.BankReturnCode,
 		&o.Customer.ID,
-		&o.Customer.FirstName,
-		&o.Customer.LastName,
-		&o.Customer.Email,
+		m.opened(&o.Customer.FirstName),
+		m.opened(&o.Customer.LastName),
+		m.opened(&o.Customer.Email),
 	)
 	if err != nil {
 		return o, err
 	}
 
-	return o, nil
-}
+	o.StatusName = OrderStatusName(o.StatusID)
 
-func (m *DBModel) UpdateOrderStatus(id, statusID int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	query := "update orders set status_id = ? where id = ?"
-
-	_, err := m.DB.ExecContext(ctx, query, statusID, id)
+	err = m.attachOrderItems(ctx, &o)
 	if err != nil {
-		return err
+		return o, err
 	}
-	return nil
+
+	return o, nil
 }
 
 // GetAllUsers returns a slice of all users
@@ -723,11 +970,11 @@ func (m *DBModel) GetAllUsers() ([]*User, error) {
 
 	query := `
 		select
-			id, last_name, first_name, email, created_at, updated_at
+			u.id, u.last_name, u.first_name, u.email, u.role, u.created_at, u.updated_at,
+			` + twoFactorColumns + `
 		from
-			users
-		order by
-			last_name, first_name`
+			users u
+			` + twoFactorJoin
 
 	rows, err := m.DB.QueryContext(ctx, query)
 	if err != nil {
@@ -744,17 +991,31 @@ func (m *DBModel) GetAllUsers() ([]*User, error) {
 		var u User
 		err = rows.Scan(
 			&u.ID,
-			&u.LastName,
-			&u.FirstName,
-			&u.Email,
+			m.opened(&u.LastName),
+			m.opened(&u.FirstName),
+			m.opened(&u.Email),
+			&u.Role,
 			&u.CreatedAt,
 			&u.UpdatedAt,
+			&u.TwoFactorEnabled,
+			&u.TwoFactorRequired,
 		)
 		if err != nil {
 			return nil, err
 		}
 		users = append(users, &u)
 	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// names are encrypted, so they are sorted here rather than by the database
+	sort.SliceStable(users, func(i, j int) bool {
+		a := strings.ToLower(users[i].LastName + " " + users[i].FirstName)
+		b := strings.ToLower(users[j].LastName + " " + users[j].FirstName)
+		return a < b
+	})
+
 	return users, nil
 }
 
@@ -767,20 +1028,25 @@ func (m *DBModel) GetOneUser(id int) (User, error) {
 
 	query := `
 		select
-			id, last_name, first_name, email, created_at, updated_at
+			u.id, u.last_name, u.first_name, u.email, u.role, u.created_at, u.updated_at,
+			` + twoFactorColumns + `
 		from
-			users
-		where id = ?`
+			users u
+			` + twoFactorJoin + `
+		where u.id = ?`
 
 	row := m.DB.QueryRowContext(ctx, query, id)
 
 	err := row.Scan(
 		&u.ID,
-		&u.LastName,
-		&u.FirstName,
-		&u.Email,
+		m.opened(&u.LastName),
+		m.opened(&u.FirstName),
+		m.opened(&u.Email),
+		&u.Role,
 		&u.CreatedAt,
 		&u.UpdatedAt,
+		&u.TwoFactorEnabled,
+		&u.TwoFactorRequired,
 	)
 	if err != nil {
 		return u, err
@@ -798,14 +1064,18 @@ func (m *DBModel) EditUser(u User) error {
 			first_name = ?,
 			last_name = ?,
 			email = ?,
+			email_index = ?,
+			role = ?,
 			updated_at = ?
 		where
 			id = ?`
 
 	_, err := m.DB.ExecContext(ctx, stmt,
-		u.FirstName,
-		u.LastName,
-		u.Email,
+		m.sealed(u.FirstName),
+		m.sealed(u.LastName),
+		m.sealed(normalizeEmail(u.Email)),
+		m.emailIndex(u.Email),
+		u.Role,
 		time.Now(),
 		u.ID,
 	)
@@ -816,27 +1086,34 @@ func (m *DBModel) EditUser(u User) error {
 	return nil
 }
 
-// AddUser inserts a user into the database
-func (m *DBModel) AddUser(u User, hash string) error {
+// AddUser inserts a user into the database, and returns its id
+func (m *DBModel) AddUser(u User, hash string) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	stmt := `
-		insert into users (first_name, last_name, email, password, created_at, updated_at)
-		values (?, ?, ?, ?, ?, ?)`
+		insert into users (first_name, last_name, email, email_index, role, password, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?)`
 
-	_, err := m.DB.ExecContext(ctx, stmt,
-		u.FirstName,
-		u.LastName,
-		u.Email,
+	result, err := m.DB.ExecContext(ctx, stmt,
+		m.sealed(u.FirstName),
+		m.sealed(u.LastName),
+		m.sealed(normalizeEmail(u.Email)),
+		m.emailIndex(u.Email),
+		u.Role,
 		hash,
 		time.Now(),
 		time.Now(),
 	)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
 }
 
 // DeleteUser deletes a user by id
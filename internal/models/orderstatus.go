@@ -0,0 +1,296 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Order statuses, matching the rows of the statuses table
+const (
+	OrderStatusPaid              = 1
+	OrderStatusRefunded          = 2
+	OrderStatusCancelled         = 3
+	OrderStatusFulfilled         = 5
+	OrderStatusShipped           = 6
+	OrderStatusDelivered         = 7
+	OrderStatusPartiallyRefunded = 8
+	OrderStatusPaused            = 9
+	OrderStatusCancelling        = 10
+)
+
+// orderStatusNames are the names of the order statuses
+var orderStatusNames = map[int]string{
+	OrderStatusPaid:              "Paid",
+	OrderStatusRefunded:          "Refunded",
+	OrderStatusCancelled:         "Cancelled",
+	OrderStatusFulfilled:         "Fulfilled",
+	OrderStatusShipped:           "Shipped",
+	OrderStatusDelivered:         "Delivered",
+	OrderStatusPartiallyRefunded: "Partially refunded",
+	OrderStatusPaused:            "Paused",
+	OrderStatusCancelling:        "Cancelling",
+}
+
+// oneOffStatusTransitions is every status an order for one-off widgets may move to from each
+// status. They are fulfilled, shipped and delivered in turn. Refunded and cancelled orders are
+// finished, and cannot change again. Only partial refunds may repeat
+var oneOffStatusTransitions = map[int][]int{
+	OrderStatusPaid: {
+		OrderStatusFulfilled, OrderStatusRefunded, OrderStatusPartiallyRefunded, OrderStatusCancelled,
+	},
+	OrderStatusFulfilled:         {OrderStatusShipped, OrderStatusRefunded, OrderStatusPartiallyRefunded},
+	OrderStatusShipped:           {OrderStatusDelivered, OrderStatusRefunded, OrderStatusPartiallyRefunded},
+	OrderStatusDelivered:         {OrderStatusRefunded, OrderStatusPartiallyRefunded},
+	OrderStatusPartiallyRefunded: {OrderStatusPartiallyRefunded, OrderStatusRefunded},
+}
+
+// recurringStatusTransitions is every status an order for a subscription may move to from each
+// status. Subscriptions are never shipped, but may be paused, and a cancelling subscription runs to
+// the end of its billing period, and can be reactivated until then
+var recurringStatusTransitions = map[int][]int{
+	OrderStatusPaid: {
+		OrderStatusRefunded, OrderStatusPartiallyRefunded, OrderStatusCancelled, OrderStatusPaused,
+		OrderStatusCancelling,
+	},
+	OrderStatusPartiallyRefunded: {OrderStatusPartiallyRefunded, OrderStatusRefunded},
+	OrderStatusPaused:            {OrderStatusPaid, OrderStatusCancelling, OrderStatusCancelled},
+	OrderStatusCancelling:        {OrderStatusPaid, OrderStatusCancelled},
+}
+
+// ErrInvalidTransition is returned for an order status change the transition table does not allow
+var ErrInvalidTransition = errors.New("invalid order status change")
+
+// OrderStatusName returns the name of an order status
+func OrderStatusName(statusID int) string {
+	name, ok := orderStatusNames[statusID]
+	if !ok {
+		return "Unknown"
+	}
+	return name
+}
+
+// CanChangeOrderStatus reports whether an order, for a subscription if recurring is set, may move
+// from one status to another
+func CanChangeOrderStatus(recurring bool, from, to int) bool {
+	for _, next := range NextOrderStatuses(recurring, from) {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOrderStatuses returns the statuses an order, for a subscription if recurring is set, may
+// move to from statusID
+func NextOrderStatuses(recurring bool, statusID int) []int {
+	if recurring {
+		return recurringStatusTransitions[statusID]
+	}
+	return oneOffStatusTransitions[statusID]
+}
+
+// OrderStatusChange is one entry in the status history of an order. FromStatusID is zero for the
+// status the order was created with, and UserID is zero for changes made by checkout or webhooks
+type OrderStatusChange struct {
+	ID           int       `json:"id"`
+	OrderID      int       `json:"order_id"`
+	FromStatusID int       `json:"from_status_id"`
+	FromStatus   string    `json:"from_status"`
+	ToStatusID   int       `json:"to_status_id"`
+	ToStatus     string    `json:"to_status"`
+	UserID       int       `json:"user_id"`
+	UserName     string    `json:"user_name"`
+	Note         string    `json:"note"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// nullIfZero returns nil for zero, so optional ids are stored as null
+func nullIfZero(n int) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+// insertOrderStatusChange records a status change in the order's history
+func insertOrderStatusChange(ctx context.Context, db execer, orderID, from, to, userID int, note string) error {
+	stmt := `
+		insert into order_status_history
+			(order_id, from_status_id, to_status_id, user_id, note, created_at)
+		values (?, ?, ?, ?, ?, ?)`
+
+	_, err := db.ExecContext(ctx, stmt, orderID, nullIfZero(from), to, nullIfZero(userID), note, time.Now())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// lockOrderStatus returns the status of an order, and whether it is for a subscription, locking the
+// order's row inside tx
+func lockOrderStatus(ctx context.Context, tx *sql.Tx, orderID int) (int, bool, error) {
+	query := `
+		select
+			o.status_id, w.is_recurring
+		from
+			orders o
+			inner join widgets w on (o.widget_id = w.id)
+		where
+			o.id = ?
+		for update`
+
+	var statusID int
+	var recurring bool
+	err := tx.QueryRowContext(ctx, query, orderID).Scan(&statusID, &recurring)
+	return statusID, recurring, err
+}
+
+// changeOrderStatus moves an order to a new status inside tx, if the transition table for its kind
+// of order allows it, and records the change in its history
+func changeOrderStatus(ctx context.Context, tx *sql.Tx, orderID int, recurring bool, from, to, userID int, note string) error {
+	if !CanChangeOrderStatus(recurring, from, to) {
+		return fmt.Errorf("%w from %s to %s", ErrInvalidTransition, OrderStatusName(from), OrderStatusName(to))
+	}
+
+	stmt := `update orders set status_id = ?, updated_at = ? where id = ?`
+
+	_, err := tx.ExecContext(ctx, stmt, to, time.Now(), orderID)
+	if err != nil {
+		return err
+	}
+
+	return insertOrderStatusChange(ctx, tx, orderID, from, to, userID, note)
+}
+
+// UpdateOrderStatus moves an order to a new status, on behalf of userID. It returns
+// ErrInvalidTransition if the order cannot move to that status from the one it is in
+func (m *DBModel) UpdateOrderStatus(id, statusID, userID int, note string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		from, recurring, err := lockOrderStatus(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		return changeOrderStatus(ctx, tx, id, recurring, from, statusID, userID, note)
+	})
+}
+
+// UpdateOrderStatusByPaymentIntentTx moves every order paid for by a payment intent (or, for
+// subscriptions, a subscription id) to a new status inside tx. The payment provider is the source of
+// truth, so orders already in that status, or which cannot move to it, are left as they are rather
+// than failing the webhook
+func (m *DBModel) UpdateOrderStatusByPaymentIntentTx(ctx context.Context, tx *sql.Tx, pi string, statusID int) error {
+	query := `
+		select
+			o.id, o.status_id, w.is_recurring
+		from
+			orders o
+			inner join transactions t on (o.transaction_id = t.id)
+			inner join widgets w on (o.widget_id = w.id)
+		where
+			t.payment_intent = ?
+		for update`
+
+	rows, err := tx.QueryContext(ctx, query, pi)
+	if err != nil {
+		return err
+	}
+
+	type orderStatus struct {
+		id, statusID int
+		recurring    bool
+	}
+	var orders []orderStatus
+	for rows.Next() {
+		var o orderStatus
+		err = rows.Scan(&o.id, &o.statusID, &o.recurring)
+		if err != nil {
+			_ = rows.Close()
+			return err
+		}
+		orders = append(orders, o)
+	}
+	err = rows.Err()
+	_ = rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, o := range orders {
+		if o.statusID == statusID || !CanChangeOrderStatus(o.recurring, o.statusID, statusID) {
+			continue
+		}
+
+		err = changeOrderStatus(ctx, tx, o.id, o.recurring, o.statusID, statusID, 0, "payment provider")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetOrderStatusHistory returns the status history of an order, oldest first
+func (m *DBModel) GetOrderStatusHistory(orderID int) ([]*OrderStatusChange, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var history []*OrderStatusChange
+
+	query := `
+		select
+			h.id, h.order_id, coalesce(h.from_status_id, 0), h.to_status_id, coalesce(h.user_id, 0),
+			u.first_name, u.last_name, h.note, h.created_at
+		from
+			order_status_history h
+			left join users u on (h.user_id = u.id)
+		where
+			h.order_id = ?
+		order by
+			h.created_at, h.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var c OrderStatusChange
+		var firstName, lastName string
+		err = rows.Scan(
+			&c.ID,
+			&c.OrderID,
+			&c.FromStatusID,
+			&c.ToStatusID,
+			&c.UserID,
+			m.opened(&firstName),
+			m.opened(&lastName),
+			&c.Note,
+			&c.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		c.UserName = strings.TrimSpace(firstName + " " + lastName)
+		if c.FromStatusID > 0 {
+			c.FromStatus = OrderStatusName(c.FromStatusID)
+		}
+		c.ToStatus = OrderStatusName(c.ToStatusID)
+		history = append(history, &c)
+	}
+
+	return history, rows.Err()
+}
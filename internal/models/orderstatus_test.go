@@ -0,0 +1,65 @@
+package models
+
+import "testing"
+
+func TestCanChangeOrderStatus(t *testing.T) {
+	var tests = []struct {
+		name      string
+		recurring bool
+		from      int
+		to        int
+		want      bool
+	}{
+		{"fulfil", false, OrderStatusPaid, OrderStatusFulfilled, true},
+		{"ship", false, OrderStatusFulfilled, OrderStatusShipped, true},
+		{"deliver", false, OrderStatusShipped, OrderStatusDelivered, true},
+		{"refund", false, OrderStatusPaid, OrderStatusRefunded, true},
+		{"refund delivered", false, OrderStatusDelivered, OrderStatusRefunded, true},
+		{"second partial refund", false, OrderStatusPartiallyRefunded, OrderStatusPartiallyRefunded, true},
+		{"cancel refunded", false, OrderStatusRefunded, OrderStatusCancelled, false},
+		{"refund cancelled", false, OrderStatusCancelled, OrderStatusRefunded, false},
+		{"refund twice", false, OrderStatusRefunded, OrderStatusRefunded, false},
+		{"skip shipping", false, OrderStatusPaid, OrderStatusDelivered, false},
+		{"go backwards", false, OrderStatusShipped, OrderStatusFulfilled, false},
+		{"cancel shipped", false, OrderStatusShipped, OrderStatusCancelled, false},
+		{"pause one-off order", false, OrderStatusPaid, OrderStatusPaused, false},
+		{"schedule one-off cancellation", false, OrderStatusPaid, OrderStatusCancelling, false},
+		{"fulfil subscription", true, OrderStatusPaid, OrderStatusFulfilled, false},
+		{"ship subscription", true, OrderStatusFulfilled, OrderStatusShipped, false},
+		{"refund subscription", true, OrderStatusPaid, OrderStatusRefunded, true},
+		{"cancel subscription", true, OrderStatusPaid, OrderStatusCancelled, true},
+		{"pause subscription", true, OrderStatusPaid, OrderStatusPaused, true},
+		{"resume subscription", true, OrderStatusPaused, OrderStatusPaid, true},
+		{"schedule cancellation", true, OrderStatusPaid, OrderStatusCancelling, true},
+		{"reactivate subscription", true, OrderStatusCancelling, OrderStatusPaid, true},
+		{"cancel at period end", true, OrderStatusCancelling, OrderStatusCancelled, true},
+		{"pause cancelling", true, OrderStatusCancelling, OrderStatusPaused, false},
+		{"reactivate cancelled", true, OrderStatusCancelled, OrderStatusPaid, false},
+		{"unknown status", false, 99, OrderStatusPaid, false},
+	}
+
+	for _, e := range tests {
+		if got := CanChangeOrderStatus(e.recurring, e.from, e.to); got != e.want {
+			t.Errorf("%s: expected %v, got %v", e.name, e.want, got)
+		}
+	}
+}
+
+func TestOrderStatusNames(t *testing.T) {
+	for _, transitions := range []map[int][]int{oneOffStatusTransitions, recurringStatusTransitions} {
+		for from, next := range transitions {
+			if OrderStatusName(from) == "Unknown" {
+				t.Errorf("status %d has no name", from)
+			}
+			for _, to := range next {
+				if OrderStatusName(to) == "Unknown" {
+					t.Errorf("status %d has no name", to)
+				}
+			}
+		}
+	}
+
+	if OrderStatusName(99) != "Unknown" {
+		t.Error("expected unknown statuses to be named Unknown")
+	}
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// PaymentReview is the type for payments that were taken but could not be recorded as an order,
+// and could not be refunded automatically, so need to be looked at by a person
+type PaymentReview struct {
+	ID            int       `json:"id"`
+	PaymentIntent string    `json:"payment_intent"`
+	Amount        int       `json:"amount"`
+	Currency      string    `json:"currency"`
+	Email         string    `json:"email"`
+	Reason        string    `json:"reason"`
+	CreatedAt     time.Time `json:"-"`
+	UpdatedAt     time.Time `json:"-"`
+}
+
+// InsertPaymentReview flags a payment for manual review
+func (m *DBModel) InsertPaymentReview(p PaymentReview) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		insert into payment_reviews
+			(payment_intent, amount, currency, email, reason, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?)`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		p.PaymentIntent,
+		p.Amount,
+		p.Currency,
+		m.sealed(p.Email),
+		p.Reason,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
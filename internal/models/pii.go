@@ -0,0 +1,115 @@
+package models
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"goEcommerce/internal/encryption"
+	"strconv"
+	"strings"
+)
+
+// Personal data (customer and user names and emails, and card details) is encrypted in the
+// database with DBModel.Keyring. Queries pass values through sealed on the way in and opened on
+// the way out, so callers only ever see plain text. Emails also get a blind index, made with
+// DBModel.IndexKey, so they can still be looked up
+
+// sealedValue encrypts a value as it is written to the database
+type sealedValue struct {
+	k    *encryption.Keyring
+	text string
+}
+
+// Value implements driver.Valuer
+func (v sealedValue) Value() (driver.Value, error) {
+	return v.k.Encrypt(v.text)
+}
+
+// sealed returns text, to be encrypted as it is written
+func (m *DBModel) sealed(text string) driver.Valuer {
+	return sealedValue{k: m.Keyring, text: text}
+}
+
+// sealedInt returns n, to be encrypted as it is written
+func (m *DBModel) sealedInt(n int) driver.Valuer {
+	return m.sealed(strconv.Itoa(n))
+}
+
+// openedValue decrypts a value as it is scanned from the database
+type openedValue struct {
+	k    *encryption.Keyring
+	dest *string
+}
+
+// Scan implements sql.Scanner. Values written before their column was encrypted have no key id,
+// and are read as they are until "migrate reencrypt" has encrypted them. A null, from an outer
+// join, is read as an empty string
+func (v openedValue) Scan(src interface{}) error {
+	var text string
+
+	switch s := src.(type) {
+	case nil:
+		*v.dest = ""
+		return nil
+	case []byte:
+		text = string(s)
+	case string:
+		text = s
+	case int64:
+		text = strconv.FormatInt(s, 10)
+	default:
+		return fmt.Errorf("cannot decrypt %T", src)
+	}
+
+	if _, err := encryption.KeyID(text); err != nil {
+		*v.dest = text
+		return nil
+	}
+
+	plainText, err := v.k.Decrypt(text)
+	if err != nil {
+		return err
+	}
+	*v.dest = plainText
+	return nil
+}
+
+// openedInt decrypts a number as it is scanned from the database
+type openedInt struct {
+	k    *encryption.Keyring
+	dest *int
+}
+
+// Scan implements sql.Scanner
+func (v openedInt) Scan(src interface{}) error {
+	var text string
+
+	err := openedValue{k: v.k, dest: &text}.Scan(src)
+	if err != nil || text == "" {
+		*v.dest = 0
+		return err
+	}
+
+	*v.dest, err = strconv.Atoi(text)
+	return err
+}
+
+// opened returns a scan destination which decrypts into dest
+func (m *DBModel) opened(dest *string) sql.Scanner {
+	return openedValue{k: m.Keyring, dest: dest}
+}
+
+// openedInt returns a scan destination which decrypts a number into dest
+func (m *DBModel) openedInt(dest *int) sql.Scanner {
+	return openedInt{k: m.Keyring, dest: dest}
+}
+
+// normalizeEmail is the form emails are compared in
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// emailIndex returns the blind index of an email
+func (m *DBModel) emailIndex(email string) []byte {
+	return encryption.BlindIndex(m.IndexKey, normalizeEmail(email))
+}
@@ -0,0 +1,119 @@
+package models
+
+import (
+	"bytes"
+	"goEcommerce/internal/encryption"
+	"strings"
+	"testing"
+)
+
+func testModel(t *testing.T) *DBModel {
+	t.Helper()
+
+	keyring, err := encryption.New("test:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &DBModel{Keyring: keyring, IndexKey: []byte("a test index key of 32 bytes!!!!")}
+}
+
+func TestSealedAndOpened(t *testing.T) {
+	m := testModel(t)
+
+	stored, err := m.sealed("Jane").Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored.(string), "test:") {
+		t.Fatalf("expected an encrypted value, got %v", stored)
+	}
+
+	var tests = []struct {
+		name string
+		src  interface{}
+		want string
+	}{
+		{"encrypted", stored, "Jane"},
+		{"encrypted bytes", []byte(stored.(string)), "Jane"},
+		{"written before encryption", []byte("John"), "John"},
+		{"outer join null", nil, ""},
+	}
+
+	for _, e := range tests {
+		var got string
+		err := m.opened(&got).Scan(e.src)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		}
+		if got != e.want {
+			t.Errorf("%s: expected %q, got %q", e.name, e.want, got)
+		}
+	}
+
+	var s string
+	err = m.opened(&s).Scan("gone:AAAA")
+	if err == nil {
+		t.Error("expected an error for a value encrypted with an unknown key")
+	}
+}
+
+func TestSealedIntAndOpenedInt(t *testing.T) {
+	m := testModel(t)
+
+	stored, err := m.sealedInt(2031).Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name string
+		src  interface{}
+		want int
+	}{
+		{"encrypted", stored, 2031},
+		{"written before encryption", []byte("12"), 12},
+		{"int column", int64(7), 7},
+		{"outer join null", nil, 0},
+	}
+
+	for _, e := range tests {
+		var got int
+		err := m.openedInt(&got).Scan(e.src)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		}
+		if got != e.want {
+			t.Errorf("%s: expected %d, got %d", e.name, e.want, got)
+		}
+	}
+}
+
+func TestEmailIndex(t *testing.T) {
+	m := testModel(t)
+
+	if !bytes.Equal(m.emailIndex("Me@Here.com "), m.emailIndex("me@here.com")) {
+		t.Error("expected emails to be indexed case and space insensitively")
+	}
+	if bytes.Equal(m.emailIndex("me@here.com"), m.emailIndex("you@here.com")) {
+		t.Error("expected different emails to have different indexes")
+	}
+}
+
+func TestReEncryptValue(t *testing.T) {
+	m := testModel(t)
+
+	encrypted, changed, err := reEncryptValue(m.Keyring, "John", true)
+	if err != nil || !changed || !strings.HasPrefix(encrypted, "test:") {
+		t.Errorf("expected plain text to be encrypted, got %q %v %v", encrypted, changed, err)
+	}
+
+	same, changed, err := reEncryptValue(m.Keyring, encrypted, true)
+	if err != nil || changed || same != encrypted {
+		t.Errorf("expected a value on the active key to be left alone, got %v %v", changed, err)
+	}
+
+	_, _, err = reEncryptValue(m.Keyring, "not encrypted", false)
+	if err == nil {
+		t.Error("expected plain text in an encrypted only column to be refused")
+	}
+}
@@ -0,0 +1,171 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"goEcommerce/internal/encryption"
+	"time"
+)
+
+// encryptedColumn is a column holding values encrypted with the application keyring, in a table
+// with an id primary key. Values in a plaintext column which have no key id were written before
+// the column was encrypted
+type encryptedColumn struct {
+	table     string
+	column    string
+	plaintext bool
+}
+
+// encryptedColumns lists every column ReEncrypt moves to the active key
+var encryptedColumns = []encryptedColumn{
+	{"users", "totp_secret", false},
+	{"users", "first_name", true},
+	{"users", "last_name", true},
+	{"users", "email", true},
+	{"customers", "first_name", true},
+	{"customers", "last_name", true},
+	{"customers", "email", true},
+	{"transactions", "last_four", true},
+	{"transactions", "expiry_month", true},
+	{"transactions", "expiry_year", true},
+	{"payment_reviews", "email", true},
+}
+
+// emailIndexedTables lists the tables with an email_index blind index of their email column
+var emailIndexedTables = []string{"users", "customers"}
+
+// ReEncrypt moves every encrypted value in the database to the active key of the keyring, after a key has
+// been rotated, and returns how many values it changed. Personal data written before it was
+// encrypted is encrypted, and given its blind index. It can be run while the applications are
+// up, since a value is only replaced if it has not changed since it was read
+func (m *DBModel) ReEncrypt() (int, error) {
+	// emails are indexed first, since until then they are looked up by their plain text
+	for _, table := range emailIndexedTables {
+		err := m.indexEmails(table)
+		if err != nil {
+			return 0, fmt.Errorf("%s.email_index: %w", table, err)
+		}
+	}
+
+	total := 0
+	for _, c := range encryptedColumns {
+		n, err := m.reEncryptColumn(c)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("%s.%s: %w", c.table, c.column, err)
+		}
+	}
+	return total, nil
+}
+
+// reEncryptColumn moves the values in one column to the active key
+func (m *DBModel) reEncryptColumn(c encryptedColumn) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	// the table and column names come from encryptedColumns, never from input
+	query := fmt.Sprintf("select id, %s from %s where %s <> '' and %s not like ?", c.column, c.table, c.column, c.column)
+
+	rows, err := m.DB.QueryContext(ctx, query, m.Keyring.ActiveKey()+":%")
+	if err != nil {
+		return 0, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	type value struct {
+		id   int
+		text string
+	}
+
+	var values []value
+	for rows.Next() {
+		var v value
+		err = rows.Scan(&v.id, &v.text)
+		if err != nil {
+			return 0, err
+		}
+		values = append(values, v)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	stmt := fmt.Sprintf("update %s set %s = ? where id = ? and %s = ?", c.table, c.column, c.column)
+
+	changed := 0
+	for _, v := range values {
+		reEncrypted, ok, err := reEncryptValue(m.Keyring, v.text, c.plaintext)
+		if err != nil {
+			return changed, fmt.Errorf("id %d: %w", v.id, err)
+		}
+		if !ok {
+			continue
+		}
+
+		_, err = m.DB.ExecContext(ctx, stmt, reEncrypted, v.id, v.text)
+		if err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// reEncryptValue moves one stored value to the active key. Values without a key id in a plaintext
+// column are encrypted for the first time
+func reEncryptValue(k *encryption.Keyring, text string, plaintext bool) (string, bool, error) {
+	if _, err := encryption.KeyID(text); err != nil && plaintext {
+		encrypted, err := k.Encrypt(text)
+		if err != nil {
+			return "", false, err
+		}
+		return encrypted, true, nil
+	}
+	return k.ReEncrypt(text)
+}
+
+// indexEmails sets the blind index of every email in table which does not have one yet
+func (m *DBModel) indexEmails(table string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, fmt.Sprintf("select id, email from %s where email_index is null", table))
+	if err != nil {
+		return err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	emails := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var email string
+		err = rows.Scan(&id, m.opened(&email))
+		if err != nil {
+			return fmt.Errorf("id %d: %w", id, err)
+		}
+		emails[id] = email
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	stmt := fmt.Sprintf("update %s set email_index = ? where id = ? and email_index is null", table)
+	for id, email := range emails {
+		_, err = m.DB.ExecContext(ctx, stmt, m.emailIndex(email), id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Refund is money returned to a customer against a transaction. A transaction may be refunded in
+// several parts, up to the amount that was captured. UserID is zero for refunds made outside the
+// admin area, which the payment provider tells us about through webhooks
+type Refund struct {
+	ID             int       `json:"id"`
+	TransactionID  int       `json:"transaction_id"`
+	OrderID        int       `json:"order_id"`
+	Amount         int       `json:"amount"`
+	Reason         string    `json:"reason"`
+	StripeRefundID string    `json:"stripe_refund_id"`
+	UserID         int       `json:"user_id"`
+	UserName       string    `json:"user_name"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// ErrRefundTooLarge is returned for a refund of more than is left to refund on a transaction
+var ErrRefundTooLarge = errors.New("refund amount is more than is left to refund")
+
+// RefundableAmount returns how much of a captured amount is left to refund, once refunded has been
+// refunded
+func RefundableAmount(captured, refunded int) int {
+	if refunded >= captured {
+		return 0
+	}
+	return captured - refunded
+}
+
+// TotalRefunded returns the sum of refunds
+func TotalRefunded(refunds []*Refund) int {
+	total := 0
+	for _, r := range refunds {
+		total += r.Amount
+	}
+	return total
+}
+
+// RefundStatuses returns the order and transaction status for a transaction once refunded of
+// captured has been refunded
+func RefundStatuses(captured, refunded int) (orderStatusID, transactionStatusID int) {
+	if RefundableAmount(captured, refunded) == 0 {
+		return OrderStatusRefunded, TransactionStatusRefunded
+	}
+	return OrderStatusPartiallyRefunded, TransactionStatusPartiallyRefunded
+}
+
+// refundedAmount returns the amount refunded so far on a transaction
+func refundedAmount(ctx context.Context, db execer, transactionID int) (int, error) {
+	var refunded int
+	row := db.QueryRowContext(ctx, `select coalesce(sum(amount), 0) from refunds where transaction_id = ?`, transactionID)
+	err := row.Scan(&refunded)
+	if err != nil {
+		return 0, err
+	}
+	return refunded, nil
+}
+
+// insertRefund adds a refund inside tx, and returns its id
+func insertRefund(ctx context.Context, tx *sql.Tx, r Refund) (int, error) {
+	var stripeRefundID interface{}
+	if r.StripeRefundID != "" {
+		stripeRefundID = r.StripeRefundID
+	}
+
+	stmt := `
+		insert into refunds
+			(transaction_id, order_id, amount, reason, stripe_refund_id, user_id, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := tx.ExecContext(ctx, stmt,
+		r.TransactionID,
+		nullIfZero(r.OrderID),
+		r.Amount,
+		r.Reason,
+		stripeRefundID,
+		nullIfZero(r.UserID),
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// RecordRefund records a refund of an order, made with the payment provider as refund r, and moves the
+// order and its transaction to refunded or partially refunded. It returns ErrRefundTooLarge if the
+// refund is for more than is left to refund, and the refund's id and the order's new status otherwise.
+// The provider's webhook may have recorded the refund already; if so it is only credited to r's user
+// and reason
+func (m *DBModel) RecordRefund(r Refund) (int, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var refundID, statusID int
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		var from, captured int
+		var recurring bool
+		query := `
+			select
+				o.status_id, o.transaction_id, t.amount, w.is_recurring
+			from
+				orders o
+				inner join transactions t on (o.transaction_id = t.id)
+				inner join widgets w on (o.widget_id = w.id)
+			where
+				o.id = ?
+			for update`
+
+		row := tx.QueryRowContext(ctx, query, r.OrderID)
+		err := row.Scan(&from, &r.TransactionID, &captured, &recurring)
+		if err != nil {
+			return err
+		}
+
+		if r.StripeRefundID != "" {
+			row = tx.QueryRowContext(ctx, `select id from refunds where stripe_refund_id = ?`, r.StripeRefundID)
+			err = row.Scan(&refundID)
+			if err == nil {
+				statusID = from
+				stmt := `update refunds set user_id = ?, reason = ?, updated_at = ? where id = ?`
+				_, err = tx.ExecContext(ctx, stmt, nullIfZero(r.UserID), r.Reason, time.Now(), refundID)
+				return err
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		}
+
+		refunded, err := refundedAmount(ctx, tx, r.TransactionID)
+		if err != nil {
+			return err
+		}
+		if r.Amount <= 0 || r.Amount > RefundableAmount(captured, refunded) {
+			return ErrRefundTooLarge
+		}
+
+		refundID, err = insertRefund(ctx, tx, r)
+		if err != nil {
+			return err
+		}
+
+		var transactionStatusID int
+		statusID, transactionStatusID = RefundStatuses(captured, refunded+r.Amount)
+
+		stmt := `update transactions set transaction_status_id = ?, updated_at = ? where id = ?`
+		_, err = tx.ExecContext(ctx, stmt, transactionStatusID, time.Now(), r.TransactionID)
+		if err != nil {
+			return err
+		}
+
+		return changeOrderStatus(ctx, tx, r.OrderID, recurring, from, statusID, r.UserID, r.Reason)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return refundID, statusID, nil
+}
+
+// RecordProviderRefundTx records a refund the payment provider made against a payment intent inside
+// tx, unless it has been recorded already. Refunds of payment intents with no transaction, such as
+// subscription invoices, are ignored
+func (m *DBModel) RecordProviderRefundTx(ctx context.Context, tx *sql.Tx, pi string, r Refund) error {
+	// locking the order as RecordRefund does means the two cannot both record the same refund
+	query := `
+		select
+			t.id, coalesce(o.id, 0)
+		from
+			transactions t
+			left join orders o on (o.transaction_id = t.id)
+		where
+			t.payment_intent = ?
+		order by
+			o.id
+		limit 1
+		for update`
+
+	row := tx.QueryRowContext(ctx, query, pi)
+	err := row.Scan(&r.TransactionID, &r.OrderID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var exists int
+	row = tx.QueryRowContext(ctx, `select count(id) from refunds where stripe_refund_id = ?`, r.StripeRefundID)
+	err = row.Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists > 0 {
+		return nil
+	}
+
+	_, err = insertRefund(ctx, tx, r)
+	return err
+}
+
+// GetRefundsForOrder returns the refunds of the transaction that paid for an order, oldest first
+func (m *DBModel) GetRefundsForOrder(orderID int) ([]*Refund, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var refunds []*Refund
+
+	query := `
+		select
+			r.id, r.transaction_id, coalesce(r.order_id, 0), r.amount, r.reason,
+			coalesce(r.stripe_refund_id, ''), coalesce(r.user_id, 0), u.first_name, u.last_name,
+			r.created_at
+		from
+			refunds r
+			inner join orders o on (r.transaction_id = o.transaction_id)
+			left join users u on (r.user_id = u.id)
+		where
+			o.id = ?
+		order by
+			r.created_at, r.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var r Refund
+		var firstName, lastName string
+		err = rows.Scan(
+			&r.ID,
+			&r.TransactionID,
+			&r.OrderID,
+			&r.Amount,
+			&r.Reason,
+			&r.StripeRefundID,
+			&r.UserID,
+			m.opened(&firstName),
+			m.opened(&lastName),
+			&r.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		r.UserName = strings.TrimSpace(firstName + " " + lastName)
+		refunds = append(refunds, &r)
+	}
+
+	return refunds, rows.Err()
+}
@@ -0,0 +1,49 @@
+package models
+
+import "testing"
+
+func TestRefundableAmount(t *testing.T) {
+	var tests = []struct {
+		name     string
+		captured int
+		refunded int
+		want     int
+	}{
+		{"nothing refunded", 1000, 0, 1000},
+		{"partly refunded", 1000, 400, 600},
+		{"fully refunded", 1000, 1000, 0},
+		{"over refunded", 1000, 1200, 0},
+	}
+
+	for _, e := range tests {
+		if got := RefundableAmount(e.captured, e.refunded); got != e.want {
+			t.Errorf("%s: expected %d, got %d", e.name, e.want, got)
+		}
+	}
+}
+
+func TestRefundStatuses(t *testing.T) {
+	var tests = []struct {
+		name            string
+		refunds         []*Refund
+		wantOrder       int
+		wantTransaction int
+	}{
+		{"one partial refund", []*Refund{{Amount: 400}}, OrderStatusPartiallyRefunded, TransactionStatusPartiallyRefunded},
+		{"two partial refunds", []*Refund{{Amount: 400}, {Amount: 300}}, OrderStatusPartiallyRefunded, TransactionStatusPartiallyRefunded},
+		{"partial refunds adding up", []*Refund{{Amount: 400}, {Amount: 600}}, OrderStatusRefunded, TransactionStatusRefunded},
+		{"full refund", []*Refund{{Amount: 1000}}, OrderStatusRefunded, TransactionStatusRefunded},
+	}
+
+	for _, e := range tests {
+		order, transaction := RefundStatuses(1000, TotalRefunded(e.refunds))
+		if order != e.wantOrder || transaction != e.wantTransaction {
+			t.Errorf("%s: expected statuses %d and %d, got %d and %d", e.name, e.wantOrder, e.wantTransaction, order, transaction)
+		}
+		for _, recurring := range []bool{false, true} {
+			if !CanChangeOrderStatus(recurring, OrderStatusPaid, order) {
+				t.Errorf("%s: a paid order cannot move to %s", e.name, OrderStatusName(order))
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package models
+
+// Role is the role of an admin user, which decides what they are allowed to do
+type Role string
+
+const (
+	RoleOwner    Role = "owner"
+	RoleFinance  Role = "finance"
+	RoleSupport  Role = "support"
+	RoleReadOnly Role = "read-only"
+)
+
+// Roles lists every role, most powerful first
+var Roles = []Role{RoleOwner, RoleFinance, RoleSupport, RoleReadOnly}
+
+// Permission is something an admin user may be allowed to do
+type Permission string
+
+const (
+	PermViewSales           Permission = "sales:view"
+	PermRefund              Permission = "sales:refund"
+	PermFulfilOrders        Permission = "orders:fulfil"
+	PermCancelSubscriptions Permission = "subscriptions:cancel"
+	PermChangePlans         Permission = "subscriptions:change-plan"
+	PermVirtualTerminal     Permission = "terminal:charge"
+	PermViewWidgets         Permission = "widgets:view"
+	PermManageWidgets       Permission = "widgets:manage"
+	PermViewUsers           Permission = "users:view"
+	PermManageUsers         Permission = "users:manage"
+	PermManageAPIKeys       Permission = "api-keys:manage"
+	PermViewAuditLog        Permission = "audit:view"
+)
+
+// rolePermissions is what each role may do. Owners may do everything
+var rolePermissions = map[Role][]Permission{
+	RoleFinance: {
+		PermViewSales, PermRefund, PermFulfilOrders, PermCancelSubscriptions, PermChangePlans, PermVirtualTerminal,
+		PermViewWidgets, PermViewUsers,
+	},
+	RoleSupport: {
+		PermViewSales, PermFulfilOrders, PermCancelSubscriptions, PermViewWidgets, PermViewUsers,
+	},
+	RoleReadOnly: {
+		PermViewSales, PermViewWidgets, PermViewUsers,
+	},
+}
+
+// Can reports whether u has permission p. Requests made with an api key are limited to both the
+// role of the user who created the key and the key's scopes
+func (u *User) Can(p Permission) bool {
+	if !u.Role.Can(p) {
+		return false
+	}
+	return u.APIKey == nil || u.APIKey.Allows(p)
+}
+
+// Valid reports whether r is a known role
+func (r Role) Valid() bool {
+	for _, role := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether r has permission p
+func (r Role) Can(p Permission) bool {
+	if r == RoleOwner {
+		return true
+	}
+	for _, perm := range rolePermissions[r] {
+		if perm == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package models
+
+import "testing"
+
+func TestRole_Can(t *testing.T) {
+	var tests = []struct {
+		role Role
+		perm Permission
+		want bool
+	}{
+		{RoleOwner, PermManageUsers, true},
+		{RoleOwner, PermRefund, true},
+		{RoleFinance, PermRefund, true},
+		{RoleFinance, PermManageUsers, false},
+		{RoleSupport, PermViewSales, true},
+		{RoleSupport, PermRefund, false},
+		{RoleSupport, PermManageUsers, false},
+		{RoleReadOnly, PermViewSales, true},
+		{RoleReadOnly, PermCancelSubscriptions, false},
+		{RoleFinance, PermChangePlans, true},
+		{RoleSupport, PermChangePlans, false},
+		{RoleOwner, PermViewAuditLog, true},
+		{RoleFinance, PermViewAuditLog, false},
+		{Role("admin"), PermViewSales, false},
+		{Role(""), PermViewSales, false},
+	}
+
+	for _, e := range tests {
+		if got := e.role.Can(e.perm); got != e.want {
+			t.Errorf("%q can %q: expected %v, got %v", e.role, e.perm, e.want, got)
+		}
+	}
+}
+
+func TestRole_Valid(t *testing.T) {
+	for _, role := range Roles {
+		if !role.Valid() {
+			t.Errorf("%q should be valid", role)
+		}
+	}
+	if Role("admin").Valid() {
+		t.Error("unknown roles should not be valid")
+	}
+}
+
+func TestUser_Can(t *testing.T) {
+	readOrders := &APIKey{Scopes: []APIKeyScope{ScopeReadOrders}}
+
+	var tests = []struct {
+		name string
+		user User
+		perm Permission
+		want bool
+	}{
+		{"owner without key", User{Role: RoleOwner}, PermRefund, true},
+		{"owner key in scope", User{Role: RoleOwner, APIKey: readOrders}, PermViewSales, true},
+		{"owner key out of scope", User{Role: RoleOwner, APIKey: readOrders}, PermRefund, false},
+		{"key never manages users", User{Role: RoleOwner, APIKey: readOrders}, PermManageUsers, false},
+		{"scope beyond role", User{Role: RoleSupport, APIKey: &APIKey{Scopes: []APIKeyScope{ScopeWriteRefunds}}}, PermRefund, false},
+	}
+
+	for _, e := range tests {
+		if got := e.user.Can(e.perm); got != e.want {
+			t.Errorf("%s: expected %v, got %v", e.name, e.want, got)
+		}
+	}
+}
@@ -0,0 +1,687 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Subscription statuses, as the payment provider names them. A subscription whose collection is
+// paused is still active with the provider, but is kept as paused here
+const (
+	SubscriptionStatusActive     = "active"
+	SubscriptionStatusTrialing   = "trialing"
+	SubscriptionStatusPastDue    = "past_due"
+	SubscriptionStatusPaused     = "paused"
+	SubscriptionStatusCanceled   = "canceled"
+	SubscriptionStatusIncomplete = "incomplete"
+	SubscriptionStatusUnpaid     = "unpaid"
+)
+
+// subscriptionStatusNames are the names of the subscription statuses
+var subscriptionStatusNames = map[string]string{
+	SubscriptionStatusActive:     "Active",
+	SubscriptionStatusTrialing:   "Trialing",
+	SubscriptionStatusPastDue:    "Past due",
+	SubscriptionStatusPaused:     "Paused",
+	SubscriptionStatusCanceled:   "Cancelled",
+	SubscriptionStatusIncomplete: "Incomplete",
+	SubscriptionStatusUnpaid:     "Unpaid",
+}
+
+// SubscriptionStatusName returns the name of a subscription status. A subscription which is still
+// running but set to cancel at the end of its billing period is cancelling
+func SubscriptionStatusName(status string, cancelAtPeriodEnd bool) string {
+	if cancelAtPeriodEnd && (status == SubscriptionStatusActive || status == SubscriptionStatusTrialing) {
+		return "Cancelling"
+	}
+	name, ok := subscriptionStatusNames[status]
+	if !ok {
+		return "Unknown"
+	}
+	return name
+}
+
+// Subscription is the local record of a subscription with the payment provider, kept up to date by
+// its webhooks. OrderID is the order it was bought with, and WidgetID the plan it is on now. The
+// period and trial times are nil until the provider has told us about them. HasCard is false for
+// subscriptions started on a free trial without a card
+type Subscription struct {
+	ID                   int        `json:"id"`
+	OrderID              int        `json:"order_id"`
+	CustomerID           int        `json:"customer_id"`
+	WidgetID             int        `json:"widget_id"`
+	StripeSubscriptionID string     `json:"stripe_subscription_id"`
+	Status               string     `json:"status"`
+	StatusName           string     `json:"status_name"`
+	CurrentPeriodStart   *time.Time `json:"current_period_start"`
+	CurrentPeriodEnd     *time.Time `json:"current_period_end"`
+	CancelAtPeriodEnd    bool       `json:"cancel_at_period_end"`
+	TrialEnd             *time.Time `json:"trial_end"`
+	HasCard              bool       `json:"has_card"`
+	Amount               int        `json:"amount"`
+	CreatedAt            time.Time  `json:"created_at"`
+	UpdatedAt            time.Time  `json:"-"`
+	Widget               Widget     `json:"widget"`
+	Customer             Customer   `json:"customer"`
+}
+
+// ErrSamePlan is returned for a plan change to the plan a subscription is already on
+var ErrSamePlan = errors.New("the subscription is already on that plan")
+
+// PlanChange is one entry in the plan history of a subscription. FromWidgetID is zero for the plan
+// it was started on. Amount is the price of the new plan, and ProratedAmount what was charged, or
+// credited if it is negative, for the rest of the billing period when it changed
+type PlanChange struct {
+	ID             int       `json:"id"`
+	OrderID        int       `json:"order_id"`
+	FromWidgetID   int       `json:"from_widget_id"`
+	FromPlan       string    `json:"from_plan"`
+	ToWidgetID     int       `json:"to_widget_id"`
+	ToPlan         string    `json:"to_plan"`
+	Amount         int       `json:"amount"`
+	ProratedAmount int       `json:"prorated_amount"`
+	UserID         int       `json:"user_id"`
+	UserName       string    `json:"user_name"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// insertStartingPlan starts the plan history of a new order, if it is for a subscription
+func insertStartingPlan(ctx context.Context, db execer, orderID int, order Order) error {
+	stmt := `
+		insert into subscription_plan_history
+			(order_id, to_widget_id, amount, created_at)
+		select
+			?, w.id, ?, ?
+		from
+			widgets w
+		where
+			w.id = ? and w.is_recurring = 1`
+
+	_, err := db.ExecContext(ctx, stmt, orderID, order.Amount, time.Now(), order.WidgetID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ChangeSubscriptionPlan moves the subscription paid for by an order to the plan widgetID, which
+// costs amount, on behalf of userID, and records the change in its plan history. proratedAmount is
+// what the payment provider charged for the change
+func (m *DBModel) ChangeSubscriptionPlan(orderID, widgetID, amount, proratedAmount, userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		var from int
+		row := tx.QueryRowContext(ctx, `select widget_id from orders where id = ? for update`, orderID)
+		err := row.Scan(&from)
+		if err != nil {
+			return err
+		}
+		if from == widgetID {
+			return ErrSamePlan
+		}
+
+		stmt := `update orders set widget_id = ?, amount = ?, updated_at = ? where id = ?`
+		_, err = tx.ExecContext(ctx, stmt, widgetID, amount, time.Now(), orderID)
+		if err != nil {
+			return err
+		}
+
+		stmt = `update subscriptions set widget_id = ?, updated_at = ? where order_id = ?`
+		_, err = tx.ExecContext(ctx, stmt, widgetID, time.Now(), orderID)
+		if err != nil {
+			return err
+		}
+
+		stmt = `
+			insert into subscription_plan_history
+				(order_id, from_widget_id, to_widget_id, amount, prorated_amount, user_id, created_at)
+			values (?, ?, ?, ?, ?, ?, ?)`
+
+		_, err = tx.ExecContext(ctx, stmt, orderID, from, widgetID, amount, proratedAmount, nullIfZero(userID), time.Now())
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// GetSubscriptionPlanHistory returns the plan history of the subscription paid for by an order,
+// oldest first
+func (m *DBModel) GetSubscriptionPlanHistory(orderID int) ([]*PlanChange, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var history []*PlanChange
+
+	query := `
+		select
+			h.id, h.order_id, coalesce(h.from_widget_id, 0), coalesce(fw.name, ''), h.to_widget_id, tw.name,
+			h.amount, h.prorated_amount, coalesce(h.user_id, 0), u.first_name, u.last_name, h.created_at
+		from
+			subscription_plan_history h
+			left join widgets fw on (h.from_widget_id = fw.id)
+			left join widgets tw on (h.to_widget_id = tw.id)
+			left join users u on (h.user_id = u.id)
+		where
+			h.order_id = ?
+		order by
+			h.created_at, h.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var c PlanChange
+		var firstName, lastName string
+		err = rows.Scan(
+			&c.ID,
+			&c.OrderID,
+			&c.FromWidgetID,
+			&c.FromPlan,
+			&c.ToWidgetID,
+			&c.ToPlan,
+			&c.Amount,
+			&c.ProratedAmount,
+			&c.UserID,
+			m.opened(&firstName),
+			m.opened(&lastName),
+			&c.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		c.UserName = strings.TrimSpace(firstName + " " + lastName)
+		history = append(history, &c)
+	}
+
+	return history, rows.Err()
+}
+
+// insertSubscription adds a subscription inside tx, and returns its id
+func insertSubscription(ctx context.Context, db execer, s Subscription) (int, error) {
+	stmt := `
+		insert into subscriptions
+			(order_id, customer_id, widget_id, stripe_subscription_id, status, current_period_start,
+			current_period_end, cancel_at_period_end, trial_end, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := db.ExecContext(ctx, stmt,
+		s.OrderID,
+		s.CustomerID,
+		s.WidgetID,
+		s.StripeSubscriptionID,
+		s.Status,
+		s.CurrentPeriodStart,
+		s.CurrentPeriodEnd,
+		s.CancelAtPeriodEnd,
+		s.TrialEnd,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// CreateSubscriptionTx saves the order for a new subscription, as CreateOrderTx does, along with
+// the subscription s, and links the transaction which paid for its first billing cycle to it. It
+// returns the id of the order
+func (m *DBModel) CreateSubscriptionTx(c Customer, txn Transaction, order Order, s Subscription) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var orderID int
+
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		saved, err := m.createOrder(ctx, tx, c, txn, order)
+		if err != nil {
+			return err
+		}
+
+		s.OrderID = saved.ID
+		s.CustomerID = saved.CustomerID
+		s.WidgetID = saved.WidgetID
+		subscriptionID, err := insertSubscription(ctx, tx, s)
+		if err != nil {
+			return err
+		}
+
+		stmt := `update transactions set subscription_id = ? where id = ?`
+		_, err = tx.ExecContext(ctx, stmt, subscriptionID, saved.TransactionID)
+		if err != nil {
+			return err
+		}
+
+		orderID = saved.ID
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return orderID, nil
+}
+
+// UpdateSubscriptionStatus moves the order for a subscription to orderStatusID on behalf of userID,
+// as UpdateOrderStatus does, and sets the status of the subscription to match. An empty status
+// leaves the subscription's status as it is, for changes which do not change it with the payment
+// provider, such as cancelling at the end of a trial
+func (m *DBModel) UpdateSubscriptionStatus(orderID, orderStatusID, userID int, status string, cancelAtPeriodEnd bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		from, recurring, err := lockOrderStatus(ctx, tx, orderID)
+		if err != nil {
+			return err
+		}
+
+		err = changeOrderStatus(ctx, tx, orderID, recurring, from, orderStatusID, userID, "")
+		if err != nil {
+			return err
+		}
+
+		stmt := `
+			update subscriptions set
+				status = coalesce(nullif(?, ''), status),
+				cancel_at_period_end = ?,
+				updated_at = ?
+			where
+				order_id = ?`
+		_, err = tx.ExecContext(ctx, stmt, status, cancelAtPeriodEnd, time.Now(), orderID)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// SyncSubscriptionTx updates the subscription with s's payment provider id to the status, billing
+// period and trial in s, inside tx. Subscriptions we have no record of are ignored
+func (m *DBModel) SyncSubscriptionTx(ctx context.Context, tx *sql.Tx, s Subscription) error {
+	stmt := `
+		update subscriptions set
+			status = ?, current_period_start = ?, current_period_end = ?, cancel_at_period_end = ?,
+			trial_end = ?, updated_at = ?
+		where
+			stripe_subscription_id = ?`
+
+	_, err := tx.ExecContext(ctx, stmt,
+		s.Status,
+		s.CurrentPeriodStart,
+		s.CurrentPeriodEnd,
+		s.CancelAtPeriodEnd,
+		s.TrialEnd,
+		time.Now(),
+		s.StripeSubscriptionID,
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RecordRenewalTx records txn as the payment for one billing cycle of the subscription with the
+// payment provider id stripeSubID, inside tx, and moves the subscription on to txn's period if it
+// cleared. Each cycle has one transaction, found by its invoice id: a declined payment which is
+// retried and paid is cleared, but a cleared one is never declined again. Subscriptions we have no
+// record of are ignored
+func (m *DBModel) RecordRenewalTx(ctx context.Context, tx *sql.Tx, stripeSubID string, txn Transaction) error {
+	row := tx.QueryRowContext(ctx, `select id from subscriptions where stripe_subscription_id = ? for update`, stripeSubID)
+	err := row.Scan(&txn.SubscriptionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var id, statusID int
+	row = tx.QueryRowContext(ctx, `select id, transaction_status_id from transactions where invoice_id = ? for update`, txn.InvoiceID)
+	err = row.Scan(&id, &statusID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		_, err = m.insertTransaction(ctx, tx, txn)
+		if err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case statusID == TransactionStatusDeclined && txn.TransactionStatusID == TransactionStatusCleared:
+		stmt := `
+			update transactions set
+				amount = ?,
+				payment_intent = coalesce(?, payment_intent),
+				transaction_status_id = ?,
+				updated_at = ?
+			where
+				id = ?`
+
+		var paymentIntent interface{}
+		if txn.PaymentIntent != "" {
+			paymentIntent = txn.PaymentIntent
+		}
+
+		_, err = tx.ExecContext(ctx, stmt, txn.Amount, paymentIntent, txn.TransactionStatusID, time.Now(), id)
+		if err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	if txn.TransactionStatusID != TransactionStatusCleared {
+		return nil
+	}
+
+	stmt := `
+		update subscriptions set
+			current_period_start = coalesce(?, current_period_start),
+			current_period_end = coalesce(?, current_period_end),
+			updated_at = ?
+		where
+			id = ?`
+
+	_, err = tx.ExecContext(ctx, stmt, txn.PeriodStart, txn.PeriodEnd, time.Now(), txn.SubscriptionID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// subscriptionColumns are the columns scanned by scanSubscription, from subscriptions s joined to
+// orders o, widgets w and customers c
+const subscriptionColumns = `
+	s.id, s.order_id, s.customer_id, s.widget_id, s.stripe_subscription_id, s.status,
+	s.current_period_start, s.current_period_end, s.cancel_at_period_end, s.trial_end,
+	t.payment_method <> '', s.created_at, s.updated_at, o.amount, w.id, w.name, w.slug, w.price,
+	w.is_recurring, w.plan_interval, w.intro_price, w.intro_cycles, c.id, c.first_name, c.last_name, c.email`
+
+// subscriptionTables are the tables subscriptionColumns are selected from
+const subscriptionTables = `
+	subscriptions s
+	inner join orders o on (s.order_id = o.id)
+	inner join transactions t on (o.transaction_id = t.id)
+	inner join widgets w on (s.widget_id = w.id)
+	inner join customers c on (s.customer_id = c.id)`
+
+// scanSubscription scans one subscription selected with subscriptionColumns into s
+func (m *DBModel) scanSubscription(row scanner, s *Subscription) error {
+	var periodStart, periodEnd, trialEnd sql.NullTime
+	err := row.Scan(
+		&s.ID,
+		&s.OrderID,
+		&s.CustomerID,
+		&s.WidgetID,
+		&s.StripeSubscriptionID,
+		&s.Status,
+		&periodStart,
+		&periodEnd,
+		&s.CancelAtPeriodEnd,
+		&trialEnd,
+		&s.HasCard,
+		&s.CreatedAt,
+		&s.UpdatedAt,
+		&s.Amount,
+		&s.Widget.ID,
+		&s.Widget.Name,
+		&s.Widget.Slug,
+		&s.Widget.Price,
+		&s.Widget.IsRecurring,
+		&s.Widget.PlanInterval,
+		&s.Widget.IntroPrice,
+		&s.Widget.IntroCycles,
+		&s.Customer.ID,
+		m.opened(&s.Customer.FirstName),
+		m.opened(&s.Customer.LastName),
+		m.opened(&s.Customer.Email),
+	)
+	if err != nil {
+		return err
+	}
+
+	if periodStart.Valid {
+		s.CurrentPeriodStart = &periodStart.Time
+	}
+	if periodEnd.Valid {
+		s.CurrentPeriodEnd = &periodEnd.Time
+	}
+	if trialEnd.Valid {
+		s.TrialEnd = &trialEnd.Time
+	}
+	s.StatusName = SubscriptionStatusName(s.Status, s.CancelAtPeriodEnd)
+	return nil
+}
+
+// GetSubscriptionByOrderID returns the subscription bought with an order
+func (m *DBModel) GetSubscriptionByOrderID(orderID int) (Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var s Subscription
+
+	query := `
+		select` + subscriptionColumns + `
+		from` + subscriptionTables + `
+		where
+			s.order_id = ?`
+
+	err := m.scanSubscription(m.DB.QueryRowContext(ctx, query, orderID), &s)
+	if err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// GetTrialsEndingBefore returns the subscriptions on a free trial which ends between now and t,
+// whose customers have not been reminded of it yet
+func (m *DBModel) GetTrialsEndingBefore(t time.Time) ([]*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var subscriptions []*Subscription
+
+	query := `
+		select` + subscriptionColumns + `
+		from` + subscriptionTables + `
+		where
+			s.status = ? and s.trial_end > ? and s.trial_end <= ? and s.trial_reminder_sent_at is null
+		order by
+			s.trial_end`
+
+	rows, err := m.DB.QueryContext(ctx, query, SubscriptionStatusTrialing, time.Now(), t)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var s Subscription
+		err = m.scanSubscription(rows, &s)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, &s)
+	}
+
+	return subscriptions, rows.Err()
+}
+
+// ClaimTrialReminder marks the trial ending reminder for a subscription as sent, and reports whether
+// this call did so. Only the caller which claims the reminder should send it, so a customer is not
+// reminded twice when reminders are sent from more than one place at once
+func (m *DBModel) ClaimTrialReminder(id int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		update subscriptions set
+			trial_reminder_sent_at = ?,
+			updated_at = ?
+		where
+			id = ? and trial_reminder_sent_at is null`
+
+	result, err := m.DB.ExecContext(ctx, stmt, time.Now(), time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows == 1, nil
+}
+
+// ReleaseTrialReminder gives back a claimed trial ending reminder which could not be sent, so it is
+// tried again
+func (m *DBModel) ReleaseTrialReminder(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update subscriptions set trial_reminder_sent_at = null, updated_at = ? where id = ?`
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetAllSubscriptionsPaginated returns a page of subscriptions, newest first, with the last page
+// number and the number of subscriptions
+func (m *DBModel) GetAllSubscriptionsPaginated(pageSize, page int) ([]*Subscription, int, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	offset := (page - 1) * pageSize
+
+	var subscriptions []*Subscription
+
+	query := `
+		select` + subscriptionColumns + `
+		from` + subscriptionTables + `
+		order by
+			s.created_at desc, s.id desc
+		limit ? offset ?`
+
+	rows, err := m.DB.QueryContext(ctx, query, pageSize, offset)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var s Subscription
+		err = m.scanSubscription(rows, &s)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		subscriptions = append(subscriptions, &s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	var totalRecords int
+	countRow := m.DB.QueryRowContext(ctx, `select count(id) from subscriptions`)
+	err = countRow.Scan(&totalRecords)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	// a part filled page at the end is still a page
+	lastPage := (totalRecords + pageSize - 1) / pageSize
+
+	return subscriptions, lastPage, totalRecords, nil
+}
+
+// GetSubscriptionTransactions returns the transactions which paid for the billing cycles of the
+// subscription bought with an order, oldest first
+func (m *DBModel) GetSubscriptionTransactions(orderID int) ([]*Transaction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var txns []*Transaction
+
+	query := `
+		select
+			t.id, t.amount, t.currency, coalesce(t.payment_intent, ''), coalesce(t.invoice_id, ''), t.period_start,
+			t.period_end, t.transaction_status_id, t.created_at
+		from
+			transactions t
+			inner join subscriptions s on (t.subscription_id = s.id)
+		where
+			s.order_id = ?
+		order by
+			t.created_at, t.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var t Transaction
+		var periodStart, periodEnd sql.NullTime
+		err = rows.Scan(
+			&t.ID,
+			&t.Amount,
+			&t.Currency,
+			&t.PaymentIntent,
+			&t.InvoiceID,
+			&periodStart,
+			&periodEnd,
+			&t.TransactionStatusID,
+			&t.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if periodStart.Valid {
+			t.PeriodStart = &periodStart.Time
+		}
+		if periodEnd.Valid {
+			t.PeriodEnd = &periodEnd.Time
+		}
+		txns = append(txns, &t)
+	}
+
+	return txns, rows.Err()
+}
@@ -0,0 +1,26 @@
+package models
+
+import "testing"
+
+func TestSubscriptionStatusName(t *testing.T) {
+	var tests = []struct {
+		name              string
+		status            string
+		cancelAtPeriodEnd bool
+		want              string
+	}{
+		{"active", SubscriptionStatusActive, false, "Active"},
+		{"active and cancelling", SubscriptionStatusActive, true, "Cancelling"},
+		{"trialing and cancelling", SubscriptionStatusTrialing, true, "Cancelling"},
+		{"past due", SubscriptionStatusPastDue, false, "Past due"},
+		{"paused", SubscriptionStatusPaused, false, "Paused"},
+		{"cancelled", SubscriptionStatusCanceled, true, "Cancelled"},
+		{"unknown", "incomplete_expired", false, "Unknown"},
+	}
+
+	for _, e := range tests {
+		if got := SubscriptionStatusName(e.status, e.cancelAtPeriodEnd); got != e.want {
+			t.Errorf("%s: expected %s, got %s", e.name, e.want, got)
+		}
+	}
+}
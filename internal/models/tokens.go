@@ -1,9 +1,11 @@
 package models
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/base32"
 	"log"
 	"time"
@@ -13,13 +15,24 @@ const (
 	ScopeAuthentication = "authentication"
 )
 
+// tokenTouchInterval is how often a token's last used time is updated, so that every api call
+// does not write to the database
+const tokenTouchInterval = time.Minute
+
 // Token is the type for authentication tokens
 type Token struct {
-	PlainText string    `json:"token"`
-	UserID    int64     `json:"-"`
-	Hash      []byte    `json:"-"`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	ID         int        `json:"id"`
+	PlainText  string     `json:"token,omitempty"`
+	UserID     int64      `json:"-"`
+	Hash       []byte     `json:"-"`
+	Expiry     time.Time  `json:"expiry"`
+	Scope      string     `json:"-"`
+	Name       string     `json:"name"`
+	Device     string     `json:"device"`
+	IPAddress  string     `json:"ip_address"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Current    bool       `json:"current"`
 }
 
 // GenerateToken generates a token that lasts for ttl, and returns it
@@ -42,27 +55,30 @@ func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error)
 	return token, nil
 }
 
+// InsertToken saves a new token for user. A user can hold many tokens, one for each browser or
+// device they log in from; only their expired tokens are removed
 func (m *DBModel) InsertToken(token *Token, user User) error {
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 	defer cancel()
 
-	// delete existing tokens
-	query := `delete from tokens where user_id = ?`
-	_, err := m.DB.ExecContext(ctx, query, user.ID)
+	// delete expired tokens
+	query := `delete from tokens where user_id = ? and expiry <= ?`
+	_, err := m.DB.ExecContext(ctx, query, user.ID, time.Now())
 	if err != nil {
 		return err
 	}
 
 	query = `
 		insert into tokens
-			(user_id, name, email, token_hash, expiry, created_at, updated_at)
-		values (?, ?, ?, ?, ?, ?, ?)`
+			(user_id, name, device, ip_address, token_hash, expiry, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?)`
 
 	_, err = m.DB.ExecContext(ctx, query,
 		user.ID,
-		user.LastName,
-		user.Email,
+		token.Name,
+		token.Device,
+		token.IPAddress,
 		token.Hash,
 		token.Expiry,
 		time.Now(),
@@ -84,19 +100,23 @@ func (m *DBModel) GetUserForToken(token string) (*User, error) {
 
 	query := `
 		select
-			u.id, u.first_name, u.last_name, u.email
+			u.id, u.first_name, u.last_name, u.email, u.role, ` + twoFactorColumns + `
 		from
 			users u
 			inner join tokens t on (u.id = t.user_id)
+			` + twoFactorJoin + `
 		where
 			t.token_hash = ?
 			and t.expiry > ?
 	`
 	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], time.Now()).Scan(
 		&user.ID,
-		&user.FirstName,
-		&user.LastName,
-		&user.Email,
+		m.opened(&user.FirstName),
+		m.opened(&user.LastName),
+		m.opened(&user.Email),
+		&user.Role,
+		&user.TwoFactorEnabled,
+		&user.TwoFactorRequired,
 	)
 
 	if err != nil {
@@ -104,5 +124,116 @@ func (m *DBModel) GetUserForToken(token string) (*User, error) {
 		return nil, err
 	}
 
+	_, err = m.DB.ExecContext(ctx, `
+		update tokens set last_used_at = ?
+		where token_hash = ? and (last_used_at is null or last_used_at < ?)`,
+		time.Now(), tokenHash[:], time.Now().Add(-tokenTouchInterval))
+	if err != nil {
+		log.Println(err)
+	}
+
 	return &user, nil
 }
+
+// GetTokensForUser returns the unexpired tokens of a user, newest first. The token matching
+// current (the plain text token of the caller) is marked as Current
+func (m *DBModel) GetTokensForUser(userID int, current string) ([]*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var tokens []*Token
+	currentHash := sha256.Sum256([]byte(current))
+
+	query := `
+		select
+			id, user_id, token_hash, name, device, ip_address, expiry, created_at, last_used_at
+		from
+			tokens
+		where
+			user_id = ? and expiry > ?
+		order by
+			created_at desc`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var t Token
+		var lastUsed sql.NullTime
+		err = rows.Scan(
+			&t.ID,
+			&t.UserID,
+			&t.Hash,
+			&t.Name,
+			&t.Device,
+			&t.IPAddress,
+			&t.Expiry,
+			&t.CreatedAt,
+			&lastUsed,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if lastUsed.Valid {
+			t.LastUsedAt = &lastUsed.Time
+		}
+		t.Current = bytes.Equal(t.Hash, currentHash[:])
+		tokens = append(tokens, &t)
+	}
+
+	return tokens, rows.Err()
+}
+
+// DeleteToken revokes one token, by its plain text
+func (m *DBModel) DeleteToken(token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tokenHash := sha256.Sum256([]byte(token))
+	_, err := m.DB.ExecContext(ctx, "delete from tokens where token_hash = ?", tokenHash[:])
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteTokenForUser revokes one of a user's tokens, by its id. It returns sql.ErrNoRows if the user
+// has no such token
+func (m *DBModel) DeleteTokenForUser(id, userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, "delete from tokens where id = ? and user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteTokensForUser revokes every token a user holds, logging them out everywhere
+func (m *DBModel) DeleteTokensForUser(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, "delete from tokens where user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"strings"
+	"time"
+)
+
+// twoFactorColumns and twoFactorJoin add TwoFactorEnabled and TwoFactorRequired to a query on users u
+const (
+	twoFactorColumns = `u.totp_enabled_at is not null, coalesce(rs.require_two_factor, 0) = 1`
+	twoFactorJoin    = `left join role_settings rs on (rs.role = u.role)`
+)
+
+// RecoveryCodeCount is how many recovery codes a user gets when they turn on two factor authentication
+const RecoveryCodeCount = 10
+
+// RoleSetting is the type for per role settings
+type RoleSetting struct {
+	Role             Role `json:"role"`
+	RequireTwoFactor bool `json:"require_two_factor"`
+}
+
+// GenerateRecoveryCodes returns n new recovery codes, formatted as XXXXX-XXXXX, and their hashes
+func GenerateRecoveryCodes(n int) ([]string, [][]byte, error) {
+	var codes []string
+	var hashes [][]byte
+
+	for i := 0; i < n; i++ {
+		b := make([]byte, 7)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode hashes a recovery code, ignoring case, spaces and dashes
+func HashRecoveryCode(code string) []byte {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// GetTwoFactorSecret returns a user's (encrypted) totp secret, and whether two factor is turned on
+func (m *DBModel) GetTwoFactorSecret(userID int) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var secret string
+	var enabled bool
+
+	row := m.DB.QueryRowContext(ctx, "select totp_secret, totp_enabled_at is not null from users where id = ?", userID)
+	err := row.Scan(&secret, &enabled)
+	if err != nil {
+		return "", false, err
+	}
+	return secret, enabled, nil
+}
+
+// SetTwoFactorSecret stores a new (encrypted) totp secret for a user who is setting up two factor
+// authentication. It does nothing once two factor is turned on, so a stolen token cannot replace
+// the secret; it must be turned off or reset first
+func (m *DBModel) SetTwoFactorSecret(userID int, secret string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		update users set
+			totp_secret = ?, totp_last_step = 0, updated_at = ?
+		where
+			id = ? and totp_enabled_at is null`
+
+	result, err := m.DB.ExecContext(ctx, stmt, secret, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// EnableTwoFactor turns on two factor authentication for a user, once they have proved their app
+// works with a code from step, and replaces their recovery codes
+func (m *DBModel) EnableTwoFactor(userID int, step int64, recoveryHashes [][]byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		stmt := `
+			update users set
+				totp_enabled_at = ?, totp_last_step = ?, updated_at = ?
+			where
+				id = ? and totp_enabled_at is null and totp_secret <> ''`
+
+		result, err := tx.ExecContext(ctx, stmt, time.Now(), step, time.Now(), userID)
+		if err != nil {
+			return err
+		}
+
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows == 0 {
+			return sql.ErrNoRows
+		}
+
+		_, err = tx.ExecContext(ctx, "delete from user_recovery_codes where user_id = ?", userID)
+		if err != nil {
+			return err
+		}
+
+		for _, hash := range recoveryHashes {
+			_, err = tx.ExecContext(ctx, `
+				insert into user_recovery_codes (user_id, code_hash, created_at, updated_at)
+				values (?, ?, ?, ?)`, userID, hash, time.Now(), time.Now())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UseTwoFactorStep records that a user's code for step has been used. It returns false if a code for
+// that step (or a later one) was already used, so every code works only once
+func (m *DBModel) UseTwoFactorStep(userID int, step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, "update users set totp_last_step = ? where id = ? and totp_last_step < ?",
+		step, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows == 1, nil
+}
+
+// UseRecoveryCode uses up one of a user's recovery codes. It returns false if the code is wrong or
+// has already been used
+func (m *DBModel) UseRecoveryCode(userID int, code string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		update user_recovery_codes set
+			used_at = ?, updated_at = ?
+		where
+			user_id = ? and code_hash = ? and used_at is null`
+
+	result, err := m.DB.ExecContext(ctx, stmt, time.Now(), time.Now(), userID, HashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left
+func (m *DBModel) CountRecoveryCodes(userID int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+	row := m.DB.QueryRowContext(ctx, "select count(*) from user_recovery_codes where user_id = ? and used_at is null", userID)
+	err := row.Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// ResetTwoFactor turns off two factor authentication for a user, and removes their secret and
+// recovery codes
+func (m *DBModel) ResetTwoFactor(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *sql.Tx) error {
+		stmt := `
+			update users set
+				totp_secret = '', totp_enabled_at = null, totp_last_step = 0, updated_at = ?
+			where
+				id = ?`
+
+		_, err := tx.ExecContext(ctx, stmt, time.Now(), userID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "delete from user_recovery_codes where user_id = ?", userID)
+		return err
+	})
+}
+
+// GetRoleSettings returns the settings for every role
+func (m *DBModel) GetRoleSettings() ([]*RoleSetting, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	required := make(map[Role]bool)
+
+	rows, err := m.DB.QueryContext(ctx, "select role, require_two_factor from role_settings")
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var role Role
+		var require bool
+		err = rows.Scan(&role, &require)
+		if err != nil {
+			return nil, err
+		}
+		required[role] = require
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var settings []*RoleSetting
+	for _, role := range Roles {
+		settings = append(settings, &RoleSetting{Role: role, RequireTwoFactor: required[role]})
+	}
+	return settings, nil
+}
+
+// UpdateRoleSetting saves the settings for one role
+func (m *DBModel) UpdateRoleSetting(s RoleSetting) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		insert into role_settings (role, require_two_factor, created_at, updated_at)
+		values (?, ?, ?, ?)
+		on duplicate key update require_two_factor = values(require_two_factor), updated_at = values(updated_at)`
+
+	_, err := m.DB.ExecContext(ctx, stmt, s.Role, s.RequireTwoFactor, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+	return nil
+}
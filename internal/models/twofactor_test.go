@@ -0,0 +1,42 @@
+package models
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+)
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, hashes, err := GenerateRecoveryCodes(RecoveryCodeCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodeCount || len(hashes) != RecoveryCodeCount {
+		t.Fatalf("expected %d codes, got %d codes and %d hashes", RecoveryCodeCount, len(codes), len(hashes))
+	}
+
+	format := regexp.MustCompile(`^[A-Z2-7]{5}-[A-Z2-7]{5}$`)
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("unexpected code format %q", code)
+		}
+		if seen[code] {
+			t.Errorf("duplicate code %q", code)
+		}
+		seen[code] = true
+
+		if !bytes.Equal(hashes[i], HashRecoveryCode(code)) {
+			t.Errorf("hash for %q does not match", code)
+		}
+	}
+}
+
+func TestHashRecoveryCode_Normalises(t *testing.T) {
+	want := HashRecoveryCode("ABCDE-FGHIJ")
+	for _, code := range []string{"abcde-fghij", "ABCDEFGHIJ", "abcde fghij"} {
+		if !bytes.Equal(HashRecoveryCode(code), want) {
+			t.Errorf("%q should hash the same as ABCDE-FGHIJ", code)
+		}
+	}
+}
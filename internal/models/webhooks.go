@@ -0,0 +1,100 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// WebhookEvent is the type for events received from the payment provider
+type WebhookEvent struct {
+	ID          int          `json:"id"`
+	EventID     string       `json:"event_id"`
+	EventType   string       `json:"event_type"`
+	Payload     string       `json:"payload"`
+	ProcessedAt sql.NullTime `json:"-"`
+	CreatedAt   time.Time    `json:"-"`
+	UpdatedAt   time.Time    `json:"-"`
+}
+
+// InsertWebhookEvent stores a webhook event, ignoring events we have already received
+func (m *DBModel) InsertWebhookEvent(e WebhookEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		insert ignore into webhook_events
+			(event_id, event_type, payload, created_at, updated_at)
+		values (?, ?, ?, ?, ?)`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		e.EventID,
+		e.EventType,
+		e.Payload,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ProcessWebhookEvent claims a stored webhook event and runs fn in the same database transaction.
+// The claim sets processed_at only if it is still null, so of two concurrent deliveries of one
+// event only one runs fn; the other waits on the row lock and then finds the event claimed. If fn
+// fails the claim is rolled back with fn's writes, and the next delivery tries again. It returns
+// false if the event had already been processed
+func (m *DBModel) ProcessWebhookEvent(eventID string, fn func(ctx context.Context, tx *sql.Tx) error) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	claimed := false
+
+	err := m.WithTx(ctx, func(tx *sql.Tx) error {
+		stmt := `
+			update webhook_events set
+				processed_at = ?,
+				updated_at = ?
+			where
+				event_id = ? and processed_at is null`
+
+		result, err := tx.ExecContext(ctx, stmt, time.Now(), time.Now(), eventID)
+		if err != nil {
+			return err
+		}
+
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows == 0 {
+			return nil
+		}
+
+		claimed = true
+		return fn(ctx, tx)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return claimed, nil
+}
+
+// UpdateTransactionStatusByPaymentIntentTx sets the status of the transaction for a payment intent
+// (or, for subscriptions, a subscription id) inside tx
+func (m *DBModel) UpdateTransactionStatusByPaymentIntentTx(ctx context.Context, tx *sql.Tx, pi string, statusID int) error {
+	stmt := `
+		update transactions set
+			transaction_status_id = ?,
+			updated_at = ?
+		where
+			payment_intent = ?`
+
+	_, err := tx.ExecContext(ctx, stmt, statusID, time.Now(), pi)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// widgetColumns is the column list scanned by scanWidget
+const widgetColumns = `id, name, slug, description, inventory_level, price, coalesce(image, ''), thumbnail, is_recurring, plan_id,
+			plan_interval, trial_days, trial_without_card, intro_price, intro_cycles, intro_coupon_id, archived_at is not null, created_at,
+			updated_at`
+
+// scanner is satisfied by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanWidget scans one widget selected with widgetColumns
+func scanWidget(row scanner) (Widget, error) {
+	var widget Widget
+
+	err := row.Scan(
+		&widget.ID,
+		&widget.Name,
+		&widget.Slug,
+		&widget.Description,
+		&widget.InventoryLevel,
+		&widget.Price,
+		&widget.Image,
+		&widget.Thumbnail,
+		&widget.IsRecurring,
+		&widget.PlanID,
+		&widget.PlanInterval,
+		&widget.TrialDays,
+		&widget.TrialWithoutCard,
+		&widget.IntroPrice,
+		&widget.IntroCycles,
+		&widget.IntroCouponID,
+		&widget.IsArchived,
+		&widget.CreatedAt,
+		&widget.UpdatedAt,
+	)
+	if err != nil {
+		return widget, err
+	}
+
+	return widget, nil
+}
+
+// Plan intervals, how often a plan is billed
+const (
+	PlanIntervalMonth = "month"
+	PlanIntervalYear  = "year"
+)
+
+// IntervalMonths returns how many months a billing cycle of a plan lasts
+func (w Widget) IntervalMonths() int {
+	if w.PlanInterval == PlanIntervalYear {
+		return 12
+	}
+	return 1
+}
+
+// BillingFrequency describes how often a plan is billed, such as "monthly"
+func (w Widget) BillingFrequency() string {
+	if w.PlanInterval == PlanIntervalYear {
+		return "yearly"
+	}
+	return "monthly"
+}
+
+// HasIntro reports whether a plan charges an introductory price for its first cycles
+func (w Widget) HasIntro() bool {
+	return w.IsRecurring && w.IntroCycles > 0 && w.IntroPrice < w.Price
+}
+
+// CyclePrice returns what a plan charges for its nth paid billing cycle, counting from 1
+func (w Widget) CyclePrice(n int) int {
+	if w.HasIntro() && n <= w.IntroCycles {
+		return w.IntroPrice
+	}
+	return w.Price
+}
+
+// FirstCharge returns what subscribing to a plan charges straight away: nothing during a free
+// trial, and the price of the first cycle otherwise
+func (w Widget) FirstCharge() int {
+	if w.IsRecurring && w.TrialDays > 0 {
+		return 0
+	}
+	return w.CyclePrice(1)
+}
+
+// GetWidgetBySlug gets one widget by its slug
+func (m *DBModel) GetWidgetBySlug(slug string) (Widget, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, `
+		select
+			`+widgetColumns+`
+		from
+			widgets
+		where slug = ?`, slug)
+
+	return scanWidget(row)
+}
+
+// GetAllWidgets returns all widgets, optionally including archived ones
+func (m *DBModel) GetAllWidgets(includeArchived bool) ([]*Widget, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var widgets []*Widget
+
+	query := `
+		select
+			` + widgetColumns + `
+		from
+			widgets
+		where
+			? or archived_at is null
+		order by
+			is_recurring, name`
+
+	rows, err := m.DB.QueryContext(ctx, query, includeArchived)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		widget, err := scanWidget(rows)
+		if err != nil {
+			return nil, err
+		}
+		widgets = append(widgets, &widget)
+	}
+
+	return widgets, rows.Err()
+}
+
+// InsertWidget inserts a new widget, and returns its id
+func (m *DBModel) InsertWidget(widget Widget) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		insert into widgets
+			(name, slug, description, inventory_level, price, image, thumbnail, is_recurring, plan_id,
+			plan_interval, trial_days, trial_without_card, intro_price, intro_cycles, intro_coupon_id, created_at,
+			updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := m.DB.ExecContext(ctx, stmt,
+		widget.Name,
+		widget.Slug,
+		widget.Description,
+		widget.InventoryLevel,
+		widget.Price,
+		widget.Image,
+		widget.Thumbnail,
+		widget.IsRecurring,
+		widget.PlanID,
+		widget.PlanInterval,
+		widget.TrialDays,
+		widget.TrialWithoutCard,
+		widget.IntroPrice,
+		widget.IntroCycles,
+		widget.IntroCouponID,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// UpdateWidget updates an existing widget. Its inventory level is left alone, since sales change
+// it while the widget is being edited; use AdjustInventory for that
+func (m *DBModel) UpdateWidget(widget Widget) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		update widgets set
+			name = ?,
+			slug = ?,
+			description = ?,
+			price = ?,
+			image = ?,
+			thumbnail = ?,
+			is_recurring = ?,
+			plan_id = ?,
+			plan_interval = ?,
+			trial_days = ?,
+			trial_without_card = ?,
+			intro_price = ?,
+			intro_cycles = ?,
+			intro_coupon_id = ?,
+			updated_at = ?
+		where
+			id = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		widget.Name,
+		widget.Slug,
+		widget.Description,
+		widget.Price,
+		widget.Image,
+		widget.Thumbnail,
+		widget.IsRecurring,
+		widget.PlanID,
+		widget.PlanInterval,
+		widget.TrialDays,
+		widget.TrialWithoutCard,
+		widget.IntroPrice,
+		widget.IntroCycles,
+		widget.IntroCouponID,
+		time.Now(),
+		widget.ID,
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ArchiveWidget takes a widget off sale. Widgets are archived rather than deleted, since past orders
+// still refer to them
+func (m *DBModel) ArchiveWidget(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update widgets set archived_at = ?, updated_at = ? where id = ? and archived_at is null`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package models
+
+import "testing"
+
+func TestWidget_FirstCharge(t *testing.T) {
+	var tests = []struct {
+		name   string
+		widget Widget
+		want   int
+	}{
+		{"one-off widget", Widget{Price: 1000}, 1000},
+		{"plan", Widget{Price: 1000, IsRecurring: true}, 1000},
+		{"plan with a trial", Widget{Price: 1000, IsRecurring: true, TrialDays: 14}, 0},
+		{"plan with an intro price", Widget{Price: 1000, IsRecurring: true, IntroPrice: 500, IntroCycles: 3}, 500},
+		{"plan with a free first cycle", Widget{Price: 1000, IsRecurring: true, IntroCycles: 1}, 0},
+		{"intro price above the price", Widget{Price: 1000, IsRecurring: true, IntroPrice: 1500, IntroCycles: 3}, 1000},
+		{"trial and intro price", Widget{Price: 1000, IsRecurring: true, TrialDays: 7, IntroPrice: 500, IntroCycles: 3}, 0},
+	}
+
+	for _, e := range tests {
+		if got := e.widget.FirstCharge(); got != e.want {
+			t.Errorf("%s: expected %d, got %d", e.name, e.want, got)
+		}
+	}
+}
+
+func TestWidget_CyclePrice(t *testing.T) {
+	widget := Widget{Price: 1000, IsRecurring: true, IntroPrice: 500, IntroCycles: 2}
+
+	for n, want := range map[int]int{1: 500, 2: 500, 3: 1000, 12: 1000} {
+		if got := widget.CyclePrice(n); got != want {
+			t.Errorf("cycle %d: expected %d, got %d", n, want, got)
+		}
+	}
+}
+
+func TestWidget_Interval(t *testing.T) {
+	var tests = []struct {
+		interval      string
+		wantMonths    int
+		wantFrequency string
+	}{
+		{PlanIntervalMonth, 1, "monthly"},
+		{PlanIntervalYear, 12, "yearly"},
+		{"", 1, "monthly"},
+	}
+
+	for _, e := range tests {
+		widget := Widget{IsRecurring: true, PlanInterval: e.interval}
+		if got := widget.IntervalMonths(); got != e.wantMonths {
+			t.Errorf("%q: expected %d months, got %d", e.interval, e.wantMonths, got)
+		}
+		if got := widget.BillingFrequency(); got != e.wantFrequency {
+			t.Errorf("%q: expected %s, got %s", e.interval, e.wantFrequency, got)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Storage stores uploaded files by key, and gives each one a url. Keys are slash separated paths,
+// such as "uploads/widgets/abc.jpg"
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+	Delete(ctx context.Context, key string) error
+	URL(key string) string
+}
+
+// ErrInvalidKey is returned for keys which are empty or would escape the storage root
+var ErrInvalidKey = errors.New("invalid storage key")
+
+// New returns the storage matching name. Only "local" is available for now; an S3 compatible
+// store can be added behind the same interface
+func New(name, dir, baseURL string) (Storage, error) {
+	switch name {
+	case "local":
+		return NewLocal(dir, baseURL), nil
+	default:
+		return nil, fmt.Errorf("unknown storage %q", name)
+	}
+}
+
+// Local stores files on local disk, under Dir, and serves them from BaseURL
+type Local struct {
+	Dir     string
+	BaseURL string
+}
+
+// NewLocal returns a Local storage
+func NewLocal(dir, baseURL string) *Local {
+	return &Local{
+		Dir:     dir,
+		BaseURL: strings.TrimRight(baseURL, "/"),
+	}
+}
+
+// path returns the file path for key, refusing keys which are not clean relative paths
+func (l *Local) path(key string) (string, error) {
+	if key == "" || path.IsAbs(key) || path.Clean(key) != key || key == ".." || strings.HasPrefix(key, "../") {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(l.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes r to key. The file is written to a temporary name and renamed into place, so a
+// url never serves a half written file
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), p)
+}
+
+// Delete removes key. Deleting a key which does not exist is not an error
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// URL returns the url key is served from
+func (l *Local) URL(key string) string {
+	return l.BaseURL + "/" + key
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocal_PutAndDelete(t *testing.T) {
+	dir := t.TempDir()
+	l := NewLocal(dir, "/static/")
+
+	err := l.Put(context.Background(), "uploads/widgets/a.jpg", strings.NewReader("image"), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "uploads", "widgets", "a.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "image" {
+		t.Errorf("expected file to contain image, got %q", data)
+	}
+
+	if got := l.URL("uploads/widgets/a.jpg"); got != "/static/uploads/widgets/a.jpg" {
+		t.Errorf("unexpected url %s", got)
+	}
+
+	err = l.Delete(context.Background(), "uploads/widgets/a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Delete(context.Background(), "uploads/widgets/a.jpg")
+	if err != nil {
+		t.Errorf("deleting a missing key should not fail: %s", err)
+	}
+}
+
+func TestLocal_InvalidKeys(t *testing.T) {
+	l := NewLocal(t.TempDir(), "/static")
+
+	var tests = []struct {
+		name string
+		key  string
+	}{
+		{"empty", ""},
+		{"absolute", "/etc/passwd"},
+		{"parent", "../secret"},
+		{"unclean", "uploads/../../secret"},
+	}
+
+	for _, e := range tests {
+		err := l.Put(context.Background(), e.key, strings.NewReader("x"), "text/plain")
+		if !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("%s: expected ErrInvalidKey, got %v", e.name, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Limiter counts failed attempts by key, such as an account or an ip address, and slows down or
+// locks out keys with too many. Limiters must be safe for concurrent use
+type Limiter interface {
+	// Wait returns how long key must wait before its next attempt; zero if it may try now
+	Wait(ctx context.Context, key string) (time.Duration, error)
+	// Fail records a failed attempt for key, and reports whether it locked key out
+	Fail(ctx context.Context, key string) (bool, error)
+	// Reset forgets the failed attempts for key, after a good attempt or an admin unlock
+	Reset(ctx context.Context, key string) error
+}
+
+// Policy sets how a Limiter backs off. After FreeAttempts failures, each further failure doubles
+// the wait, starting at BaseDelay and up to MaxDelay. LockoutAfter failures lock the key out for
+// LockoutFor. Failures are forgotten after Window without one
+type Policy struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	LockoutAfter int
+	LockoutFor   time.Duration
+	Window       time.Duration
+}
+
+// Delay returns the wait after the given number of failures, not counting lockouts
+func (p Policy) Delay(failures int) time.Duration {
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures; i++ {
+		delay *= 2
+		if delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return min(delay, p.MaxDelay)
+}
+
+// New returns the limiter matching name. Only "memory" is available for now, which keeps counts in
+// this process; several api instances need a shared backend behind the same interface
+func New(name string, policy Policy) (Limiter, error) {
+	switch name {
+	case "memory":
+		return NewMemory(policy), nil
+	default:
+		return nil, fmt.Errorf("unknown limiter %q", name)
+	}
+}
+
+// entry is the failure record for one key
+type entry struct {
+	failures    int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// Memory is a Limiter which keeps its counts in memory
+type Memory struct {
+	policy Policy
+	now    func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]*entry
+	lastSweep time.Time
+}
+
+// NewMemory returns a Memory limiter
+func NewMemory(policy Policy) *Memory {
+	return &Memory{
+		policy:  policy,
+		now:     time.Now,
+		entries: make(map[string]*entry),
+	}
+}
+
+// current returns the live entry for key, dropping it if it has expired. The caller holds mu
+func (m *Memory) current(key string, now time.Time) *entry {
+	e, ok := m.entries[key]
+	if !ok {
+		return nil
+	}
+	if m.expired(e, now) {
+		delete(m.entries, key)
+		return nil
+	}
+	return e
+}
+
+// expired reports whether e no longer counts; its lockout is over, or it has had no failures for
+// the policy window
+func (m *Memory) expired(e *entry, now time.Time) bool {
+	if !e.lockedUntil.IsZero() {
+		return !now.Before(e.lockedUntil)
+	}
+	return now.Sub(e.last) > m.policy.Window
+}
+
+// Wait returns how long key must wait before its next attempt
+func (m *Memory) Wait(_ context.Context, key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	e := m.current(key, now)
+	if e == nil {
+		return 0, nil
+	}
+
+	until := e.last.Add(m.policy.Delay(e.failures))
+	if e.lockedUntil.After(until) {
+		until = e.lockedUntil
+	}
+	if !until.After(now) {
+		return 0, nil
+	}
+	return until.Sub(now), nil
+}
+
+// Fail records a failed attempt for key, and reports whether it locked key out
+func (m *Memory) Fail(_ context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	e := m.current(key, now)
+	if e == nil {
+		e = &entry{}
+		m.entries[key] = e
+	}
+
+	e.failures++
+	e.last = now
+	if e.lockedUntil.IsZero() && m.policy.LockoutAfter > 0 && e.failures >= m.policy.LockoutAfter {
+		e.lockedUntil = now.Add(m.policy.LockoutFor)
+		return true, nil
+	}
+	return false, nil
+}
+
+// Reset forgets the failed attempts for key
+func (m *Memory) Reset(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, key)
+	return nil
+}
+
+// sweep drops expired entries, at most once per policy window, so keys which stop failing do not
+// stay in memory. The caller holds mu
+func (m *Memory) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < m.policy.Window {
+		return
+	}
+	m.lastSweep = now
+
+	for key, e := range m.entries {
+		if m.expired(e, now) {
+			delete(m.entries, key)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package throttle
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+var testPolicy = Policy{
+	FreeAttempts: 2,
+	BaseDelay:    time.Second,
+	MaxDelay:     4 * time.Second,
+	LockoutAfter: 6,
+	LockoutFor:   time.Minute,
+	Window:       time.Hour,
+}
+
+func TestPolicy_Delay(t *testing.T) {
+	var tests = []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{20, 4 * time.Second},
+	}
+
+	for _, e := range tests {
+		got := testPolicy.Delay(e.failures)
+		if got != e.want {
+			t.Errorf("%d failures: expected %s, got %s", e.failures, e.want, got)
+		}
+	}
+}
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	m := NewMemory(testPolicy)
+	m.now = func() time.Time { return now }
+
+	wait := func() time.Duration {
+		t.Helper()
+		d, err := m.Wait(ctx, "account:me@here.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	fail := func() bool {
+		t.Helper()
+		locked, err := m.Fail(ctx, "account:me@here.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return locked
+	}
+
+	fail()
+	fail()
+	if d := wait(); d != 0 {
+		t.Errorf("expected no wait after free attempts, got %s", d)
+	}
+
+	fail()
+	if d := wait(); d != time.Second {
+		t.Errorf("expected a 1s wait, got %s", d)
+	}
+
+	now = now.Add(time.Second)
+	if d := wait(); d != 0 {
+		t.Errorf("expected no wait once the delay passed, got %s", d)
+	}
+
+	fail()
+	fail()
+	if fail() != true {
+		t.Fatal("expected the sixth failure to lock the key out")
+	}
+	if fail() != false {
+		t.Error("expected only the failure which locked the key to report it")
+	}
+	if d := wait(); d != time.Minute {
+		t.Errorf("expected a 1m lockout, got %s", d)
+	}
+
+	now = now.Add(time.Minute)
+	if d := wait(); d != 0 {
+		t.Errorf("expected no wait after the lockout, got %s", d)
+	}
+	fail()
+	if d := wait(); d != 0 {
+		t.Errorf("expected the count to restart after a lockout, got %s", d)
+	}
+
+	if d, _ := m.Wait(ctx, "ip:127.0.0.1"); d != 0 {
+		t.Errorf("expected other keys not to wait, got %s", d)
+	}
+
+	for i := 0; i < 5; i++ {
+		fail()
+	}
+	err := m.Reset(ctx, "account:me@here.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := wait(); d != 0 {
+		t.Errorf("expected no wait after a reset, got %s", d)
+	}
+
+	fail()
+	now = now.Add(2 * time.Hour)
+	fail()
+	fail()
+	if d := wait(); d != 0 {
+		t.Errorf("expected old failures to be forgotten, got %s", d)
+	}
+}
+
+func TestNew(t *testing.T) {
+	_, err := New("memory", testPolicy)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = New("redis", testPolicy)
+	if err == nil {
+		t.Error("expected an error for an unknown limiter")
+	}
+}
@@ -0,0 +1,78 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the RFC 6238 test key "12345678901234567890"
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestCode_RFC6238(t *testing.T) {
+	// the RFC lists 8 digit codes; these are their last 6 digits
+	var tests = []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, e := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(e.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != e.want {
+			t.Errorf("at %d: expected %s, got %s", e.unix, e.want, got)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+
+	var tests = []struct {
+		name   string
+		code   string
+		at     time.Time
+		wantOK bool
+	}{
+		{"current code", "005924", now, true},
+		{"code with spaces", "005 924", now, true},
+		{"previous period", "005924", now.Add(Period), true},
+		{"two periods late", "005924", now.Add(2 * Period), false},
+		{"wrong code", "123456", now, false},
+		{"too short", "5924", now, false},
+	}
+
+	for _, e := range tests {
+		step, ok := Validate(rfcSecret, e.code, e.at)
+		if ok != e.wantOK {
+			t.Errorf("%s: expected %v, got %v", e.name, e.wantOK, ok)
+		}
+		if ok && step != Step(now) {
+			t.Errorf("%s: expected step %d, got %d", e.name, Step(now), step)
+		}
+	}
+}
+
+func TestGenerateSecretAndURI(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 32 {
+		t.Errorf("expected a 32 character secret, got %q", secret)
+	}
+
+	uri := ProvisioningURI("Widgets", "admin@example.com", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/Widgets:admin@example.com?") || !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("unexpected uri %s", uri)
+	}
+}
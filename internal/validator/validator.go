@@ -1,5 +1,10 @@
 package validator
 
+import "regexp"
+
+// SlugRX matches url slugs such as "bronze-plan"
+var SlugRX = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
 type Validator struct {
 	Errors map[string]string
 }
@@ -23,3 +28,16 @@ func (v *Validator) Check(ok bool, key, message string) {
 		v.AddError(key, message)
 	}
 }
+
+func Matches(value string, rx *regexp.Regexp) bool {
+	return rx.MatchString(value)
+}
+
+func In(value string, list ...string) bool {
+	for _, item := range list {
+		if value == item {
+			return true
+		}
+	}
+	return false
+}